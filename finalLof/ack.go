@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// ** how far a write goes before it is acknowledged
+type Ack int
+
+const (
+	// ** whatever the sync policy does, which is what WriteLog does
+	AckPolicy Ack = iota
+	// ** flushed and fsynced, survives a crash of the machine
+	AckFsync
+	// ** flushed to the OS but not fsynced, survives a crash of the process
+	AckFlush
+	// ** only queued for the async writer, may be lost with the process
+	AckNone
+)
+
+func (a Ack) String() string {
+	switch a {
+	case AckFsync:
+		return "fsync"
+	case AckFlush:
+		return "flush"
+	case AckNone:
+		return "none"
+	default:
+		return "policy"
+	}
+}
+
+// ** the ack query parameter, empty leaves it to the sync policy
+func parseAck(value string) (Ack, error) {
+	switch value {
+	case "":
+		return AckPolicy, nil
+	case "fsync":
+		return AckFsync, nil
+	case "flush":
+		return AckFlush, nil
+	case "none":
+		return AckNone, nil
+	}
+	return 0, fmt.Errorf("unknown ack %q", value)
+}
+
+// ** append one entry, committed as far as ack asks instead of as the sync
+// ** policy says, and return the level it actually reached
+// ** AckNone cannot be waited for, use WriteLogAsync for it
+func (w *WAL) WriteLogAck(topic string, payload interface{}, ack Ack) (int64, Ack, error) {
+	offset, _, achieved, err := w.writeLogAck(context.Background(), "", LogEntry{Topic: topic, Payload: payload}, ack)
+	return offset, achieved, err
+}
+
+// ** WriteLogIdempotent with an ack level, a repeated id writes nothing but
+// ** still commits what is buffered, so the first write reaches the level too
+func (w *WAL) writeLogAck(ctx context.Context, id string, entry LogEntry, ack Ack) (offset int64, duplicate bool, achieved Ack, err error) {
+	if ack == AckNone {
+		return 0, false, 0, fmt.Errorf("ack none cannot be waited for, write asynchronously")
+	}
+	defer w.metrics.countError(&err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, false, 0, ErrClosed
+	}
+	defer w.traceFrom(ctx)()
+	publish, achieved := w.publishFor(ack)
+	if id != "" {
+		if offset, ok := w.dedup.lookup(id, w.offset); ok {
+			if err := publish(); err != nil {
+				return 0, false, 0, fmt.Errorf("failed to flush log entry: %w", err)
+			}
+			return offset, true, achieved, nil
+		}
+	}
+	offset, err = w.appendLog(id, entry, publish)
+	if err != nil {
+		return 0, false, 0, err
+	}
+	return offset, false, achieved, nil
+}
+
+// ** how appendLog publishes a write for ack and the level that reaches
+// ** must be called with the mutex held
+func (w *WAL) publishFor(ack Ack) (func() error, Ack) {
+	switch ack {
+	case AckFsync:
+		return w.FlushE, AckFsync
+	case AckFlush:
+		return w.flushOnly, AckFlush
+	}
+	if w.syncPolicy.mode == syncAlways {
+		return w.commit, AckFsync
+	}
+	return w.commit, AckFlush
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	archiveCatalogFileName = "wal.archive"
+	archiveWorkers         = 2
+	archiveQueueSize       = 64
+)
+
+// ** ends an archive scan once it reaches entries that are still kept locally
+var errReachedLocal = errors.New("reached local segments")
+
+// ** object storage that closed segments are copied to before they are
+// ** deleted locally, segments are stored under their file name
+type Archiver interface {
+	Upload(ctx context.Context, name string, data io.Reader) error
+	Download(ctx context.Context, name string) (io.ReadCloser, error)
+}
+
+// ** a segment that only exists in the archive any more
+type archivedSegment struct {
+	Index       int    `json:"index"`
+	Name        string `json:"name"`
+	FirstOffset int64  `json:"first_offset"`
+	// ** topics purged after the segment was archived, reads skip their
+	// ** entries since the archived copy is never rewritten
+	Purged []string `json:"purged,omitempty"`
+}
+
+// ** whether entries of topic were purged from the segment
+func (s archivedSegment) purged(topic string) bool {
+	for _, purged := range s.Purged {
+		if purged == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// ** mark topic purged in every archived segment, must be called with the
+// ** mutex held
+func (w *WAL) purgeArchived(topic string) error {
+	if len(w.archive) == 0 {
+		return nil
+	}
+	catalog := make([]archivedSegment, len(w.archive))
+	for i, segment := range w.archive {
+		if !segment.purged(topic) {
+			// ** a fresh slice, snapshots may still be reading the old catalog
+			segment.Purged = append(append([]string(nil), segment.Purged...), topic)
+		}
+		catalog[i] = segment
+	}
+	if err := writeArchiveCatalog(w.fs, w.directory, catalog); err != nil {
+		return err
+	}
+	w.archive = catalog
+	return nil
+}
+
+// ** archived segments in ascending order, empty if nothing was archived yet
+func readArchiveCatalog(fs fileSystem, directory string) ([]archivedSegment, error) {
+	data, err := readFile(fs, filepath.Join(directory, archiveCatalogFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive catalog: %w", err)
+	}
+	var catalog []archivedSegment
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("failed to decode archive catalog: %w", err)
+	}
+	return catalog, nil
+}
+
+func writeArchiveCatalog(fs fileSystem, directory string, catalog []archivedSegment) error {
+	data, err := json.Marshal(catalog)
+	if err != nil {
+		return fmt.Errorf("failed to encode archive catalog: %w", err)
+	}
+	if err := writeFileAtomic(fs, filepath.Join(directory, archiveCatalogFileName), data); err != nil {
+		return fmt.Errorf("failed to write archive catalog: %w", err)
+	}
+	return nil
+}
+
+// ** start the upload workers, rotated segments are handed to them through archiveQueue
+func (w *WAL) startArchiver() {
+	if w.archiver == nil {
+		return
+	}
+	w.archiveQueue = make(chan int, archiveQueueSize)
+	for i := 0; i < archiveWorkers; i++ {
+		w.archiveWorkers.Add(1)
+		go w.archiveLoop()
+	}
+}
+
+func (w *WAL) archiveLoop() {
+	defer w.archiveWorkers.Done()
+	for index := range w.archiveQueue {
+		if err := w.uploadSegment(index); err != nil {
+			// ** not fatal, removal uploads the segment itself if it has to
+			w.mu.Lock()
+			w.archiveErr = err
+			w.mu.Unlock()
+			w.metrics.errors.Add(1)
+			w.logger.Error("failed to archive segment", "segment", index, "err", err)
+		}
+	}
+}
+
+// ** hand a freshly rotated segment to the workers, must be called with the mutex held
+// ** never blocks, a segment that does not fit in the queue is uploaded on removal
+func (w *WAL) queueArchive(index int) {
+	if w.archiver == nil {
+		return
+	}
+	select {
+	case w.archiveQueue <- index:
+	default:
+	}
+}
+
+// ** upload a closed segment without holding the mutex during the transfer
+func (w *WAL) uploadSegment(index int) error {
+	w.mu.Lock()
+	path := segmentPath(w.fs, w.directory, index)
+	done := w.archived[index]
+	w.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	file, err := openFile(w.fs, path)
+	if os.IsNotExist(err) {
+		// ** already removed, and so already uploaded by removeSegment
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open segment %d for archiving: %w", index, err)
+	}
+	defer file.Close()
+	if err := w.archiver.Upload(context.Background(), filepath.Base(path), file); err != nil {
+		return fmt.Errorf("failed to archive segment %d: %w", index, err)
+	}
+
+	w.mu.Lock()
+	w.archived[index] = true
+	w.mu.Unlock()
+	return nil
+}
+
+// ** make sure a segment is in the archive and listed in the catalog before
+// ** it is deleted, must be called with the mutex held
+// ** uploads in place if no worker got to it, which blocks writers meanwhile
+func (w *WAL) archiveBeforeRemove(index int) error {
+	path := segmentPath(w.fs, w.directory, index)
+	first, ok, err := firstOffset(w.fs, path, w.encryption)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	if !w.archived[index] {
+		file, err := openFile(w.fs, path)
+		if err != nil {
+			return fmt.Errorf("failed to open segment %d for archiving: %w", index, err)
+		}
+		err = w.archiver.Upload(context.Background(), filepath.Base(path), file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to archive segment %d: %w", index, err)
+		}
+	}
+
+	catalog := append(w.archive, archivedSegment{Index: index, Name: filepath.Base(path), FirstOffset: first})
+	if err := writeArchiveCatalog(w.fs, w.directory, catalog); err != nil {
+		return err
+	}
+	w.archive = catalog
+	delete(w.archived, index)
+	return nil
+}
+
+// ** segments from index on are rewritten, their uploads no longer match
+// ** must be called with the mutex held
+func (w *WAL) forgetArchived(index int) {
+	for archived := range w.archived {
+		if archived >= index {
+			delete(w.archived, archived)
+		}
+	}
+}
+
+// ** scan archived segments for entries from offset up to before, the
+// ** first offset still kept locally
+// ** each segment is downloaded in full, so deep replays are slow
+func (s *logSnapshot) scanArchive(ctx context.Context, offset, before int64, topics []string, fn func(logRecord) error) error {
+	start := sort.Search(len(s.archive), func(i int) bool {
+		return s.archive[i].FirstOffset > offset
+	}) - 1
+	if start < 0 {
+		start = 0
+	}
+	for _, segment := range s.archive[start:] {
+		body, err := s.archiver.Download(ctx, segment.Name)
+		if err != nil {
+			return fmt.Errorf("failed to download archived segment %d: %w", segment.Index, err)
+		}
+		reader := body
+		if compressionOf(segment.Name) != CompressionNone {
+			if reader, err = decompressSegment(segment.Name, body, 0); err != nil {
+				return err
+			}
+		}
+		err = scanRecords(reader, 0, s.encryption, func(record logRecord, _ int64) error {
+			if record.Offset >= before {
+				return errReachedLocal
+			}
+			if record.Offset >= offset && record.readable(topics) && !segment.purged(record.Topic) {
+				return fn(record)
+			}
+			return nil
+		})
+		reader.Close()
+		if err == errReachedLocal {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import "fmt"
+
+const (
+	asyncQueueSize = 1024
+	// ** most entries group committed under one fsync
+	maxAsyncGroup = 256
+)
+
+// ** outcome of an asynchronous write, delivered once the entry is committed
+// ** under the sync policy or failed
+type WriteResult struct {
+	Offset int64
+	Err    error
+}
+
+type asyncWrite struct {
+	id     string // ** idempotency key, empty for none
+	entry  LogEntry
+	result chan WriteResult
+}
+
+// ** queue an entry for the writer goroutine and return at once
+// ** the writer takes everything queued up meanwhile and commits it with a
+// ** single fsync, so many concurrent producers share the disk latency
+// ** the channel receives exactly one result, waiting on it gives the same
+// ** guarantees as WriteLog
+func (w *WAL) WriteLogAsync(topic string, payload interface{}) <-chan WriteResult {
+	return w.writeLogAsync("", LogEntry{Topic: topic, Payload: payload})
+}
+
+// ** body of WriteLogAsync, an entry whose id is still in the dedup window
+// ** is not written again and gets the offset of the first write
+func (w *WAL) writeLogAsync(id string, entry LogEntry) <-chan WriteResult {
+	result := make(chan WriteResult, 1)
+	w.asyncMu.RLock()
+	defer w.asyncMu.RUnlock()
+	if w.asyncClosed {
+		result <- WriteResult{Err: ErrClosed}
+		return result
+	}
+	w.asyncOnce.Do(w.startAsyncWriter)
+	w.asyncQueue <- asyncWrite{id: id, entry: entry, result: result}
+	return result
+}
+
+func (w *WAL) startAsyncWriter() {
+	w.asyncQueue = make(chan asyncWrite, asyncQueueSize)
+	w.asyncDone = make(chan struct{})
+	go w.asyncWriter()
+}
+
+func (w *WAL) asyncWriter() {
+	defer close(w.asyncDone)
+	group := make([]asyncWrite, 0, maxAsyncGroup)
+	for first := range w.asyncQueue {
+		group = append(group[:0], first)
+	collect:
+		for len(group) < maxAsyncGroup {
+			select {
+			case next, ok := <-w.asyncQueue:
+				if !ok {
+					break collect
+				}
+				group = append(group, next)
+			default:
+				break collect
+			}
+		}
+		w.commitGroup(group)
+	}
+}
+
+// ** write a group of queued entries and commit them together
+// ** unlike WriteBatch every entry stands on its own, one that fails to
+// ** encode does not fail the others
+func (w *WAL) commitGroup(group []asyncWrite) {
+	results := make([]WriteResult, len(group))
+	w.mu.Lock()
+	if w.closed {
+		for i := range results {
+			results[i].Err = ErrClosed
+		}
+	} else {
+		flush := func() error { return w.writer.Flush() }
+		written := 0
+		for i, write := range group {
+			if write.id != "" {
+				if offset, ok := w.dedup.lookup(write.id, w.offset); ok {
+					results[i].Offset = offset
+					continue
+				}
+			}
+			results[i].Offset, results[i].Err = w.appendLog(write.id, write.entry, flush)
+			if results[i].Err == nil {
+				written++
+			}
+		}
+		if written > 0 {
+			if err := w.commit(); err != nil {
+				for i := range results {
+					if results[i].Err == nil {
+						results[i].Err = fmt.Errorf("failed to commit log entry: %w", err)
+					}
+				}
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	for i, write := range group {
+		if results[i].Err != nil {
+			w.metrics.errors.Add(1)
+		}
+		write.result <- results[i]
+	}
+}
+
+// ** stop taking async writes and wait until the queued ones are done
+// ** called by Close before the wal itself is closed
+func (w *WAL) stopAsyncWriter() {
+	w.asyncMu.Lock()
+	if w.asyncClosed {
+		w.asyncMu.Unlock()
+		return
+	}
+	w.asyncClosed = true
+	started := w.asyncQueue != nil
+	if started {
+		close(w.asyncQueue)
+	}
+	w.asyncMu.Unlock()
+	if started {
+		<-w.asyncDone
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ** how the servers are protected, the zero value serves plaintext to anyone
+type ServerSecurity struct {
+	// ** nil serves plaintext
+	TLS *tls.Config
+	// ** accepted bearer tokens or API keys, none turns auth off
+	Tokens []string
+}
+
+// ** TLS config for a server with the key pair in certFile and keyFile
+// ** with clientCAFile every client must present a certificate signed by
+// ** one of the CAs in it
+func loadServerTLS(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ** TLS config for a client trusting the CAs in caFile, the system roots if
+// ** it is empty, and presenting the key pair in certFile and keyFile if set
+func loadClientTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS key pair: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// ** tokens from a file with one per line, blank lines and # comments are skipped
+func loadTokens(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tokens file: %w", err)
+	}
+	defer file.Close()
+	var tokens []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens found in %s", path)
+	}
+	return tokens, nil
+}
+
+// ** whether token is one of the accepted ones
+// ** hashing first makes every comparison take the same time whatever the
+// ** lengths, so the check leaks nothing about the tokens
+func (s ServerSecurity) allows(token string) bool {
+	if token == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	allowed := false
+	for _, accepted := range s.Tokens {
+		acceptedSum := sha256.Sum256([]byte(accepted))
+		if subtle.ConstantTimeCompare(sum[:], acceptedSum[:]) == 1 {
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+// ** context key of the token requireAuth accepted for a request
+type authTokenKey struct{}
+
+// ** the token requireAuth accepted for request, empty when auth is off
+func authenticatedToken(request *http.Request) string {
+	token, _ := request.Context().Value(authTokenKey{}).(string)
+	return token
+}
+
+// ** the token of a request, from "Authorization: Bearer" or X-API-Key
+func requestToken(request *http.Request) string {
+	if value := request.Header.Get("Authorization"); value != "" {
+		if !strings.HasPrefix(value, "Bearer ") {
+			return ""
+		}
+		return strings.TrimSpace(strings.TrimPrefix(value, "Bearer "))
+	}
+	return request.Header.Get("X-API-Key")
+}
+
+// ** wrap next so every request but /healthz needs an accepted token
+// ** health checks stay open so load balancers can probe without a token
+func (s ServerSecurity) requireAuth(next http.Handler) http.Handler {
+	if len(s.Tokens) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/healthz" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		token := requestToken(request)
+		if !s.allows(token) {
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="wal"`)
+			http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), authTokenKey{}, token)))
+	})
+}
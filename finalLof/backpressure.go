@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// ** returned by writes while the wal is over Options.MaxSize
+var ErrWALFull = errors.New("wal is full")
+
+// ** what a write does when the wal is over its maximum size
+type FullPolicy int
+
+const (
+	// ** fail the write with ErrWALFull
+	FullReject FullPolicy = iota
+	// ** wait until TruncateBefore, a checkpoint, retention or compaction
+	// ** frees space, up to Options.FullTimeout
+	FullBlock
+	// ** delete the oldest closed segments to make room, archiving them first
+	// ** if an archiver is configured, ErrWALFull if only the active one is left
+	FullEvict
+)
+
+func (p FullPolicy) String() string {
+	switch p {
+	case FullBlock:
+		return "block"
+	case FullEvict:
+		return "evict"
+	default:
+		return "reject"
+	}
+}
+
+// ** recount the bytes on disk after segments were added, removed or rewritten
+// ** wakes writers blocked on a full wal, must be called with the mutex held
+func (w *WAL) refreshUsage() error {
+	if w.maxSize <= 0 {
+		return nil
+	}
+	_, total, err := w.diskUsage()
+	if err != nil {
+		return err
+	}
+	w.usage = total
+	w.spaceFreed.Broadcast()
+	return nil
+}
+
+// ** make sure there is room for another write, must be called with the mutex held
+// ** the limit is checked before writing, so the wal can end up over it by
+// ** at most one write
+func (w *WAL) waitForSpace() error {
+	if w.maxSize <= 0 || w.usage < w.maxSize {
+		return nil
+	}
+	switch w.fullPolicy {
+	case FullEvict:
+		return w.evictForSpace()
+	case FullBlock:
+		return w.blockForSpace()
+	default:
+		return ErrWALFull
+	}
+}
+
+func (w *WAL) evictForSpace() error {
+	for w.usage >= w.maxSize {
+		indexes := w.segments.indexes()
+		if len(indexes) == 0 || indexes[0] >= w.currentSegmentIndex {
+			return ErrWALFull
+		}
+		if err := w.removeSegment(indexes[0]); err != nil {
+			return err
+		}
+		if err := w.refreshUsage(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *WAL) blockForSpace() error {
+	var deadline time.Time
+	if w.fullTimeout > 0 {
+		deadline = time.Now().Add(w.fullTimeout)
+		// ** sync.Cond has no timeout, wake everyone once the deadline passed
+		timer := time.AfterFunc(w.fullTimeout, func() {
+			w.mu.Lock()
+			w.spaceFreed.Broadcast()
+			w.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+	for w.usage >= w.maxSize {
+		if w.closing {
+			return ErrClosed
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return ErrWALFull
+		}
+		w.spaceFreed.Wait()
+	}
+	return nil
+}
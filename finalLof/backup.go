@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ** stream a consistent snapshot of the wal directory into a tar archive
+// ** the mutex is held throughout, so no write or rotation happens while
+// ** the segments are copied and the archive matches one point in the log
+func (w *WAL) Backup(out io.Writer) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if err := w.FlushE(); err != nil {
+		return err
+	}
+	return writeBackup(w.fs, out, w.directory)
+}
+
+// ** tar every file of a wal directory, segments, sidecars and meta files alike
+// ** leftovers of interrupted atomic writes and the lock file are skipped
+func writeBackup(fs fileSystem, out io.Writer, directory string) error {
+	entries, err := fs.ReadDir(directory)
+	if err != nil {
+		return fmt.Errorf("failed to read wal directory: %w", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasSuffix(entry.Name(), ".tmp") && entry.Name() != lockFileName {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	archive := tar.NewWriter(out)
+	for _, name := range names {
+		if err := addBackupFile(fs, archive, filepath.Join(directory, name)); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("failed to finish backup: %w", err)
+	}
+	return nil
+}
+
+func addBackupFile(fs fileSystem, archive *tar.Writer, path string) error {
+	file, err := openFile(fs, path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for backup: %w", path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return fmt.Errorf("failed to build backup header for %s: %w", path, err)
+	}
+	header.Name = filepath.Base(path)
+	if err := archive.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	// ** copy exactly the size in the header even if the file grows meanwhile
+	if _, err := io.CopyN(archive, file, info.Size()); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+	return nil
+}
+
+// ** recreate a wal directory from an archive written by Backup
+// ** dir must not exist yet or be empty, every file is synced before
+// ** Restore returns so the directory can be opened straight away
+func Restore(dir string, r io.Reader) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	existing, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("failed to restore: %s is not empty", dir)
+	}
+
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read backup: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// ** backups are flat, anything with a path could escape dir
+		if header.Name != filepath.Base(header.Name) || header.Name == ".." {
+			return fmt.Errorf("failed to restore: unexpected entry %q in backup", header.Name)
+		}
+		if err := restoreFile(filepath.Join(dir, header.Name), archive); err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+func restoreFile(path string, contents io.Reader) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	if _, err := io.Copy(file, contents); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ** what walctl bench measures and against what
+type benchConfig struct {
+	mode        string // ** write, batch or replay
+	dir         string // ** a temporary directory if empty
+	url         string // ** drive a running server instead of the library
+	token       string
+	sync        string
+	ops         int
+	concurrency int
+	payloadSize int
+	batchSize   int
+}
+
+// ** one way of running the benchmark operations, the library or a server
+type benchTarget interface {
+	write(payload map[string]interface{}) error
+	writeBatch(entries []LogEntry) error
+	// ** read everything back, returning how many entries there were
+	replay(workers int) (int, error)
+	Close() error
+}
+
+type benchResult struct {
+	entries   int
+	bytes     int64
+	elapsed   time.Duration
+	latencies []time.Duration // ** one per operation, empty for replay
+	// ** heap allocations of the whole process while the operations ran,
+	// ** the benchmark's own included
+	allocs     uint64
+	allocBytes uint64
+}
+
+// ** load generation against a fresh wal, or a server with -url
+// ** write and batch run -n entries over -concurrency goroutines, replay
+// ** writes -n entries first and then times reading them back
+// ** against the library the heap allocations per entry are reported too
+func walctlBench(args []string, stdout io.Writer) error {
+	var config benchConfig
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.StringVar(&config.mode, "mode", "write", "what to measure: write, batch or replay")
+	flags.StringVar(&config.dir, "dir", "", "wal directory to write to, a temporary one that is removed afterwards if empty")
+	flags.StringVar(&config.url, "url", "", "benchmark the wal server at this URL instead of the library, e.g. http://localhost:9090")
+	flags.StringVar(&config.token, "token", "", "bearer token sent to the server")
+	flags.StringVar(&config.sync, "sync", "always", "sync policy of the library wal: always, manual or an interval such as 10ms")
+	flags.IntVar(&config.ops, "n", 10000, "entries to write")
+	flags.IntVar(&config.concurrency, "concurrency", 1, "writers running at the same time, also the replay workers")
+	flags.IntVar(&config.payloadSize, "payload", 128, "payload size in bytes")
+	flags.IntVar(&config.batchSize, "batch", 100, "entries per batch in batch mode")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if config.ops <= 0 || config.concurrency <= 0 || config.batchSize <= 0 || config.payloadSize < 0 {
+		return fmt.Errorf("-n, -concurrency and -batch must be positive and -payload not negative")
+	}
+
+	target, cleanup, err := openBenchTarget(config)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	defer target.Close()
+
+	var result benchResult
+	switch config.mode {
+	case "write", "batch":
+		result, err = runBenchWrites(target, config)
+	case "replay":
+		result, err = runBenchReplay(target, config)
+	default:
+		return fmt.Errorf("unknown mode %q, use write, batch or replay", config.mode)
+	}
+	if err != nil {
+		return err
+	}
+	return printBenchResult(stdout, config, result)
+}
+
+// ** the library wal or server client the benchmark runs against, cleanup
+// ** removes a temporary directory
+func openBenchTarget(config benchConfig) (benchTarget, func(), error) {
+	if config.url != "" {
+		return &httpBenchTarget{
+			url:    strings.TrimSuffix(config.url, "/"),
+			token:  config.token,
+			client: &http.Client{Timeout: time.Minute},
+		}, func() {}, nil
+	}
+	policy, err := parseSyncPolicy(config.sync)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, cleanup := config.dir, func() {}
+	if dir == "" {
+		if dir, err = os.MkdirTemp("", "walbench"); err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { os.RemoveAll(dir) }
+	}
+	wal, err := newWriteAheadLOG(Options{Directory: dir, SyncPolicy: policy})
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return &walBenchTarget{wal: wal}, cleanup, nil
+}
+
+// ** -n entries split over the writers, latencies are per call, so in batch
+// ** mode per batch
+func runBenchWrites(target benchTarget, config benchConfig) (benchResult, error) {
+	payload := map[string]interface{}{"data": strings.Repeat("x", config.payloadSize)}
+	perCall := 1
+	if config.mode == "batch" {
+		perCall = config.batchSize
+	}
+	calls := (config.ops + perCall - 1) / perCall
+
+	var mu sync.Mutex
+	var firstErr error
+	latencies := make([]time.Duration, 0, calls)
+	next := make(chan int, calls)
+	for i := 0; i < calls; i++ {
+		count := perCall
+		if rest := config.ops - i*perCall; rest < count {
+			count = rest
+		}
+		next <- count
+	}
+	close(next)
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	started := time.Now()
+	var workers sync.WaitGroup
+	for i := 0; i < config.concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			var own []time.Duration
+			for count := range next {
+				callStarted := time.Now()
+				var err error
+				if config.mode == "batch" {
+					entries := make([]LogEntry, count)
+					for j := range entries {
+						entries[j] = LogEntry{Topic: "bench", Payload: payload}
+					}
+					err = target.writeBatch(entries)
+				} else {
+					err = target.write(payload)
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+				own = append(own, time.Since(callStarted))
+			}
+			mu.Lock()
+			latencies = append(latencies, own...)
+			mu.Unlock()
+		}()
+	}
+	workers.Wait()
+	elapsed := time.Since(started)
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	if firstErr != nil {
+		return benchResult{}, firstErr
+	}
+	return benchResult{
+		entries:    config.ops,
+		bytes:      int64(config.ops) * int64(config.payloadSize),
+		elapsed:    elapsed,
+		latencies:  latencies,
+		allocs:     after.Mallocs - before.Mallocs,
+		allocBytes: after.TotalAlloc - before.TotalAlloc,
+	}, nil
+}
+
+// ** fill the wal with -n entries in batches, then time reading it back
+func runBenchReplay(target benchTarget, config benchConfig) (benchResult, error) {
+	payload := map[string]interface{}{"data": strings.Repeat("x", config.payloadSize)}
+	for written := 0; written < config.ops; written += config.batchSize {
+		count := config.batchSize
+		if rest := config.ops - written; rest < count {
+			count = rest
+		}
+		entries := make([]LogEntry, count)
+		for i := range entries {
+			entries[i] = LogEntry{Topic: "bench", Payload: payload}
+		}
+		if err := target.writeBatch(entries); err != nil {
+			return benchResult{}, err
+		}
+	}
+
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	started := time.Now()
+	entries, err := target.replay(config.concurrency)
+	if err != nil {
+		return benchResult{}, err
+	}
+	elapsed := time.Since(started)
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	return benchResult{
+		entries:    entries,
+		bytes:      int64(entries) * int64(config.payloadSize),
+		elapsed:    elapsed,
+		allocs:     after.Mallocs - before.Mallocs,
+		allocBytes: after.TotalAlloc - before.TotalAlloc,
+	}, nil
+}
+
+func printBenchResult(stdout io.Writer, config benchConfig, result benchResult) error {
+	target := "library"
+	if config.url != "" {
+		target = config.url
+	} else if config.dir != "" {
+		target = "library, " + config.dir
+	}
+	seconds := result.elapsed.Seconds()
+
+	table := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "mode:\t%s\n", config.mode)
+	fmt.Fprintf(table, "target:\t%s\n", target)
+	if config.url == "" {
+		fmt.Fprintf(table, "sync:\t%s\n", config.sync)
+	}
+	fmt.Fprintf(table, "entries:\t%d of %d bytes\n", result.entries, config.payloadSize)
+	fmt.Fprintf(table, "concurrency:\t%d\n", config.concurrency)
+	fmt.Fprintf(table, "elapsed:\t%s\n", result.elapsed.Round(time.Microsecond))
+	if seconds > 0 {
+		fmt.Fprintf(table, "throughput:\t%.0f entries/s, %.2f MB/s\n", float64(result.entries)/seconds, float64(result.bytes)/seconds/1e6)
+	}
+	// ** against a server only the client's allocations would be counted
+	if config.url == "" && result.entries > 0 {
+		fmt.Fprintf(table, "allocations:\t%.1f allocs/entry, %.0f B/entry\n",
+			float64(result.allocs)/float64(result.entries), float64(result.allocBytes)/float64(result.entries))
+	}
+	if len(result.latencies) > 0 {
+		latencies := result.latencies
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		percentile := func(p float64) time.Duration {
+			return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+		}
+		fmt.Fprintf(table, "latency:\tp50 %s  p90 %s  p99 %s  max %s\n",
+			percentile(0.50), percentile(0.90), percentile(0.99), latencies[len(latencies)-1].Round(time.Microsecond))
+	}
+	return table.Flush()
+}
+
+type walBenchTarget struct {
+	wal *WAL
+}
+
+func (t *walBenchTarget) write(payload map[string]interface{}) error {
+	_, err := t.wal.WriteLog("bench", payload)
+	return err
+}
+
+func (t *walBenchTarget) writeBatch(entries []LogEntry) error {
+	return t.wal.WriteBatch(entries)
+}
+
+func (t *walBenchTarget) replay(workers int) (int, error) {
+	count := 0
+	err := t.wal.Replay(0, workers, func(LogEntry) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func (t *walBenchTarget) Close() error {
+	return t.wal.Close()
+}
+
+// ** drives /write, /write/batch and /read of a running server
+type httpBenchTarget struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (t *httpBenchTarget) write(payload map[string]interface{}) error {
+	return t.post("/write?topic=bench", payload)
+}
+
+func (t *httpBenchTarget) writeBatch(entries []LogEntry) error {
+	body := make([]map[string]interface{}, len(entries))
+	for i, entry := range entries {
+		body[i] = map[string]interface{}{"topic": entry.Topic, "payload": entry.Payload}
+	}
+	return t.post("/write/batch", body)
+}
+
+func (t *httpBenchTarget) replay(int) (int, error) {
+	request, err := t.request(http.MethodGet, "/read?offset=0", nil)
+	if err != nil {
+		return 0, err
+	}
+	response, err := t.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("read failed: %s", response.Status)
+	}
+	var body struct {
+		Count int `json:"count"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("failed to decode read response: %w", err)
+	}
+	return body.Count, nil
+}
+
+func (t *httpBenchTarget) post(path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := t.request(http.MethodPost, path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := t.client.Do(request)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("%s failed: %s", path, response.Status)
+	}
+	return nil
+}
+
+func (t *httpBenchTarget) request(method, path string, body io.Reader) (*http.Request, error) {
+	request, err := http.NewRequest(method, t.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if t.token != "" {
+		request.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	return request, nil
+}
+
+func (t *httpBenchTarget) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
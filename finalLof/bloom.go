@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+)
+
+const (
+	bloomSuffix = ".bloom"
+	bloomBits   = 1024 // ** segments hold few distinct topics, so this stays sparse
+	bloomHashes = 3
+)
+
+// ** bloom filter over the topics written to one segment
+// ** lets a filtered read skip segments that cannot hold a matching entry
+type topicFilter [bloomBits / 8]byte
+
+func newTopicFilter() *topicFilter {
+	return &topicFilter{}
+}
+
+// ** double hashing on fnv-1a, bit i is h1 + i*h2
+func (f *topicFilter) positions(topic string) [bloomHashes]uint32 {
+	hash := fnv.New64a()
+	hash.Write([]byte(topic))
+	sum := hash.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	var bits [bloomHashes]uint32
+	for i := range bits {
+		bits[i] = (h1 + uint32(i)*h2) % bloomBits
+	}
+	return bits
+}
+
+func (f *topicFilter) add(topic string) {
+	for _, bit := range f.positions(topic) {
+		f[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// ** false means the topic is definitely not in the segment
+func (f *topicFilter) mayContain(topic string) bool {
+	for _, bit := range f.positions(topic) {
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *topicFilter) mayContainAny(topics []string) bool {
+	for _, topic := range topics {
+		if f.mayContain(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+func bloomFileName(directory string, index int) string {
+	return strings.TrimSuffix(segmentFileName(directory, index), ".log") + bloomSuffix
+}
+
+func writeTopicFilter(fs fileSystem, directory string, index int, filter *topicFilter) error {
+	path := bloomFileName(directory, index)
+	if err := writeFile(fs, path+".tmp", filter[:], 0666); err != nil {
+		return fmt.Errorf("failed to write topic filter: %w", err)
+	}
+	if err := fs.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to replace topic filter: %w", err)
+	}
+	return nil
+}
+
+// ** scan a segment and collect its topics
+func buildTopicFilter(fs fileSystem, directory string, index int, encryption *recordEncryption) (*topicFilter, error) {
+	filter := newTopicFilter()
+	err := scanSegment(fs, segmentPath(fs, directory, index), 0, encryption, func(record logRecord, _ int64) error {
+		filter.add(record.Topic)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// ** read the topic filter of a closed segment, building it when missing
+func loadTopicFilter(fs fileSystem, directory string, index int, encryption *recordEncryption) (*topicFilter, error) {
+	data, err := readFile(fs, bloomFileName(directory, index))
+	if err == nil && len(data) == len(topicFilter{}) {
+		filter := newTopicFilter()
+		copy(filter[:], data)
+		return filter, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read topic filter: %w", err)
+	}
+	filter, err := buildTopicFilter(fs, directory, index, encryption)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTopicFilter(fs, directory, index, filter); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const checkpointFileName = "wal.checkpoint"
+
+// ** a record that the application snapshotted its state up to Offset
+// ** Meta is opaque to the wal, typically where to find the snapshot
+type Checkpoint struct {
+	Offset    int64     `json:"offset"`
+	Meta      []byte    `json:"meta,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ** the checkpoint stored in the directory, nil if there is none yet
+func readCheckpoint(fs fileSystem, directory string) (*Checkpoint, error) {
+	data, err := readFile(fs, filepath.Join(directory, checkpointFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint file: %w", err)
+	}
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint file: %w", err)
+	}
+	return &checkpoint, nil
+}
+
+func writeCheckpoint(fs fileSystem, directory string, checkpoint Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint file: %w", err)
+	}
+	if err := writeFileAtomic(fs, filepath.Join(directory, checkpointFileName), data); err != nil {
+		return fmt.Errorf("failed to write checkpoint file: %w", err)
+	}
+	return nil
+}
+
+// ** record that everything up to and including offset is covered by an
+// ** external snapshot, then reclaim the segments the checkpoint covers
+// ** the checkpoint is persisted before anything is removed, so after a
+// ** crash replay from LastCheckpoint never needs a deleted entry
+func (w *WAL) CreateCheckpoint(offset int64, meta []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if offset < 1 || offset >= w.offset {
+		return fmt.Errorf("failed to create checkpoint: offset %d is not in the log", offset)
+	}
+	if w.checkpoint != nil && offset < w.checkpoint.Offset {
+		return fmt.Errorf("failed to create checkpoint: offset %d is before the last checkpoint at %d", offset, w.checkpoint.Offset)
+	}
+	// ** the snapshot may cover entries still sitting in the buffer
+	if err := w.FlushE(); err != nil {
+		return err
+	}
+
+	checkpoint := Checkpoint{Offset: offset, Meta: meta, CreatedAt: time.Now()}
+	if err := writeCheckpoint(w.fs, w.directory, checkpoint); err != nil {
+		return err
+	}
+	w.checkpoint = &checkpoint
+	return w.truncateBefore(offset + 1)
+}
+
+// ** the newest checkpoint, ok is false if none was ever created
+// ** replay after open should restore the snapshot and then read from
+// ** checkpoint.Offset+1
+func (w *WAL) LastCheckpoint() (checkpoint Checkpoint, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.checkpoint == nil {
+		return Checkpoint{}, false
+	}
+	return *w.checkpoint, true
+}
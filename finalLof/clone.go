@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ** the size and modification time a file had when it was copied, a file
+// ** that still matches both does not need to be copied again
+type clonedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// ** copy the wal into dir while writes go on, to move it to a bigger disk
+// ** or seed a follower without downtime
+// ** the closed segments are copied without the mutex, then it is held only
+// ** to copy the active segment, the meta files and whatever rotation,
+// ** compaction or retention changed meanwhile, so dir matches one point in
+// ** the log and can be opened straight away
+// ** dir must not exist yet or be empty
+func (w *WAL) CloneTo(dir string) error {
+	if err := w.fs.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	existing, err := w.fs.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("failed to clone: %s is not empty", dir)
+	}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	closed := w.segments.indexes()
+	active := w.currentSegmentIndex
+	w.mu.Unlock()
+
+	copied := make(map[string]clonedFile)
+	for _, index := range closed {
+		if index >= active {
+			continue
+		}
+		source := segmentPath(w.fs, w.directory, index)
+		info, err := cloneFile(w.fs, source, filepath.Join(dir, filepath.Base(source)))
+		if os.IsNotExist(err) {
+			// ** removed by retention or compressed meanwhile, the second
+			// ** pass sees what took its place
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		copied[filepath.Base(source)] = info
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if err := w.FlushE(); err != nil {
+		return err
+	}
+	return finishClone(w.fs, w.directory, dir, copied)
+}
+
+// ** copy every file of directory that changed since copied was taken and
+// ** drop the copies of files that are gone, the wal's mutex must be held
+func finishClone(fs fileSystem, directory, dir string, copied map[string]clonedFile) error {
+	entries, err := fs.ReadDir(directory)
+	if err != nil {
+		return fmt.Errorf("failed to read wal directory: %w", err)
+	}
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasSuffix(name, ".tmp") || name == lockFileName {
+			continue
+		}
+		present[name] = true
+		source := filepath.Join(directory, name)
+		if previous, ok := copied[name]; ok {
+			info, err := fs.Stat(source)
+			if err != nil {
+				return fmt.Errorf("failed to stat %s: %w", source, err)
+			}
+			if info.Size() == previous.size && info.ModTime().Equal(previous.modTime) {
+				continue
+			}
+		}
+		if _, err := cloneFile(fs, source, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	for name := range copied {
+		if present[name] {
+			continue
+		}
+		if err := fs.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale copy of %s: %w", name, err)
+		}
+	}
+	return fs.SyncDir(dir)
+}
+
+// ** copy source to target and sync it, returns what source looked like
+func cloneFile(fs fileSystem, source, target string) (clonedFile, error) {
+	file, err := openFile(fs, source)
+	if err != nil {
+		return clonedFile{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return clonedFile{}, fmt.Errorf("failed to get file info: %w", err)
+	}
+	clone, err := createFile(fs, target)
+	if err != nil {
+		return clonedFile{}, fmt.Errorf("failed to create %s: %w", target, err)
+	}
+	// ** copy exactly the size seen so a segment growing meanwhile is cut
+	// ** at a point the second pass notices
+	if _, err := io.CopyN(clone, file, info.Size()); err != nil {
+		clone.Close()
+		return clonedFile{}, fmt.Errorf("failed to copy %s: %w", source, err)
+	}
+	if err := clone.Sync(); err != nil {
+		clone.Close()
+		return clonedFile{}, fmt.Errorf("failed to sync %s: %w", target, err)
+	}
+	if err := clone.Close(); err != nil {
+		return clonedFile{}, fmt.Errorf("failed to close %s: %w", target, err)
+	}
+	return clonedFile{size: info.Size(), modTime: info.ModTime()}, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ** returned by every write once Close has been called
+var ErrClosed = errors.New("wal is closed")
+
+// ** flush and fsync everything, close the active segment and stop background work
+// ** writes after Close fail with ErrClosed, calling Close again is a no-op
+// ** queued async writes and uploads are finished before Close returns
+func (w *WAL) Close() error {
+	// ** writes blocked on a full wal give up, so the async writer can drain
+	w.mu.Lock()
+	w.closing = true
+	w.spaceFreed.Broadcast()
+	w.mu.Unlock()
+	w.stopAsyncWriter()
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	// ** their placeholders are on disk already, so the offsets stay gaps
+	for r := range w.reservations {
+		w.releaseReservation(r)
+	}
+	if w.follower != nil {
+		// ** it sees ErrClosed on its next write, cancelling also ends an idle stream
+		w.follower.cancel()
+	}
+	if w.archiveQueue != nil {
+		// ** workers take the mutex, so wait for them without holding it
+		close(w.archiveQueue)
+		w.mu.Unlock()
+		w.archiveWorkers.Wait()
+		w.mu.Lock()
+	}
+	// ** async hooks may call into the wal, so they are drained after unlocking
+	var hooks []*commitHook
+	defer func() {
+		for _, hook := range hooks {
+			hook.stop()
+		}
+	}()
+	defer w.mu.Unlock()
+	if w.stopSync != nil {
+		close(w.stopSync)
+	}
+	if w.stopCompact != nil {
+		close(w.stopCompact)
+	}
+	if w.stopScrub != nil {
+		close(w.stopScrub)
+	}
+	if w.stopVacuum != nil {
+		close(w.stopVacuum)
+	}
+	if w.stopRotate != nil {
+		close(w.stopRotate)
+	}
+	// ** watchers wake up, see the wal is closed and finish
+	w.signalAppend()
+	w.signalDurable()
+
+	var firstErr error
+	if err := w.FlushE(); err != nil {
+		firstErr = err
+	}
+	if err := w.closeSegmentFile(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err := w.indexFile.Close(); err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("failed to close index file: %w", err)
+	}
+	hooks, w.hooks = w.hooks, nil
+	// ** last, so another process can only open the wal once it is consistent
+	if err := w.lock.Close(); err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("failed to release wal lock: %w", err)
+	}
+	if firstErr != nil {
+		w.logger.Error("wal closed with an error", "next_offset", w.offset, "err", firstErr)
+	} else {
+		w.logger.Info("wal closed", "next_offset", w.offset)
+	}
+	return firstErr
+}
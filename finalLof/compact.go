@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ** key based compaction of closed segments, off unless Interval is set
+// ** only entries with a key take part, entries without one are always kept
+type CompactionPolicy struct {
+	// ** how often the background compactor runs
+	Interval time.Duration
+	// ** how long a tombstone outlives the values it deleted, so consumers
+	// ** that are behind still see the delete, forever if zero
+	TombstoneRetention time.Duration
+}
+
+// ** identity of a compacted value, keys are scoped to their topic
+type compactionKey struct {
+	topic string
+	key   string
+}
+
+// ** write an entry that supersedes every earlier entry with the same topic and key
+func (w *WAL) WriteKeyed(topic, key string, payload interface{}) (offset int64, err error) {
+	if key == "" {
+		return 0, fmt.Errorf("failed to write keyed entry: key is empty")
+	}
+	defer w.metrics.countError(&err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	return w.writeLog("", LogEntry{Topic: topic, Key: key, Payload: payload})
+}
+
+// ** write a tombstone, compaction then drops every value of the key and
+// ** eventually the tombstone itself
+func (w *WAL) DeleteKey(topic, key string) (int64, error) {
+	return w.WriteKeyed(topic, key, nil)
+}
+
+func isTombstone(record logRecord) bool {
+	return record.Key != "" && record.Payload == nil
+}
+
+func (w *WAL) startCompactor() {
+	if w.compaction.Interval <= 0 {
+		return
+	}
+	w.stopCompact = make(chan struct{})
+	go w.compactLoop(w.compaction.Interval, w.stopCompact)
+}
+
+func (w *WAL) compactLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := w.Compact(); err != nil && !errors.Is(err, ErrClosed) {
+				w.metrics.errors.Add(1)
+				w.logger.Error("background compaction failed", "err", err)
+			}
+		}
+	}
+}
+
+// ** rewrite closed segments keeping only the newest entry per topic and key
+// ** the active segment is never rewritten but its entries do supersede
+// ** older ones, offsets are kept so compacted segments simply have gaps
+// ** the newest offset of every key is read from a snapshot without the
+// ** mutex, writers only wait for the rewrites
+func (w *WAL) Compact() error {
+	for {
+		latest, truncations, err := w.latestKeys()
+		if err != nil {
+			return err
+		}
+		if len(latest) == 0 {
+			return nil
+		}
+
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return ErrClosed
+		}
+		if len(w.truncations) != truncations {
+			// ** an entry latest points at may have been cut off and its
+			// ** offset reused, so it no longer supersedes anything
+			w.mu.Unlock()
+			continue
+		}
+		err = w.compactClosed(latest)
+		w.mu.Unlock()
+		return err
+	}
+}
+
+// ** the offset of the newest entry of every key and how many truncations
+// ** the wal had seen when the snapshot was taken
+func (w *WAL) latestKeys() (map[compactionKey]int64, int, error) {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil, 0, ErrClosed
+	}
+	if err := w.FlushE(); err != nil {
+		w.mu.Unlock()
+		return nil, 0, err
+	}
+	indexes := w.segments.indexes()
+	ranges := make([]segmentRange, len(indexes))
+	for i, index := range indexes {
+		ranges[i] = segmentRange{index: index}
+	}
+	snap, err := w.snapshot(ranges)
+	truncations := len(w.truncations)
+	w.mu.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer snap.Close()
+
+	latest := make(map[compactionKey]int64)
+	err = snap.scanSegments(context.Background(), func(record logRecord) error {
+		if record.Key != "" {
+			latest[compactionKey{record.Topic, record.Key}] = record.Offset
+		}
+		return nil
+	})
+	return latest, truncations, err
+}
+
+// ** compact every closed segment against latest, must be called with the
+// ** mutex held
+func (w *WAL) compactClosed(latest map[compactionKey]int64) error {
+	for _, index := range w.segments.indexes() {
+		if index >= w.currentSegmentIndex {
+			break
+		}
+		if err := w.compactSegment(index, latest); err != nil {
+			return fmt.Errorf("failed to compact segment %d: %w", index, err)
+		}
+	}
+	return w.refreshUsage()
+}
+
+// ** drop superseded entries and expired tombstones from one closed segment
+// ** a key latest does not know, written after it was built, is kept
+// ** must be called with the mutex held
+func (w *WAL) compactSegment(index int, latest map[compactionKey]int64) error {
+	dropped, err := w.rewriteSegment(index, func(record logRecord, modTime time.Time) bool {
+		if record.Key == "" {
+			return false
+		}
+		expired := w.compaction.TombstoneRetention > 0 && time.Since(modTime) > w.compaction.TombstoneRetention
+		newest, ok := latest[compactionKey{record.Topic, record.Key}]
+		superseded := ok && newest > record.Offset
+		return superseded || (isTombstone(record) && expired)
+	})
+	w.metrics.compacted.Add(uint64(dropped))
+	return err
+}
+
+// ** rewrite one closed segment without the records drop returns true for,
+// ** given the segment's modification time, must be called with the mutex held
+// ** the new contents go through a temp file and a rename, and a segment
+// ** that was compressed is compressed again afterwards
+// ** returns how many records were dropped, a segment left empty is deleted
+func (w *WAL) rewriteSegment(index int, drop func(record logRecord, modTime time.Time) bool) (int, error) {
+	path := segmentPath(w.fs, w.directory, index)
+	info, err := w.fs.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	source, err := openSegment(w.fs, path, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer source.Close()
+
+	plain := segmentFileName(w.directory, index)
+	tmp, err := createFile(w.fs, plain+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer w.fs.Remove(plain + ".tmp")
+	out := bufio.NewWriterSize(tmp, bufferSize)
+
+	reader := bufio.NewReader(source)
+	header, size, err := readSegmentHeader(reader)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	position := size
+	if size > 0 {
+		// ** same header, the segment still starts where it used to
+		if _, err := out.Write(header.encode()); err != nil {
+			tmp.Close()
+			return 0, err
+		}
+	}
+	decode := segmentDecoders[header.Version]
+	kept, dropped := 0, 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			tmp.Close()
+			return 0, err
+		}
+		record, err := decode(w.encryption, line)
+		if err != nil {
+			// ** stopping here would rename away every record after it
+			tmp.Close()
+			return 0, &CorruptError{Segment: index, Position: position, Reason: "unreadable record, run walctl repair"}
+		}
+		position += int64(len(line))
+		if drop(record, info.ModTime()) {
+			dropped++
+			continue
+		}
+		if record.Batch > 0 {
+			// ** part of the batch may be gone, and a closed segment no longer
+			// ** needs the marker, recovery only looks at the active segment
+			record.Batch = 0
+			err = w.encryption.encodeRecord(out, record)
+		} else {
+			_, err = out.Write(line)
+		}
+		if err != nil {
+			tmp.Close()
+			return 0, err
+		}
+		kept++
+	}
+	if dropped == 0 {
+		tmp.Close()
+		return 0, nil
+	}
+	if kept == 0 {
+		// ** nothing left, an empty segment would only get in the way of
+		// ** TruncateBefore and offset lookups
+		tmp.Close()
+		return dropped, w.deleteSegmentFiles(index)
+	}
+
+	if err := out.Flush(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	// ** keep the age so retention and tombstone expiry are not reset
+	if err := w.fs.Chtimes(plain+".tmp", info.ModTime(), info.ModTime()); err != nil {
+		return 0, err
+	}
+	// ** the plain file wins over a compressed one of the same index, so the
+	// ** compacted contents are in effect from the rename on
+	if err := w.fs.Rename(plain+".tmp", plain); err != nil {
+		return 0, err
+	}
+	if err := w.fs.SyncDir(w.directory); err != nil {
+		return 0, err
+	}
+	if compression := compressionOf(path); compression != CompressionNone {
+		if err := compressSegment(w.fs, w.directory, index, compression); err != nil {
+			return 0, err
+		}
+		if err := w.fs.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, _, err := buildIndex(w.fs, w.directory, index, w.encryption); err != nil {
+		return 0, err
+	}
+	filter, err := buildTopicFilter(w.fs, w.directory, index, w.encryption)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeTopicFilter(w.fs, w.directory, index, filter); err != nil {
+		return 0, err
+	}
+	times, err := buildTimeRange(w.fs, w.directory, index, w.encryption)
+	if err != nil {
+		return 0, err
+	}
+	if err := writeTimeRange(w.fs, w.directory, index, times); err != nil {
+		return 0, err
+	}
+	delete(w.archived, index)
+	return dropped, w.segments.refresh(index)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// ** keyed entries keep only their newest value, entries without a key all
+// ** stay, and a delete removes the values before it
+func TestCompactKeepsNewestPerKey(t *testing.T) {
+	wal, err := newWriteAheadLOG(Options{Directory: t.TempDir(), Rotation: RotationPolicy{MaxEntries: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := wal.WriteKeyed("users", "a", i); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wal.WriteKeyed("users", "b", i); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wal.WriteLog("events", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := wal.DeleteKey("users", "b"); err != nil {
+		t.Fatal(err)
+	}
+	// ** the same key in another topic is a key of its own
+	if _, err := wal.WriteKeyed("orders", "a", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := wal.ReadFrom(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		counts[entry.Topic+"/"+entry.Key]++
+	}
+	want := map[string]int{"users/a": 1, "users/b": 1, "events/": 3, "orders/a": 1}
+	for key, count := range want {
+		if counts[key] != count {
+			t.Fatalf("%s has %d entries after compaction, want %d (all: %v)", key, counts[key], count, counts)
+		}
+	}
+	for _, entry := range entries {
+		if entry.Topic == "users" && entry.Key == "a" && entry.Payload != float64(2) {
+			t.Fatalf("users/a kept %v, want the newest value 2", entry.Payload)
+		}
+		if entry.Topic == "users" && entry.Key == "b" && entry.Payload != nil {
+			t.Fatalf("users/b kept %v, want only its tombstone", entry.Payload)
+		}
+	}
+}
+
+// ** a tombstone outlives TombstoneRetention only in the active segment
+func TestCompactDropsExpiredTombstones(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := newWriteAheadLOG(Options{
+		Directory:  dir,
+		Rotation:   RotationPolicy{MaxEntries: 2},
+		Compaction: CompactionPolicy{TombstoneRetention: time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if _, err := wal.WriteKeyed("users", "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.DeleteKey("users", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.WriteLog("events", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := wal.ReadFrom(0, "users"); len(entries) != 1 {
+		t.Fatalf("got %d users entries, want the fresh tombstone only", len(entries))
+	}
+
+	old := time.Now().Add(-time.Hour)
+	for _, index := range wal.segments.indexes() {
+		if index < wal.currentSegmentIndex {
+			if err := os.Chtimes(segmentPath(wal.fs, dir, index), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := wal.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := wal.ReadFrom(0, "users"); len(entries) != 0 {
+		t.Fatalf("got %d users entries, want the expired tombstone gone", len(entries))
+	}
+}
+
+// ** a damaged record must stop compaction, not cost the records after it
+func TestCompactRefusesCorruptSegment(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := newWriteAheadLOG(Options{Directory: dir, Rotation: RotationPolicy{MaxEntries: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		if _, err := wal.WriteKeyed("users", "a", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer wal.Close()
+	first := wal.segments.indexes()[0]
+
+	path := segmentFileName(dir, first)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data[segmentHeaderSize:], []byte("\n"))
+	garbage := bytes.Repeat([]byte("#"), len(lines[1])-1)
+	damaged := append([]byte(nil), data...)
+	copy(damaged[segmentHeaderSize+len(lines[0]):], garbage)
+	if err := os.WriteFile(path, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// ** damaged under the open wal, opening it again would already refuse
+	err = wal.Compact()
+	var corrupt *CorruptError
+	if !errors.As(err, &corrupt) || corrupt.Segment != first {
+		t.Fatalf("compacting a damaged segment returned %v, want a CorruptError for segment %d", err, first)
+	}
+	after, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after, damaged) {
+		t.Fatal("the damaged segment was rewritten")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ** how closed segments are compressed once they are rotated out
+// ** the active segment is always plain so appends stay cheap
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+type segmentCodec struct {
+	newReader func(io.Reader) (io.ReadCloser, error)
+	newWriter func(io.Writer) (io.WriteCloser, error)
+}
+
+// ** file suffix appended to wal_N.log for every known compression
+var compressionSuffixes = map[Compression]string{
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+// ** codecs compiled into this binary, zstd is added by the zstd build tag
+var segmentCodecs = map[Compression]segmentCodec{
+	CompressionGzip: {
+		newReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+	},
+}
+
+func (c Compression) validate() error {
+	if c == CompressionNone {
+		return nil
+	}
+	if _, ok := segmentCodecs[c]; !ok {
+		if _, known := compressionSuffixes[c]; known {
+			return fmt.Errorf("compression %q is not compiled in, build with -tags %s", c, c)
+		}
+		return fmt.Errorf("unknown compression %q", c)
+	}
+	return nil
+}
+
+// ** compression of a segment file judging by its name
+func compressionOf(path string) Compression {
+	for compression, suffix := range compressionSuffixes {
+		if strings.HasSuffix(path, ".log"+suffix) {
+			return compression
+		}
+	}
+	return CompressionNone
+}
+
+// ** path of a segment as it exists on disk, compressed or not
+func segmentPath(fs fileSystem, directory string, index int) string {
+	plain := segmentFileName(directory, index)
+	if _, err := fs.Stat(plain); err == nil {
+		return plain
+	}
+	for _, suffix := range compressionSuffixes {
+		if _, err := fs.Stat(plain + suffix); err == nil {
+			return plain + suffix
+		}
+	}
+	return plain
+}
+
+type segmentReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *segmentReader) Close() error {
+	var firstErr error
+	for _, closer := range r.closers {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ** open a segment for reading from byte position of its uncompressed contents
+func openSegment(fs fileSystem, path string, position int64) (io.ReadCloser, error) {
+	file, err := openFile(fs, path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment file: %w", err)
+	}
+	compression := compressionOf(path)
+	if compression == CompressionNone {
+		if _, err := file.Seek(position, io.SeekStart); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to seek segment: %w", err)
+		}
+		return file, nil
+	}
+	return decompressSegment(path, file, position)
+}
+
+// ** decompressing reader over the contents of a compressed segment,
+// ** skipped ahead to position, closing it closes source too
+func decompressSegment(name string, source io.ReadCloser, position int64) (io.ReadCloser, error) {
+	compression := compressionOf(name)
+	codec, ok := segmentCodecs[compression]
+	if !ok {
+		source.Close()
+		return nil, fmt.Errorf("segment %s needs %s support, build with -tags %s", name, compression, compression)
+	}
+	decompressed, err := codec.newReader(source)
+	if err != nil {
+		source.Close()
+		return nil, fmt.Errorf("failed to open compressed segment %s: %w", name, err)
+	}
+	reader := &segmentReader{Reader: decompressed, closers: []io.Closer{decompressed, source}}
+	// ** compressed streams cannot seek, skip ahead instead
+	if _, err := io.CopyN(io.Discard, reader, position); err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("failed to seek compressed segment %s: %w", name, err)
+	}
+	return reader, nil
+}
+
+// ** replace a closed plain segment with its compressed form
+// ** the compressed file is synced before the original is removed, so a
+// ** crash leaves either the plain segment or both, never neither
+func compressSegment(fs fileSystem, directory string, index int, compression Compression) error {
+	codec := segmentCodecs[compression]
+	plain := segmentFileName(directory, index)
+	target := plain + compressionSuffixes[compression]
+
+	source, err := openFile(fs, plain)
+	if err != nil {
+		return fmt.Errorf("failed to open segment file: %w", err)
+	}
+	defer source.Close()
+	tmp, err := createFile(fs, target+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create compressed segment: %w", err)
+	}
+	defer fs.Remove(target + ".tmp")
+	defer tmp.Close()
+
+	writer, err := codec.newWriter(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to start compression: %w", err)
+	}
+	if _, err := io.Copy(writer, source); err != nil {
+		return fmt.Errorf("failed to compress segment: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to finish compression: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync compressed segment: %w", err)
+	}
+	if err := fs.Rename(target+".tmp", target); err != nil {
+		return fmt.Errorf("failed to replace compressed segment: %w", err)
+	}
+	if err := fs.Remove(plain); err != nil {
+		return fmt.Errorf("failed to remove plain segment: %w", err)
+	}
+	return fs.SyncDir(directory)
+}
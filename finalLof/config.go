@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ** the server binary takes every setting, highest first, from its command
+// ** line flag, a WAL_ environment variable or the -config file, and falls
+// ** back to the flag's default
+// ** the names are the same everywhere, in the environment upper cased with
+// ** underscores, so -tls-cert is WAL_TLS_CERT and tls-cert in the file
+// ** the file is a small subset of TOML: key = value lines, # comments,
+// ** quoted or bare values, and [section] headers that prefix the keys below
+// ** them, so age under [retention] sets retention-age
+
+// ** environment variable that sets the flag called name
+func configEnvName(name string) string {
+	return "WAL_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// ** set every flag of flags that was not on the command line from the
+// ** environment or the config file named by the config flag
+// ** flags must be parsed already, values go through flag.Set so they are
+// ** checked the same way wherever they come from
+func loadConfig(flags *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var file map[string]configSetting
+	if configFlag := flags.Lookup("config"); configFlag != nil {
+		path := configFlag.Value.String()
+		if value, ok := lookupEnv(configEnvName("config")); ok && !given["config"] {
+			path = value
+		}
+		if path != "" {
+			var err error
+			if file, err = readConfigFile(path); err != nil {
+				return err
+			}
+			for name, setting := range file {
+				if flags.Lookup(name) == nil || name == "config" {
+					return fmt.Errorf("%s line %d: unknown setting %q", path, setting.line, name)
+				}
+			}
+		}
+	}
+
+	var firstErr error
+	flags.VisitAll(func(f *flag.Flag) {
+		if firstErr != nil || given[f.Name] || f.Name == "config" {
+			return
+		}
+		if value, ok := lookupEnv(configEnvName(f.Name)); ok {
+			if err := flags.Set(f.Name, value); err != nil {
+				firstErr = fmt.Errorf("invalid value %q for %s: %v", value, configEnvName(f.Name), err)
+			}
+			return
+		}
+		if setting, ok := file[f.Name]; ok {
+			if err := flags.Set(f.Name, setting.value); err != nil {
+				firstErr = fmt.Errorf("%s line %d: invalid value %q for %s: %v", setting.path, setting.line, setting.value, f.Name, err)
+			}
+		}
+	})
+	return firstErr
+}
+
+// ** a value from the config file and where it was written
+type configSetting struct {
+	value string
+	path  string
+	line  int
+}
+
+func readConfigFile(path string) (map[string]configSetting, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	settings := make(map[string]configSetting)
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			if !strings.HasSuffix(text, "]") {
+				return nil, fmt.Errorf("%s line %d: unterminated section header", path, line)
+			}
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			continue
+		}
+		equals := strings.Index(text, "=")
+		if equals < 0 {
+			return nil, fmt.Errorf("%s line %d: expected key = value", path, line)
+		}
+		key := strings.TrimSpace(text[:equals])
+		if key == "" {
+			return nil, fmt.Errorf("%s line %d: missing key", path, line)
+		}
+		if section != "" {
+			key = section + "-" + key
+		}
+		value, err := parseConfigValue(strings.TrimSpace(text[equals+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		if previous, ok := settings[key]; ok {
+			return nil, fmt.Errorf("%s line %d: %s is already set on line %d", path, line, key, previous.line)
+		}
+		settings[key] = configSetting{value: value, path: path, line: line}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return settings, nil
+}
+
+// ** a double quoted string with escapes, a single quoted one taken as it is,
+// ** or a bare word or number, each optionally followed by a # comment
+func parseConfigValue(text string) (string, error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		end := 1
+		for end < len(text) && text[end] != '"' {
+			if text[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(text) {
+			return "", errors.New("unterminated string")
+		}
+		if err := checkConfigRest(text[end+1:]); err != nil {
+			return "", err
+		}
+		return strconv.Unquote(text[:end+1])
+	case strings.HasPrefix(text, "'"):
+		end := strings.Index(text[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated string")
+		}
+		if err := checkConfigRest(text[end+2:]); err != nil {
+			return "", err
+		}
+		return text[1 : end+1], nil
+	}
+	if comment := strings.Index(text, "#"); comment >= 0 {
+		text = strings.TrimSpace(text[:comment])
+	}
+	if text == "" {
+		return "", errors.New("missing value")
+	}
+	if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "{") {
+		return "", errors.New("arrays and tables are not supported")
+	}
+	return text, nil
+}
+
+// ** only a comment may follow a quoted value
+func checkConfigRest(rest string) error {
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected %q after value", rest)
+	}
+	return nil
+}
+
+// ** settings of the server binary that are not checked anywhere else
+func checkServerConfig(port int, rotation RotationPolicy, retention RetentionPolicy) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d is not between 1 and 65535", port)
+	}
+	if rotation.MaxBytes <= 0 {
+		return fmt.Errorf("segment size must be positive, got %d", rotation.MaxBytes)
+	}
+	if rotation.MaxEntries < 0 || rotation.MaxAge < 0 {
+		return errors.New("segment entry and age limits must not be negative")
+	}
+	if retention.MaxBytes < 0 || retention.MaxSegments < 0 || retention.MaxAge < 0 {
+		return errors.New("retention limits must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const consumersFileName = "wal.consumers"
+
+// ** committed offsets by consumer name, loaded on open and rewritten on every commit
+func readConsumerOffsets(fs fileSystem, directory string) (map[string]int64, error) {
+	offsets := make(map[string]int64)
+	data, err := readFile(fs, filepath.Join(directory, consumersFileName))
+	if os.IsNotExist(err) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consumer offsets: %w", err)
+	}
+	if err := json.Unmarshal(data, &offsets); err != nil {
+		return nil, fmt.Errorf("failed to decode consumer offsets: %w", err)
+	}
+	return offsets, nil
+}
+
+func writeConsumerOffsets(fs fileSystem, directory string, offsets map[string]int64) error {
+	data, err := json.Marshal(offsets)
+	if err != nil {
+		return fmt.Errorf("failed to encode consumer offsets: %w", err)
+	}
+	if err := writeFileAtomic(fs, filepath.Join(directory, consumersFileName), data); err != nil {
+		return fmt.Errorf("failed to write consumer offsets: %w", err)
+	}
+	return nil
+}
+
+// ** remember where a consumer should resume, offset is the next entry it
+// ** wants to read, so a consumer that has handled offset N commits N+1
+// ** the commit is durable once this returns
+func (w *WAL) CommitOffset(consumer string, offset int64) error {
+	if consumer == "" {
+		return fmt.Errorf("failed to commit offset: consumer name is empty")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if offset < 0 || offset > w.offset {
+		return fmt.Errorf("failed to commit offset: offset %d is past the end of the log", offset)
+	}
+
+	previous, had := w.consumers[consumer]
+	w.consumers[consumer] = offset
+	if err := writeConsumerOffsets(w.fs, w.directory, w.consumers); err != nil {
+		if had {
+			w.consumers[consumer] = previous
+		} else {
+			delete(w.consumers, consumer)
+		}
+		return err
+	}
+	return nil
+}
+
+// ** the offset a consumer last committed, ok is false if it never committed
+func (w *WAL) CommittedOffset(consumer string) (offset int64, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	offset, ok = w.consumers[consumer]
+	return offset, ok
+}
@@ -0,0 +1,46 @@
+package main
+
+import "context"
+
+// ** run fn in its own goroutine and wait until it returns or ctx is done
+// ** writes hold the mutex across the fsync and cannot give it up halfway,
+// ** so fn keeps running after ctx is done and a write that was cancelled
+// ** may still end up in the log
+func waitContext(ctx context.Context, fn func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ** WriteLog that gives up waiting once ctx is done, returning ctx.Err()
+// ** the entry may still be committed afterwards, callers that retry should
+// ** use WriteLogIdempotent so the retry does not write it twice
+func (w *WAL) WriteLogContext(ctx context.Context, topic string, payload interface{}) (int64, error) {
+	var offset int64
+	var err error
+	if ctxErr := waitContext(ctx, func() { offset, err = w.writeLogContext(ctx, topic, payload) }); ctxErr != nil {
+		return 0, ctxErr
+	}
+	return offset, err
+}
+
+// ** WriteBatch that gives up waiting once ctx is done, returning ctx.Err()
+// ** like WriteLogContext the batch may still be committed afterwards
+func (w *WAL) WriteBatchContext(ctx context.Context, entries []LogEntry) error {
+	var err error
+	if ctxErr := waitContext(ctx, func() { _, err = w.writeBatchOffsets(ctx, entries) }); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
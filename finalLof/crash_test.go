@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+// ** the crash test of walctl crashtest under a fixed seed, so a failure
+// ** reproduces with walctl crashtest -seed 1
+func TestCrashRecovery(t *testing.T) {
+	runs := 40
+	if testing.Short() {
+		runs = 10
+	}
+	log, err := runCrashTest(t.TempDir(), runs, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.crashes == 0 {
+		t.Fatal("no run crashed, the faults were not injected")
+	}
+}
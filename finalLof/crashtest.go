@@ -0,0 +1,338 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// ** writes one crash test run makes before closing the wal cleanly
+const crashTestWrites = 200
+
+// ** topic of the entries the crash test purges again, all others go to crash
+const crashTestPurgedTopic = "purge"
+
+// ** what the crash test knows must be in the log, and what it wrote
+type crashTestLog struct {
+	durable map[int64]int  // ** offset to sequence number of every entry that must survive
+	next    int            // ** sequence number of the next entry written
+	batches map[int]int    // ** first sequence number of every batch to its size
+	keys    map[int]string // ** sequence number of every keyed entry to its key
+	purged  map[int]bool   // ** sequence numbers written to crashTestPurgedTopic
+	gone    map[int]bool   // ** sequence numbers a truncation or purge removed for good
+	crashes int
+}
+
+// ** open the wal in directory on a faultFS over and over, write until the
+// ** injected fault kills the writer, and check after every run that the
+// ** wal recovers to a log holding every acknowledged entry, in order, with
+// ** batches whole or not at all and no corrupt segment left
+// ** besides writes and batches a run truncates, compacts and purges a topic
+// ** now and then, and each run rotates segments at a different size, so
+// ** the faults also land in the middle of rewrites and rotations
+// ** a failed fsync ends the run like a kill, the wal promises nothing about
+// ** writes after one
+func runCrashTest(directory string, iterations int, seed int64, progress io.Writer) (*crashTestLog, error) {
+	random := rand.New(rand.NewSource(seed))
+	log := &crashTestLog{
+		durable: make(map[int64]int),
+		batches: make(map[int]int),
+		keys:    make(map[int]string),
+		purged:  make(map[int]bool),
+		gone:    make(map[int]bool),
+	}
+	for i := 0; i < iterations; i++ {
+		rotation := RotationPolicy{MaxBytes: int64(256 + random.Intn(8<<10))}
+		faults := &faultFS{
+			fileSystem:  osFS{},
+			random:      random,
+			writeBudget: int64(random.Intn(8 << 10)),
+			shortReads:  random.Intn(2) == 0,
+		}
+		if random.Intn(4) == 0 {
+			faults.syncFailure = 0.05
+		}
+		if random.Intn(8) == 0 {
+			// ** now and then a run that gets to close the wal
+			faults.writeBudget = -1
+		}
+		if err := log.run(directory, rotation, faults, random); err != nil {
+			return log, fmt.Errorf("run %d: %w", i, err)
+		}
+		if err := log.check(directory); err != nil {
+			return log, fmt.Errorf("run %d: %w", i, err)
+		}
+		if progress != nil {
+			fmt.Fprintf(progress, "run %d: %d entries durable\n", i, len(log.durable))
+		}
+	}
+	return log, nil
+}
+
+// ** one run of writes until the fault fires, acknowledged entries become durable
+func (l *crashTestLog) run(directory string, rotation RotationPolicy, faults *faultFS, random *rand.Rand) error {
+	wal, err := newWriteAheadLOG(Options{Directory: directory, Rotation: rotation, fs: faults})
+	if err != nil {
+		if faults.isCrashed() {
+			// ** killed while opening, before anything new was written
+			l.crashes++
+			return nil
+		}
+		return fmt.Errorf("failed to open wal: %w", err)
+	}
+	for i := 0; i < crashTestWrites; i++ {
+		if err := l.step(wal, random); err != nil {
+			break
+		}
+	}
+	wal.Close()
+	if faults.isCrashed() {
+		l.crashes++
+	}
+	return nil
+}
+
+// ** one write or maintenance call, an error ends the run
+func (l *crashTestLog) step(wal *WAL, random *rand.Rand) error {
+	switch op := random.Intn(40); {
+	case op < 10:
+		entries := make([]LogEntry, 1+random.Intn(5))
+		first := l.next
+		for j := range entries {
+			entries[j] = LogEntry{Topic: "crash", Payload: l.payload(random)}
+		}
+		l.batches[first] = len(entries)
+		offsets, err := wal.WriteBatchOffsets(entries)
+		if err != nil {
+			return err
+		}
+		for j, offset := range offsets {
+			l.durable[offset] = first + j
+		}
+	case op < 14:
+		seq, key := l.next, fmt.Sprintf("key-%d", random.Intn(4))
+		l.keys[seq] = key
+		offset, err := wal.WriteKeyed("crash", key, l.payload(random))
+		if err != nil {
+			return err
+		}
+		l.durable[offset] = seq
+	case op < 17:
+		seq := l.next
+		l.purged[seq] = true
+		offset, err := wal.WriteLog(crashTestPurgedTopic, l.payload(random))
+		if err != nil {
+			return err
+		}
+		l.durable[offset] = seq
+	case op == 17:
+		return l.truncate(wal, random)
+	case op == 18:
+		return l.compact(wal)
+	case op == 19:
+		return l.purge(wal)
+	default:
+		seq := l.next
+		offset, err := wal.WriteLog("crash", l.payload(random))
+		if err != nil {
+			return err
+		}
+		l.durable[offset] = seq
+	}
+	return nil
+}
+
+// ** cut off the last few entries, they are only gone for good once
+// ** TruncateAfter returned, a batch that is cut keeps what is left of it
+func (l *crashTestLog) truncate(wal *WAL, random *rand.Rand) error {
+	last := int64(0)
+	for offset := range l.durable {
+		if offset > last {
+			last = offset
+		}
+	}
+	cut := last - int64(random.Intn(20))
+	if cut < 0 {
+		cut = 0
+	}
+	removed := make(map[int]bool)
+	for offset, seq := range l.durable {
+		if offset > cut {
+			removed[seq] = true
+			delete(l.durable, offset)
+		}
+	}
+	kept := make(map[int]int)
+	for first, size := range l.batches {
+		cutShort := false
+		for seq := first; seq < first+size; seq++ {
+			cutShort = cutShort || removed[seq]
+		}
+		if !cutShort {
+			continue
+		}
+		// ** whatever a crash midway leaves of the batch is acceptable
+		delete(l.batches, first)
+		for seq := first; seq < first+size && !removed[seq]; seq++ {
+			kept[first]++
+		}
+	}
+	if err := wal.TruncateAfter(cut); err != nil {
+		return err
+	}
+	for seq := range removed {
+		l.gone[seq] = true
+	}
+	for first, size := range kept {
+		l.batches[first] = size
+	}
+	return nil
+}
+
+// ** compact the keyed entries, every one a later entry of its key
+// ** supersedes may be dropped from here on
+func (l *crashTestLog) compact(wal *WAL) error {
+	latest := make(map[string]int64)
+	for offset, seq := range l.durable {
+		if key, ok := l.keys[seq]; ok && offset > latest[key] {
+			latest[key] = offset
+		}
+	}
+	for offset, seq := range l.durable {
+		if key, ok := l.keys[seq]; ok && offset != latest[key] {
+			delete(l.durable, offset)
+		}
+	}
+	return wal.Compact()
+}
+
+// ** purge crashTestPurgedTopic, its entries are gone for good once
+// ** PurgeTopic returned
+func (l *crashTestLog) purge(wal *WAL) error {
+	for offset, seq := range l.durable {
+		if l.purged[seq] {
+			delete(l.durable, offset)
+		}
+	}
+	if _, err := wal.PurgeTopic(crashTestPurgedTopic); err != nil {
+		return err
+	}
+	for seq := range l.purged {
+		l.gone[seq] = true
+	}
+	return nil
+}
+
+func (l *crashTestLog) payload(random *rand.Rand) map[string]interface{} {
+	payload := map[string]interface{}{
+		"seq": l.next,
+		"pad": strings.Repeat("p", random.Intn(200)),
+	}
+	l.next++
+	return payload
+}
+
+// ** recover the wal without faults and compare it with what was written
+func (l *crashTestLog) check(directory string) error {
+	wal, err := newWriteAheadLOG(Options{Directory: directory})
+	if err != nil {
+		return fmt.Errorf("recovery failed: %w", err)
+	}
+	defer wal.Close()
+
+	corrupt, err := wal.Verify()
+	if err != nil {
+		return err
+	}
+	if len(corrupt) > 0 {
+		return fmt.Errorf("segment %d is corrupt after recovery: %s", corrupt[0].Segment, corrupt[0].Reason)
+	}
+	entries, err := wal.ReadFrom(0)
+	if err != nil {
+		return fmt.Errorf("failed to read recovered log: %w", err)
+	}
+
+	found := make(map[int64]int, len(entries))
+	present := make(map[int]bool, len(entries))
+	lastOffset, lastSeq := int64(-1), -1
+	for _, entry := range entries {
+		payload, ok := entry.Payload.(map[string]interface{})
+		number, isNumber := payload["seq"].(float64)
+		if !ok || !isNumber {
+			return fmt.Errorf("entry %d has an unexpected payload %v", entry.Offset, entry.Payload)
+		}
+		seq := int(number)
+		if entry.Offset <= lastOffset {
+			return fmt.Errorf("offset %d follows offset %d", entry.Offset, lastOffset)
+		}
+		if seq <= lastSeq || seq >= l.next {
+			return fmt.Errorf("entry %d holds write %d, which is out of order", entry.Offset, seq)
+		}
+		if l.gone[seq] {
+			return fmt.Errorf("entry %d holds write %d, which was removed", entry.Offset, seq)
+		}
+		lastOffset, lastSeq = entry.Offset, seq
+		found[entry.Offset] = seq
+		present[seq] = true
+	}
+	for offset, seq := range l.durable {
+		if got, ok := found[offset]; !ok || got != seq {
+			return fmt.Errorf("acknowledged write %d at offset %d was lost", seq, offset)
+		}
+	}
+	for first, size := range l.batches {
+		count := 0
+		for seq := first; seq < first+size; seq++ {
+			if present[seq] {
+				count++
+			}
+		}
+		if count != 0 && count != size {
+			return fmt.Errorf("batch starting with write %d was recovered with %d of %d entries", first, count, size)
+		}
+	}
+	// ** what recovery kept is committed, a later crash must not take it away
+	for offset, seq := range found {
+		l.durable[offset] = seq
+	}
+	return nil
+}
+
+// ** crash consistency check, see runCrashTest
+func walctlCrashTest(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("crashtest", flag.ContinueOnError)
+	dir := flags.String("dir", "", "directory for the wal, a temporary one that is removed afterwards if empty")
+	iterations := flags.Int("runs", 100, "writer runs to crash")
+	seed := flags.Int64("seed", 0, "seed of the injected faults, taken from the clock if zero")
+	verbose := flags.Bool("v", false, "report every run")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	directory := *dir
+	if directory == "" {
+		var err error
+		if directory, err = os.MkdirTemp("", "walcrash"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(directory)
+	}
+
+	var progress io.Writer
+	if *verbose {
+		progress = stdout
+	}
+	log, err := runCrashTest(directory, *iterations, *seed, progress)
+	if err != nil {
+		return fmt.Errorf("seed %d: %w", *seed, err)
+	}
+	fmt.Fprintf(stdout, "%d runs, %d crashes, %d of %d writes durable, seed %d\n",
+		*iterations, log.crashes, len(log.durable), log.next, *seed)
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import "context"
+
+// ** how many of the newest entries are checked for a repeated idempotency key
+const dedupWindow = 1024
+
+type keyedOffset struct {
+	key    string
+	offset int64
+}
+
+// ** idempotency keys of the entries in the dedup window
+// ** keys live in the records themselves, so the window is rebuilt on open
+// ** and a retry after a restart is still recognised
+type dedupIndex struct {
+	offsets map[string]int64
+	order   []keyedOffset
+}
+
+func newDedupIndex() *dedupIndex {
+	return &dedupIndex{offsets: make(map[string]int64)}
+}
+
+// ** the offset key was written at, if that is still inside the window ending at next
+func (d *dedupIndex) lookup(key string, next int64) (int64, bool) {
+	offset, ok := d.offsets[key]
+	if !ok || offset < next-dedupWindow {
+		return 0, false
+	}
+	return offset, true
+}
+
+// ** remember that key was written at offset and forget keys that fell out
+// ** of the window ending at next
+func (d *dedupIndex) add(key string, offset, next int64) {
+	d.offsets[key] = offset
+	d.order = append(d.order, keyedOffset{key, offset})
+	drop := 0
+	for drop < len(d.order) && d.order[drop].offset < next-dedupWindow {
+		if d.offsets[d.order[drop].key] == d.order[drop].offset {
+			delete(d.offsets, d.order[drop].key)
+		}
+		drop++
+	}
+	d.order = d.order[drop:]
+}
+
+// ** forget keys at or after offset, after those entries were truncated
+func (d *dedupIndex) dropFrom(offset int64) {
+	keep := len(d.order)
+	for keep > 0 && d.order[keep-1].offset >= offset {
+		keep--
+		if d.offsets[d.order[keep].key] == d.order[keep].offset {
+			delete(d.offsets, d.order[keep].key)
+		}
+	}
+	d.order = d.order[:keep]
+}
+
+// ** collect the keys of the newest entries, must be called with the mutex held
+func (w *WAL) rebuildDedup() error {
+	from := w.offset - dedupWindow
+	return w.scanRecordsFrom(from, nil, func(record logRecord) error {
+		if record.ID != "" {
+			w.dedup.add(record.ID, record.Offset, w.offset)
+		}
+		return nil
+	})
+}
+
+// ** write an entry unless an entry with the same key is still in the dedup window
+// ** for a repeated key nothing is written and the offset assigned the first
+// ** time is returned with duplicate set, so producers can retry safely
+func (w *WAL) WriteLogIdempotent(key, topic string, payload interface{}) (offset int64, duplicate bool, err error) {
+	return w.writeLogIdempotent(context.Background(), key, topic, payload)
+}
+
+// ** WriteLogIdempotent with the spans of the write under ctx
+func (w *WAL) writeLogIdempotent(ctx context.Context, key, topic string, payload interface{}) (offset int64, duplicate bool, err error) {
+	defer w.metrics.countError(&err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, false, ErrClosed
+	}
+	defer w.traceFrom(ctx)()
+	if key != "" {
+		if offset, ok := w.dedup.lookup(key, w.offset); ok {
+			return offset, true, nil
+		}
+	}
+	offset, err = w.writeLog(key, LogEntry{Topic: topic, Payload: payload})
+	return offset, false, err
+}
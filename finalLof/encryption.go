@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+const keyCheckFileName = "wal.keycheck"
+
+// ** plaintext sealed into the key check file, only the right key opens it
+var keyCheckPlaintext = []byte("go-wal key check")
+
+var (
+	// ** the key does not match the one the wal was created with
+	ErrWrongKey = errors.New("wal encryption key does not match")
+	// ** the wal on disk is encrypted but no key was configured
+	ErrKeyRequired = errors.New("wal is encrypted, an encryption key is required")
+)
+
+// ** supplies the AES key used to encrypt segments
+// ** the key must be 16, 24 or 32 bytes for AES-128, AES-192 or AES-256
+type KeyProvider interface {
+	Key() ([]byte, error)
+}
+
+// ** a KeyProvider for a key already held in memory
+type StaticKey []byte
+
+func (k StaticKey) Key() ([]byte, error) {
+	return k, nil
+}
+
+// ** encrypts each record on its own with AES-GCM
+// ** an encrypted record is base64(nonce || ciphertext) on its own line, so
+// ** line framing, recovery and the offset index work unchanged
+// ** a nil *recordEncryption means records are stored as plain JSON
+type recordEncryption struct {
+	aead cipher.AEAD
+}
+
+func newRecordEncryption(provider KeyProvider) (*recordEncryption, error) {
+	if provider == nil {
+		return nil, nil
+	}
+	key, err := provider.Key()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up AES-GCM: %w", err)
+	}
+	return &recordEncryption{aead: aead}, nil
+}
+
+func (e *recordEncryption) seal(plaintext []byte) ([]byte, error) {
+	return e.sealTo(nil, plaintext)
+}
+
+// ** nonce || ciphertext of plaintext, in dst if it has room for it
+func (e *recordEncryption) sealTo(dst, plaintext []byte) ([]byte, error) {
+	size := e.aead.NonceSize()
+	nonce := slices.Grow(dst[:0], size+len(plaintext)+e.aead.Overhead())[:size]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return e.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (e *recordEncryption) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < e.aead.NonceSize() {
+		return nil, errors.New("sealed record too short")
+	}
+	nonce, ciphertext := sealed[:e.aead.NonceSize()], sealed[e.aead.NonceSize():]
+	return e.aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// ** append the on-disk form of a record, newline included, to dst
+func (e *recordEncryption) encodeRecord(dst io.Writer, record logRecord) error {
+	scratch := getRecordScratch()
+	defer putRecordScratch(scratch)
+	line, err := e.encodeLine(scratch, record)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(line)
+	return err
+}
+
+// ** the on-disk form of a record, newline included, encoded in scratch
+// ** and only valid until scratch is used again
+func (e *recordEncryption) encodeLine(scratch *recordScratch, record logRecord) ([]byte, error) {
+	line, err := marshalRecord(scratch, record)
+	if err != nil || e == nil {
+		return line, err
+	}
+	if scratch.sealed, err = e.sealTo(scratch.sealed, line[:len(line)-1]); err != nil {
+		return nil, err
+	}
+	size := base64.StdEncoding.EncodedLen(len(scratch.sealed)) + 1
+	scratch.encoded = slices.Grow(scratch.encoded[:0], size)[:size]
+	base64.StdEncoding.Encode(scratch.encoded, scratch.sealed)
+	scratch.encoded[size-1] = '\n'
+	return scratch.encoded, nil
+}
+
+// ** parse one line of a segment back into a record
+func (e *recordEncryption) decodeRecord(line []byte) (logRecord, error) {
+	if e != nil {
+		sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSuffix(line, []byte("\n"))))
+		if err != nil {
+			return logRecord{}, err
+		}
+		if line, err = e.open(sealed); err != nil {
+			return logRecord{}, err
+		}
+	}
+	return unmarshalRecord(line)
+}
+
+// ** make sure the configured key, or the lack of one, fits the wal on disk
+// ** must run before recovery, which would otherwise cut off every record it
+// ** cannot decode as torn
+func checkEncryptionKey(fs fileSystem, directory string, encryption *recordEncryption) error {
+	path := filepath.Join(directory, keyCheckFileName)
+	sealed, err := readFile(fs, path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read key check file: %w", err)
+	}
+	exists := err == nil
+
+	switch {
+	case exists && encryption == nil:
+		return ErrKeyRequired
+	case exists:
+		plaintext, err := encryption.open(sealed)
+		if err != nil || !bytes.Equal(plaintext, keyCheckPlaintext) {
+			return ErrWrongKey
+		}
+		return nil
+	case encryption == nil:
+		return nil
+	}
+
+	// ** first open with a key, only allowed on a wal without plaintext data
+	indexes, err := listSegments(fs, directory)
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		data, err := holdsRecords(fs, segmentPath(fs, directory, index))
+		if err != nil {
+			return err
+		}
+		if data {
+			return errors.New("wal already holds unencrypted segments, refusing to enable encryption")
+		}
+	}
+	if sealed, err = encryption.seal(keyCheckPlaintext); err != nil {
+		return err
+	}
+	if err := writeFile(fs, path, sealed, 0600); err != nil {
+		return fmt.Errorf("failed to write key check file: %w", err)
+	}
+	return nil
+}
+
+// ** whether anything but zeros follows the header of a segment, a
+// ** preallocated segment is its full size before its first record
+func holdsRecords(fs fileSystem, path string) (bool, error) {
+	file, err := openSegment(fs, path, 0)
+	if err != nil {
+		return false, fmt.Errorf("failed to open segment file: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if _, _, err := readSegmentHeader(reader); err == errTornHeader {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	line, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to read segment: %w", err)
+	}
+	return len(bytes.Trim(line, "\x00")) > 0, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ** largest encoded entry unless Options.MaxEntrySize says otherwise
+const defaultMaxEntrySize = 4 << 20
+
+// ** matches every EntryTooLargeError with errors.Is
+var ErrEntryTooLarge = errors.New("entry is too large")
+
+// ** returned by writes of an entry whose encoded record is over the limit
+// ** nothing of the entry, or of the batch holding it, is written
+type EntryTooLargeError struct {
+	Size  int
+	Limit int64
+}
+
+func (e *EntryTooLargeError) Error() string {
+	return fmt.Sprintf("entry of %d bytes is over the limit of %d bytes", e.Size, e.Limit)
+}
+
+func (e *EntryTooLargeError) Is(target error) bool {
+	return target == ErrEntryTooLarge
+}
+
+// ** the limit Options.MaxEntrySize stands for, 0 for none
+func entrySizeLimit(max int64) int64 {
+	switch {
+	case max == 0:
+		return defaultMaxEntrySize
+	case max < 0:
+		return 0
+	default:
+		return max
+	}
+}
+
+// ** refuse an encoded record over the entry size limit
+func (w *WAL) checkEntrySize(size int) error {
+	if w.maxEntrySize > 0 && int64(size) > w.maxEntrySize {
+		return &EntryTooLargeError{Size: size, Limit: w.maxEntrySize}
+	}
+	return nil
+}
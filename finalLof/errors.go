@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ** matches every CorruptError with errors.Is
+var ErrCorrupt = errors.New("wal segment is corrupt")
+
+// ** returned when a segment that should be there is gone, usually removed by
+// ** retention, compaction or TruncateBefore while it was being looked up
+var ErrSegmentNotFound = errors.New("segment not found")
+
+// ** a closed segment holding bytes that are not a record, or a damaged
+// ** segment header
+// ** the active segment is never reported, a torn tail there is what a crash
+// ** leaves and recovery cuts it off
+type CorruptError struct {
+	// ** index of the segment, 0 if it is not known where the error comes from
+	Segment  int
+	Position int64
+	Reason   string
+}
+
+func (e *CorruptError) Error() string {
+	if e.Segment == 0 {
+		return fmt.Sprintf("corrupt segment at byte %d: %s", e.Position, e.Reason)
+	}
+	return fmt.Sprintf("segment %d is corrupt at byte %d: %s", e.Segment, e.Position, e.Reason)
+}
+
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
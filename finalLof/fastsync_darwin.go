@@ -0,0 +1,14 @@
+//go:build darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ** plain fsync, which leaves the data in the drive's cache where
+// ** (*os.File).Sync issues F_FULLFSYNC to flush it to the platters
+func cacheSync(file *os.File) error {
+	return syscall.Fsync(int(file.Fd()))
+}
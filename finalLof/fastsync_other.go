@@ -0,0 +1,10 @@
+//go:build !darwin
+
+package main
+
+import "os"
+
+// ** fsync already reaches the disk here, FastSync is only honoured on darwin
+func cacheSync(file *os.File) error {
+	return file.Sync()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// ** returned by every operation of a faultFS once it has injected a fault
+var errInjected = errors.New("injected fault")
+
+// ** a fileSystem that fails on purpose, for the crash test
+// ** the first fault it injects crashes it, every later operation fails as if
+// ** the process had died there, while what reached the files so far stays
+// ** on disk like it does when a process is killed
+// ** locks pass straight through, so the wal can still be closed and reopened
+type faultFS struct {
+	fileSystem
+
+	mu     sync.Mutex
+	random *rand.Rand
+	// ** bytes that may still be written, the write crossing it is cut short
+	// ** and crashes, negative for no limit
+	writeBudget int64
+	// ** chance an fsync fails and crashes
+	syncFailure float64
+	// ** Read returns fewer bytes than asked for, which readers must cope with
+	shortReads bool
+	crashed    bool
+}
+
+func (f *faultFS) OpenFile(name string, flag int, perm os.FileMode) (storageFile, error) {
+	if f.isCrashed() {
+		return nil, errInjected
+	}
+	file, err := f.fileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{storageFile: file, fs: f}, nil
+}
+
+func (f *faultFS) Remove(name string) error {
+	if f.isCrashed() {
+		return errInjected
+	}
+	return f.fileSystem.Remove(name)
+}
+
+func (f *faultFS) Rename(oldpath, newpath string) error {
+	if f.isCrashed() {
+		return errInjected
+	}
+	return f.fileSystem.Rename(oldpath, newpath)
+}
+
+func (f *faultFS) Stat(name string) (os.FileInfo, error) {
+	if f.isCrashed() {
+		return nil, errInjected
+	}
+	return f.fileSystem.Stat(name)
+}
+
+func (f *faultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	if f.isCrashed() {
+		return nil, errInjected
+	}
+	return f.fileSystem.ReadDir(name)
+}
+
+func (f *faultFS) MkdirAll(path string, perm os.FileMode) error {
+	if f.isCrashed() {
+		return errInjected
+	}
+	return f.fileSystem.MkdirAll(path, perm)
+}
+
+func (f *faultFS) Chtimes(name string, atime, mtime time.Time) error {
+	if f.isCrashed() {
+		return errInjected
+	}
+	return f.fileSystem.Chtimes(name, atime, mtime)
+}
+
+func (f *faultFS) SyncDir(path string) error {
+	if err := f.allowSync(); err != nil {
+		return err
+	}
+	return f.fileSystem.SyncDir(path)
+}
+
+func (f *faultFS) isCrashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+// ** how many of size bytes may be written, crashing when that is not all
+func (f *faultFS) allowWrite(size int) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return 0, errInjected
+	}
+	if f.writeBudget < 0 || int64(size) <= f.writeBudget {
+		if f.writeBudget >= 0 {
+			f.writeBudget -= int64(size)
+		}
+		return size, nil
+	}
+	allowed := int(f.writeBudget)
+	f.writeBudget = 0
+	f.crashed = true
+	return allowed, errInjected
+}
+
+func (f *faultFS) allowSync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return errInjected
+	}
+	if f.syncFailure > 0 && f.random.Float64() < f.syncFailure {
+		f.crashed = true
+		return errInjected
+	}
+	return nil
+}
+
+// ** bytes a Read hands back out of the size asked for
+func (f *faultFS) readLength(size int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.shortReads || size <= 1 {
+		return size
+	}
+	return 1 + f.random.Intn(size)
+}
+
+type faultFile struct {
+	storageFile
+	fs *faultFS
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	allowed, fault := f.fs.allowWrite(len(p))
+	n, err := f.storageFile.Write(p[:allowed])
+	if err == nil {
+		err = fault
+	}
+	return n, err
+}
+
+func (f *faultFile) WriteAt(p []byte, offset int64) (int, error) {
+	allowed, fault := f.fs.allowWrite(len(p))
+	n, err := f.storageFile.WriteAt(p[:allowed], offset)
+	if err == nil {
+		err = fault
+	}
+	return n, err
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if f.fs.isCrashed() {
+		return 0, errInjected
+	}
+	return f.storageFile.Read(p[:f.fs.readLength(len(p))])
+}
+
+func (f *faultFile) ReadAt(p []byte, offset int64) (int, error) {
+	if f.fs.isCrashed() {
+		return 0, errInjected
+	}
+	return f.storageFile.ReadAt(p, offset)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.allowSync(); err != nil {
+		return err
+	}
+	return f.storageFile.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if f.fs.isCrashed() {
+		return errInjected
+	}
+	return f.storageFile.Truncate(size)
+}
+
+// ** the descriptor is released even after a crash, a dead process would
+// ** not keep it either
+func (f *faultFile) Close() error {
+	err := f.storageFile.Close()
+	if f.fs.isCrashed() {
+		return errInjected
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// ** the storage a wal keeps its files in
+// ** osFS is the real disk, memFS keeps everything in memory and faultFS
+// ** wraps another one to inject failures
+// ** errors for missing files satisfy os.IsNotExist like the os package's
+type fileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (storageFile, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	MkdirAll(path string, perm os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	// ** make renames and removals in a directory durable
+	SyncDir(path string) error
+	// ** take the exclusive lock on a wal directory, ErrLocked if another
+	// ** holder has it, released by closing
+	Lock(directory string) (io.Closer, error)
+}
+
+// ** an open file of a fileSystem, *os.File is one
+type storageFile interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Sync() error
+	Truncate(size int64) error
+	Stat() (os.FileInfo, error)
+	Name() string
+}
+
+func openFile(fs fileSystem, name string) (storageFile, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func createFile(fs fileSystem, name string) (storageFile, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func readFile(fs fileSystem, name string) ([]byte, error) {
+	file, err := openFile(fs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func writeFile(fs fileSystem, name string, data []byte, perm os.FileMode) error {
+	file, err := fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (storageFile, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		// ** a nil *os.File in the interface would not compare equal to nil
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+func (osFS) Rename(oldpath, newpath string) error         { return renameFile(oldpath, newpath) }
+func (osFS) Stat(name string) (os.FileInfo, error)        { return os.Stat(name) }
+func (osFS) ReadDir(name string) ([]os.DirEntry, error)   { return os.ReadDir(name) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (osFS) SyncDir(path string) error {
+	return syncDir(path)
+}
+
+func (osFS) Lock(directory string) (io.Closer, error) {
+	file, err := lockDirectory(directory)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,25 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ** best effort, not every platform lets a directory be synced
+func syncDir(dir string) error {
+	handle, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer handle.Close()
+	if err := handle.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+func renameFile(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ** renameFile must replace an existing file, the manifest and meta files
+// ** rely on it
+func TestRenameFileReplacesTarget(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.WriteFile(target, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(target+".tmp", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameFile(target+".tmp", target); err != nil {
+		t.Fatal(err)
+	}
+	if err := syncDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Fatalf("target holds %q after the rename, want %q", data, "new")
+	}
+	if _, err := os.Stat(target + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("source still there after the rename: %v", err)
+	}
+}
+
+// ** every reopen rewrites the manifest and meta files through renameFile
+// ** and syncDir, the log has to come back whole each time
+func TestReopenKeepsEntries(t *testing.T) {
+	dir := t.TempDir()
+	var want int
+	for round := 0; round < 3; round++ {
+		wal, err := newWriteAheadLOG(Options{Directory: dir})
+		if err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		entries, err := wal.ReadFrom(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != want {
+			t.Fatalf("round %d: got %d entries after reopen, want %d", round, len(entries), want)
+		}
+		for i := 0; i < 10; i++ {
+			offset, err := wal.WriteLog("t", i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want++
+			if offset != int64(want) {
+				t.Fatalf("round %d: write got offset %d, want %d", round, offset, want)
+			}
+		}
+		if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ** make the new directory entries themselves durable, without this a
+// ** created, renamed or removed file can come back the way it was after
+// ** a power loss even though its contents were synced
+func syncDir(dir string) error {
+	handle, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer handle.Close()
+	if err := handle.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// ** rename is atomic here, syncing the directory afterwards makes it durable
+func renameFile(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
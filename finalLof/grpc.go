@@ -0,0 +1,325 @@
+//go:build grpc
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ** the gRPC API is JSON over gRPC, there is no .proto and protobuf wire
+// ** clients cannot call it
+// ** service gowal.WAL has the unary methods Append, AppendBatch and Read and
+// ** the server stream Tail, which replays from an offset and then follows
+// ** new entries until cancelled
+// ** clients call with the "json" content-subtype, in Go
+// ** grpc.CallContentSubtype("json") with a codec like jsonCodec, and send
+// ** and receive the messages below as JSON with their field tags as names,
+// ** Tail streams LogEntry values
+type AppendRequest struct {
+	Topic   string      `json:"topic"`
+	Payload interface{} `json:"payload"`
+	// ** optional idempotency key, a repeated key is not written again
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+type AppendResponse struct {
+	Offset    int64 `json:"offset"`
+	Duplicate bool  `json:"duplicate,omitempty"`
+}
+
+type AppendBatchRequest struct {
+	Entries []AppendRequest `json:"entries"`
+}
+
+type AppendBatchResponse struct {
+	Count int `json:"count"`
+}
+
+type ReadRequest struct {
+	Offset int64    `json:"offset"`
+	Topics []string `json:"topics"`
+}
+
+type ReadResponse struct {
+	Entries []LogEntry `json:"entries"`
+}
+
+type TailRequest struct {
+	Offset int64  `json:"offset"`
+	Topic  string `json:"topic"`
+}
+
+// ** encodes the messages of the hand written service below, selected by the
+// ** "json" content-subtype
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+	startGRPC = serveGRPC
+}
+
+type walService interface {
+	Append(context.Context, *AppendRequest) (*AppendResponse, error)
+	AppendBatch(context.Context, *AppendBatchRequest) (*AppendBatchResponse, error)
+	Read(context.Context, *ReadRequest) (*ReadResponse, error)
+	Tail(*TailRequest, grpc.ServerStream) error
+}
+
+// ** gRPC front end sharing the same *WAL as the HTTP handlers
+type walGRPCServer struct {
+	wal *WAL
+	// ** closed on shutdown so tails end and GracefulStop does not hang on them
+	done chan struct{}
+}
+
+func grpcError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	if errors.Is(err, context.Canceled) {
+		return status.Error(codes.Canceled, err.Error())
+	}
+	if errors.Is(err, ErrClosed) {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if errors.Is(err, ErrWALFull) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if errors.Is(err, ErrEntryTooLarge) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if errors.Is(err, ErrCorrupt) {
+		return status.Error(codes.DataLoss, err.Error())
+	}
+	if errors.Is(err, ErrFollower) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *walGRPCServer) Append(ctx context.Context, request *AppendRequest) (*AppendResponse, error) {
+	if s.wal.following() {
+		return nil, grpcError(ErrFollower)
+	}
+	if request.Topic == "" {
+		request.Topic = "default"
+	}
+	var offset int64
+	var duplicate bool
+	var err error
+	if ctxErr := waitContext(ctx, func() {
+		offset, duplicate, err = s.wal.writeLogIdempotent(ctx, request.IdempotencyKey, request.Topic, request.Payload)
+	}); ctxErr != nil {
+		return nil, grpcError(ctxErr)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &AppendResponse{Offset: offset, Duplicate: duplicate}, nil
+}
+
+func (s *walGRPCServer) AppendBatch(ctx context.Context, request *AppendBatchRequest) (*AppendBatchResponse, error) {
+	if s.wal.following() {
+		return nil, grpcError(ErrFollower)
+	}
+	entries := make([]LogEntry, len(request.Entries))
+	for i, entry := range request.Entries {
+		if entry.Topic == "" {
+			entry.Topic = "default"
+		}
+		entries[i] = LogEntry{Topic: entry.Topic, Payload: entry.Payload}
+	}
+	if err := s.wal.WriteBatchContext(ctx, entries); err != nil {
+		return nil, grpcError(err)
+	}
+	return &AppendBatchResponse{Count: len(entries)}, nil
+}
+
+func (s *walGRPCServer) Read(ctx context.Context, request *ReadRequest) (*ReadResponse, error) {
+	entries, err := s.wal.ReadFromContext(ctx, request.Offset, request.Topics...)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &ReadResponse{Entries: entries}, nil
+}
+
+func (s *walGRPCServer) Tail(request *TailRequest, stream grpc.ServerStream) error {
+	entries := s.wal.WatchContext(stream.Context(), request.Offset)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-s.done:
+			return status.Error(codes.Unavailable, "server shutting down")
+		case entry, ok := <-entries:
+			if !ok {
+				return nil
+			}
+			if request.Topic != "" && entry.Topic != request.Topic {
+				continue
+			}
+			if err := stream.SendMsg(&entry); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func unaryHandler[Req any, Resp any](method string, call func(walService, context.Context, *Req) (*Resp, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			request := new(Req)
+			if err := dec(request); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(walService), ctx, request)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/gowal.WAL/" + method}
+			return interceptor(ctx, request, info, func(ctx context.Context, request interface{}) (interface{}, error) {
+				return call(srv.(walService), ctx, request.(*Req))
+			})
+		},
+	}
+}
+
+var walServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gowal.WAL",
+	HandlerType: (*walService)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryHandler("Append", walService.Append),
+		unaryHandler("AppendBatch", walService.AppendBatch),
+		unaryHandler("Read", walService.Read),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Tail",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				request := new(TailRequest)
+				if err := stream.RecvMsg(request); err != nil {
+					return err
+				}
+				return srv.(walService).Tail(request, stream)
+			},
+		},
+	},
+	Metadata: "grpc.go",
+}
+
+// ** reject calls without an accepted token in the "authorization" metadata,
+// ** as "Bearer <token>", or in "x-api-key"
+func (s ServerSecurity) checkGRPC(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	if values := md.Get("authorization"); len(values) > 0 {
+		if strings.HasPrefix(values[0], "Bearer ") {
+			token = strings.TrimSpace(strings.TrimPrefix(values[0], "Bearer "))
+		}
+	} else if values := md.Get("x-api-key"); len(values) > 0 {
+		token = values[0]
+	}
+	if !s.allows(token) {
+		return status.Error(codes.Unauthenticated, "missing or invalid token")
+	}
+	return nil
+}
+
+func (s ServerSecurity) grpcOptions() []grpc.ServerOption {
+	var options []grpc.ServerOption
+	if s.TLS != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(s.TLS)))
+	}
+	if len(s.Tokens) > 0 {
+		options = append(options,
+			grpc.UnaryInterceptor(func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				if err := s.checkGRPC(ctx); err != nil {
+					return nil, err
+				}
+				return handler(ctx, request)
+			}),
+			grpc.StreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := s.checkGRPC(stream.Context()); err != nil {
+					return err
+				}
+				return handler(srv, stream)
+			}),
+		)
+	}
+	return options
+}
+
+// ** a span around every call, joined to the caller's trace if its metadata
+// ** carries a W3C traceparent
+func grpcTraceOptions(tracer Tracer) []grpc.ServerOption {
+	if tracer == nil {
+		return nil
+	}
+	start := func(ctx context.Context, method string) (context.Context, Span) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		ctx = tracer.Extract(ctx, func(key string) string {
+			if values := md.Get(key); len(values) > 0 {
+				return values[0]
+			}
+			return ""
+		})
+		ctx, span := tracer.Start(ctx, method)
+		span.SetAttribute("rpc.method", method)
+		return ctx, span
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (response interface{}, err error) {
+			ctx, span := start(ctx, info.FullMethod)
+			defer func() { span.End(err) }()
+			return handler(ctx, request)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+			ctx, span := start(stream.Context(), info.FullMethod)
+			defer func() { span.End(err) }()
+			return handler(srv, &tracedStream{ServerStream: stream, ctx: ctx})
+		}),
+	}
+}
+
+// ** a stream whose Context carries the span of the call
+type tracedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedStream) Context() context.Context {
+	return s.ctx
+}
+
+// ** listen on addr and serve the wal over gRPC in the background
+// ** the returned func stops the server, letting running calls finish
+func serveGRPC(addr string, wal *WAL, security ServerSecurity) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	service := &walGRPCServer{wal: wal, done: make(chan struct{})}
+	server := grpc.NewServer(append(security.grpcOptions(), grpcTraceOptions(wal.tracer)...)...)
+	server.RegisterService(&walServiceDesc, service)
+	go server.Serve(listener)
+	return func() {
+		close(service.done)
+		server.GracefulStop()
+	}, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	segmentMagic      = "GOWALSEG"
+	segmentHeaderSize = 32
+	// ** segments written before there were headers start right with a record
+	segmentVersionLegacy uint16 = 0
+	// ** the version new segments are written with
+	segmentVersion uint16 = 1
+)
+
+// ** the segment ends inside its header, it was created but never written
+var errTornHeader = errors.New("torn segment header")
+
+// ** how the records of each segment format version are decoded
+// ** a version missing here is refused when the segment is read
+var segmentDecoders = map[uint16]func(*recordEncryption, []byte) (logRecord, error){
+	segmentVersionLegacy: (*recordEncryption).decodeRecord,
+	segmentVersion:       (*recordEncryption).decodeRecord,
+}
+
+// ** fixed header at the start of every segment
+type segmentHeader struct {
+	Version uint16
+	Created time.Time
+	// ** offset the first record of the segment was going to get
+	BaseOffset int64
+}
+
+// ** magic, version, creation time in unix nanoseconds and base offset, padded
+// ** and ended with a newline so the first record is still on a line of its own
+func (h segmentHeader) encode() []byte {
+	buf := make([]byte, segmentHeaderSize)
+	copy(buf, segmentMagic)
+	binary.BigEndian.PutUint16(buf[8:10], h.Version)
+	binary.BigEndian.PutUint64(buf[10:18], uint64(h.Created.UnixNano()))
+	binary.BigEndian.PutUint64(buf[18:26], uint64(h.BaseOffset))
+	buf[segmentHeaderSize-1] = '\n'
+	return buf
+}
+
+// ** read and check the header at the start of a segment, returning its size
+// ** a segment without one reads as segmentVersionLegacy with a size of 0
+func readSegmentHeader(reader *bufio.Reader) (segmentHeader, int64, error) {
+	data, err := reader.Peek(segmentHeaderSize)
+	if err != nil && err != io.EOF {
+		return segmentHeader{}, 0, fmt.Errorf("failed to read segment header: %w", err)
+	}
+	if len(data) < len(segmentMagic) {
+		if len(data) > 0 && bytes.HasPrefix([]byte(segmentMagic), data) {
+			return segmentHeader{}, 0, errTornHeader
+		}
+		return segmentHeader{Version: segmentVersionLegacy}, 0, nil
+	}
+	if !bytes.HasPrefix(data, []byte(segmentMagic)) {
+		return segmentHeader{Version: segmentVersionLegacy}, 0, nil
+	}
+	if len(data) < segmentHeaderSize {
+		return segmentHeader{}, 0, errTornHeader
+	}
+	if data[segmentHeaderSize-1] != '\n' {
+		return segmentHeader{}, 0, &CorruptError{Reason: "damaged segment header"}
+	}
+	header := segmentHeader{
+		Version:    binary.BigEndian.Uint16(data[8:10]),
+		Created:    time.Unix(0, int64(binary.BigEndian.Uint64(data[10:18]))).UTC(),
+		BaseOffset: int64(binary.BigEndian.Uint64(data[18:26])),
+	}
+	if _, ok := segmentDecoders[header.Version]; !ok {
+		return segmentHeader{}, 0, fmt.Errorf("unsupported segment format version %d", header.Version)
+	}
+	if _, err := reader.Discard(segmentHeaderSize); err != nil {
+		return segmentHeader{}, 0, fmt.Errorf("failed to read segment header: %w", err)
+	}
+	return header, segmentHeaderSize, nil
+}
+
+// ** start the empty active segment with a header, offsets continue at w.offset
+// ** flushed right away so readers never see a segment without its header
+// ** must be called with the mutex held
+func (w *WAL) writeSegmentHeader() error {
+	header := segmentHeader{Version: segmentVersion, Created: time.Now().UTC(), BaseOffset: w.offset}
+	n, err := w.writer.Write(header.encode())
+	if err != nil {
+		return fmt.Errorf("failed to write segment header: %w", err)
+	}
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write segment header: %w", err)
+	}
+	w.segmentSize += int64(n)
+	w.usage += int64(n)
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// ** how a commit hook is called
+type HookMode int
+
+const (
+	// ** in the goroutine that made the entries durable, before the write
+	// ** returns and with the wal mutex held, so the hook must be quick and
+	// ** must not call back into the wal
+	HookSync HookMode = iota
+	// ** on a goroutine of its own, in commit order, the hook may use the wal
+	// ** entries it has not got to yet are queued without a limit, writes
+	// ** never wait for it
+	HookAsync
+)
+
+type commitHook struct {
+	fn    func(LogEntry)
+	async bool
+
+	mu      sync.Mutex
+	pending []LogEntry
+	stopped bool
+	notify  chan struct{}
+	done    chan struct{}
+}
+
+// ** call fn with every entry once it is durable, that is once the fsync
+// ** covering it succeeded, so with SyncEvery or SyncNever entries arrive
+// ** when the background sync, Sync or rotation gets to them
+// ** entries are delivered in offset order, a panic in fn is recovered and
+// ** counted in Stats.HookPanics instead of taking the writer down
+// ** the returned func removes the hook, for an async one it returns once
+// ** the entries already queued were delivered
+func (w *WAL) OnCommit(fn func(LogEntry), mode HookMode) (remove func()) {
+	hook := &commitHook{fn: fn, async: mode == HookAsync}
+	if hook.async {
+		hook.notify = make(chan struct{}, 1)
+		hook.done = make(chan struct{})
+		go hook.run(w.metrics)
+	}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		hook.stop()
+		return func() {}
+	}
+	w.hooks = append(w.hooks, hook)
+	w.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			w.mu.Lock()
+			found := false
+			for i, registered := range w.hooks {
+				if registered == hook {
+					w.hooks = append(w.hooks[:i:i], w.hooks[i+1:]...)
+					found = true
+					break
+				}
+			}
+			w.mu.Unlock()
+			// ** otherwise Close has stopped it already
+			if found {
+				hook.stop()
+			}
+		})
+	}
+}
+
+// ** remember a written entry until the fsync covering it
+// ** must be called with the mutex held
+func (w *WAL) holdForHooks(entry LogEntry) {
+	if len(w.hooks) == 0 {
+		return
+	}
+	if payload, ok := entry.Payload.(rawPayload); ok {
+		// ** hooks see raw writes the way ReadFrom returns them
+		if json.Valid(payload) {
+			entry.Payload = json.RawMessage(payload)
+		} else {
+			entry.Payload = []byte(payload)
+		}
+	}
+	w.uncommitted = append(w.uncommitted, entry)
+}
+
+// ** forget entries held since mark, their write failed
+// ** must be called with the mutex held
+func (w *WAL) releaseHeld(mark int) {
+	if mark < len(w.uncommitted) {
+		w.uncommitted = w.uncommitted[:mark]
+	}
+}
+
+// ** hand everything written so far to the hooks, called once it is durable
+// ** must be called with the mutex held
+func (w *WAL) runHooks() {
+	if len(w.uncommitted) == 0 {
+		return
+	}
+	entries := w.uncommitted
+	w.uncommitted = nil
+	for _, hook := range w.hooks {
+		if hook.async {
+			hook.enqueue(entries)
+			continue
+		}
+		for _, entry := range entries {
+			callHook(hook.fn, entry, w.metrics)
+		}
+	}
+}
+
+func (h *commitHook) enqueue(entries []LogEntry) {
+	h.mu.Lock()
+	h.pending = append(h.pending, entries...)
+	h.mu.Unlock()
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (h *commitHook) run(metrics *walMetrics) {
+	defer close(h.done)
+	for {
+		h.mu.Lock()
+		entries, stopped := h.pending, h.stopped
+		h.pending = nil
+		h.mu.Unlock()
+		for _, entry := range entries {
+			callHook(h.fn, entry, metrics)
+		}
+		if len(entries) == 0 {
+			if stopped {
+				return
+			}
+			<-h.notify
+		}
+	}
+}
+
+// ** an async hook delivers what is queued before it stops
+func (h *commitHook) stop() {
+	if !h.async {
+		return
+	}
+	h.mu.Lock()
+	h.stopped = true
+	h.mu.Unlock()
+	select {
+	case h.notify <- struct{}{}:
+	default:
+	}
+	<-h.done
+}
+
+func callHook(fn func(LogEntry), entry LogEntry, metrics *walMetrics) {
+	defer func() {
+		if recover() != nil {
+			metrics.hookPanics.Add(1)
+		}
+	}()
+	fn(entry)
+}
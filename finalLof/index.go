@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	indexSuffix    = ".idx"
+	indexInterval  = 16 // ** one index entry every N records
+	indexEntrySize = 16
+)
+
+// ** maps a record offset to the byte position of that record in its segment
+type indexEntry struct {
+	offset   int64
+	position int64
+}
+
+func indexFileName(directory string, index int) string {
+	return strings.TrimSuffix(segmentFileName(directory, index), ".log") + indexSuffix
+}
+
+func openIndexFile(fs fileSystem, directory string, index int) (storageFile, error) {
+	file, err := fs.OpenFile(indexFileName(directory, index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index file: %w", err)
+	}
+	return file, nil
+}
+
+// ** remember where a record landed, only every indexInterval-th record is kept
+// ** must be called with the mutex held
+func (w *WAL) indexRecord(offset, position int64) error {
+	defer func() { w.sinceIndexed = (w.sinceIndexed + 1) % indexInterval }()
+	if w.sinceIndexed != 0 {
+		return nil
+	}
+	var buf [indexEntrySize]byte
+	binary.BigEndian.PutUint64(buf[0:8], uint64(offset))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(position))
+	if _, err := w.indexFile.Write(buf[:]); err != nil {
+		return fmt.Errorf("failed to write index entry: %w", err)
+	}
+	return nil
+}
+
+// ** call fn for every complete record in the segment starting at byte position
+// ** stops quietly at a torn or unreadable tail, recovery deals with those
+func scanSegment(fs fileSystem, path string, position int64, encryption *recordEncryption, fn func(record logRecord, position int64) error) error {
+	file, err := openSegment(fs, path, position)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return scanRecords(file, position, encryption, fn)
+}
+
+// ** scanSegment over an already opened segment whose contents start at position
+// ** starting at 0 the segment header is checked and picks the decoder, reads
+// ** from further in come from the index and use the current format
+func scanRecords(source io.Reader, position int64, encryption *recordEncryption, fn func(record logRecord, position int64) error) error {
+	_, err := scanRecordsTail(source, position, encryption, fn)
+	return err
+}
+
+// ** scanRecords over a closed segment, which is complete, so a record that
+// ** cannot be read is a CorruptError instead of a torn tail
+func scanClosedRecords(source io.Reader, index int, position int64, encryption *recordEncryption, fn func(record logRecord, position int64) error) error {
+	tail, err := scanRecordsTail(source, position, encryption, fn)
+	if err != nil {
+		return err
+	}
+	if tail >= 0 {
+		return &CorruptError{Segment: index, Position: tail, Reason: "unreadable record"}
+	}
+	return nil
+}
+
+// ** scanRecords that also returns where it stopped short of the end, at a
+// ** line that is cut off or does not decode, -1 if it read everything
+func scanRecordsTail(source io.Reader, position int64, encryption *recordEncryption, fn func(record logRecord, position int64) error) (int64, error) {
+	reader := bufio.NewReader(source)
+	decode := segmentDecoders[segmentVersion]
+	if position == 0 {
+		header, size, err := readSegmentHeader(reader)
+		if err == errTornHeader {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		decode = segmentDecoders[header.Version]
+		position = size
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return position, nil
+			}
+			return -1, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read segment: %w", err)
+		}
+		record, err := decode(encryption, line)
+		if err != nil {
+			return position, nil
+		}
+		if err := fn(record, position); err != nil {
+			return 0, err
+		}
+		position += int64(len(line))
+	}
+}
+
+// ** rewrite the index of a segment from its contents
+// ** returns the entries and the number of records in the segment
+func buildIndex(fs fileSystem, directory string, index int, encryption *recordEncryption) ([]indexEntry, int, error) {
+	var entries []indexEntry
+	count := 0
+	err := scanSegment(fs, segmentPath(fs, directory, index), 0, encryption, func(record logRecord, position int64) error {
+		if count%indexInterval == 0 {
+			entries = append(entries, indexEntry{offset: record.Offset, position: position})
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 0, len(entries)*indexEntrySize)
+	for _, entry := range entries {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(entry.offset))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(entry.position))
+	}
+	path := indexFileName(directory, index)
+	if err := writeFile(fs, path+".tmp", buf, 0666); err != nil {
+		return nil, 0, fmt.Errorf("failed to write index file: %w", err)
+	}
+	if err := fs.Rename(path+".tmp", path); err != nil {
+		return nil, 0, fmt.Errorf("failed to replace index file: %w", err)
+	}
+	return entries, count, nil
+}
+
+// ** read the index of a segment, rebuilding it when missing or damaged
+func loadIndex(fs fileSystem, directory string, index int, encryption *recordEncryption) ([]indexEntry, error) {
+	entries, ok, err := readIndex(fs, directory, index)
+	if err != nil || ok {
+		return entries, err
+	}
+	entries, _, err = buildIndex(fs, directory, index, encryption)
+	return entries, err
+}
+
+// ** the sidecar index of a segment as it is on disk, ok is false if it is
+// ** missing or cut short and needs a rebuild
+func readIndex(fs fileSystem, directory string, index int) (_ []indexEntry, ok bool, err error) {
+	data, err := readFile(fs, indexFileName(directory, index))
+	if os.IsNotExist(err) || (err == nil && len(data)%indexEntrySize != 0) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read index file: %w", err)
+	}
+
+	entries := make([]indexEntry, 0, len(data)/indexEntrySize)
+	for i := 0; i < len(data); i += indexEntrySize {
+		entries = append(entries, indexEntry{
+			offset:   int64(binary.BigEndian.Uint64(data[i : i+8])),
+			position: int64(binary.BigEndian.Uint64(data[i+8 : i+16])),
+		})
+	}
+	return entries, true, nil
+}
+
+type indexEntryList []indexEntry
+
+// ** an empty filter matches every topic
+func matchesTopic(topic string, topics []string) bool {
+	if len(topics) == 0 {
+		return true
+	}
+	for _, wanted := range topics {
+		if topic == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// ** byte position to start scanning from to find offset in a segment
+func (entries indexEntryList) seek(offset int64) int64 {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].offset > offset })
+	if i == 0 {
+		return 0
+	}
+	return entries[i-1].position
+}
+
+// ** errStopScan ends a scan early without it being reported as a failure
+var errStopScan = errors.New("stop scan")
+
+// ** find the segment holding offset, as a position in indexes, and the byte
+// ** position in it to start scanning from
+// ** uses only the sidecar indexes, a missing one is rebuilt
+func locateOffset(fs fileSystem, directory string, indexes []int, offset int64, encryption *recordEncryption) (int, int64, error) {
+	loaded := make(map[int]indexEntryList)
+	var loadErr error
+	load := func(i int) indexEntryList {
+		if entries, ok := loaded[i]; ok {
+			return entries
+		}
+		entries, err := loadIndex(fs, directory, indexes[i], encryption)
+		if err != nil && loadErr == nil {
+			loadErr = err
+		}
+		loaded[i] = entries
+		return entries
+	}
+	// ** first segment that starts after offset, the one before it holds offset
+	start := sort.Search(len(indexes), func(i int) bool {
+		entries := load(i)
+		return len(entries) == 0 || entries[0].offset > offset
+	}) - 1
+	if start < 0 {
+		return 0, 0, loadErr
+	}
+	position := load(start).seek(offset)
+	return start, position, loadErr
+}
+
+// ** call fn for every entry from offset onwards, optionally limited to topics
+// ** fn can return errStopScan to end the scan early
+// ** must be called with the mutex held
+func (w *WAL) scanFrom(offset int64, topics []string, fn func(LogEntry) error) error {
+	return w.scanRecordsFrom(offset, topics, func(record logRecord) error {
+		return fn(record.entry())
+	})
+}
+
+// ** scanFrom for callers that need the whole record
+// ** entries older than the oldest local segment are read back from the archive
+func (w *WAL) scanRecordsFrom(offset int64, topics []string, fn func(logRecord) error) error {
+	snap, err := w.snapshotFrom(offset, topics)
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+	return snap.scan(context.Background(), offset, topics, fn)
+}
+
+// ** all entries with an offset of at least offset, in write order
+// ** the segment holding offset is located through the sidecar indexes
+// ** so only the tail of the log is actually scanned
+// ** if topics are given only entries of those topics are returned and
+// ** closed segments whose topic filter rules them all out are skipped
+// ** the mutex is only held to pick the segments, so reads run alongside
+// ** writes and each other
+func (w *WAL) ReadFrom(offset int64, topics ...string) ([]LogEntry, error) {
+	return w.ReadFromContext(context.Background(), offset, topics...)
+}
+
+// ** ReadFrom that stops with ctx.Err() once ctx is done
+func (w *WAL) ReadFromContext(ctx context.Context, offset int64, topics ...string) ([]LogEntry, error) {
+	w.mu.Lock()
+	snap, err := w.snapshotFrom(offset, topics)
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+
+	var result []LogEntry
+	err = snap.scan(ctx, offset, topics, func(record logRecord) error {
+		result = append(result, record.entry())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ** the records from offset onwards, with the idempotency key and binary
+// ** flag a LogEntry leaves out
+func (w *WAL) readRecordsFrom(ctx context.Context, offset int64) ([]logRecord, error) {
+	w.mu.Lock()
+	snap, err := w.snapshotFrom(offset, nil)
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+
+	var result []logRecord
+	err = snap.scan(ctx, offset, nil, func(record logRecord) error {
+		result = append(result, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ** the entry at exactly offset, ok is false if there is none
+func (w *WAL) readAt(offset int64) (entry LogEntry, ok bool, err error) {
+	w.mu.Lock()
+	snap, err := w.snapshotFrom(offset, nil)
+	w.mu.Unlock()
+	if err != nil {
+		return LogEntry{}, false, err
+	}
+	defer snap.Close()
+
+	err = snap.scan(context.Background(), offset, nil, func(found logRecord) error {
+		if found.Offset == offset {
+			entry, ok = found.LogEntry, true
+		}
+		return errStopScan
+	})
+	return entry, ok, err
+}
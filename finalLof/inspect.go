@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ** where and why a segment stops being readable
+type corruption struct {
+	Position int64  `json:"position"`
+	Reason   string `json:"reason"`
+}
+
+// ** summary of one segment produced by walking every record in it
+type segmentReport struct {
+	Index       int         `json:"index"`
+	Path        string      `json:"path"`
+	Size        int64       `json:"size"`
+	Version     uint16      `json:"version"`
+	Entries     int         `json:"entries"`
+	FirstOffset int64       `json:"first_offset"`
+	LastOffset  int64       `json:"last_offset"`
+	Corruption  *corruption `json:"corruption,omitempty"`
+}
+
+// ** walk a segment checking framing, checksums and offset order
+// ** unlike scanSegment it does not stop quietly but reports the first
+// ** problem it finds, records after that point are not looked at
+func inspectSegment(fs fileSystem, directory string, index int, encryption *recordEncryption) (segmentReport, error) {
+	path := segmentPath(fs, directory, index)
+	report := segmentReport{Index: index, Path: path}
+	info, err := fs.Stat(path)
+	if err != nil {
+		return report, fmt.Errorf("failed to get file info: %w", err)
+	}
+	report.Size = info.Size()
+
+	file, err := openSegment(fs, path, 0)
+	if err != nil {
+		return report, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, position, err := readSegmentHeader(reader)
+	if err == errTornHeader {
+		report.Corruption = &corruption{0, "torn segment header"}
+		return report, nil
+	}
+	if err != nil {
+		report.Corruption = &corruption{0, err.Error()}
+		return report, nil
+	}
+	report.Version = header.Version
+	decode := segmentDecoders[header.Version]
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// ** zeros are the unused preallocated space of the active segment
+			if len(bytes.Trim(line, "\x00")) > 0 {
+				report.Corruption = &corruption{position, "torn record at end of segment"}
+			}
+			return report, nil
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to read segment: %w", err)
+		}
+		record, err := decode(encryption, line)
+		switch {
+		case errors.Is(err, errChecksumMismatch):
+			report.Corruption = &corruption{position, "checksum mismatch"}
+			return report, nil
+		case err != nil && len(bytes.TrimSpace(line)) == 0:
+			report.Corruption = &corruption{position, "empty record"}
+			return report, nil
+		case err != nil:
+			report.Corruption = &corruption{position, fmt.Sprintf("undecodable record: %v", err)}
+			return report, nil
+		case report.Entries > 0 && record.Offset <= report.LastOffset:
+			report.Corruption = &corruption{position, fmt.Sprintf("offset %d does not follow %d", record.Offset, report.LastOffset)}
+			return report, nil
+		}
+		if report.Entries == 0 {
+			report.FirstOffset = record.Offset
+		}
+		report.LastOffset = record.Offset
+		report.Entries++
+		position += int64(len(line))
+	}
+}
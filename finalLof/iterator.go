@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+)
+
+// ** where an Iterator starts, which entries it yields and in which order
+type IterOptions struct {
+	// ** first offset to yield, forwards the entries from here on and in
+	// ** reverse the entries up to and including it, 0 is the start of the
+	// ** log forwards and its tail in reverse
+	From int64
+	// ** only entries of these topics, every topic if empty
+	Topics []string
+	// ** walk from newer to older entries, starting at the tail unless From
+	// ** is set, so only the last segments are read to get the newest entries
+	Reverse bool
+}
+
+// ** cursor over the local segments, reading one segment at a time instead
+// ** of loading the log into memory
+// ** segments are opened as the iterator gets to them, so entries removed by
+// ** retention before that are skipped and entries written to the active
+// ** segment after it was opened are not seen, archived segments are not read
+// ** call Next until it returns false, then check Err
+type Iterator struct {
+	wal  *WAL
+	opts IterOptions
+	// ** segments still to open, in the order they are read
+	indexes []int
+	// ** byte position to start the first segment at, forwards only
+	position int64
+
+	snap    *logSnapshot
+	reader  io.ReadCloser
+	lines   *bufio.Reader
+	read    int64 // ** byte position of the next line in the current segment
+	decode  func(*recordEncryption, []byte) (logRecord, error)
+	pending []logRecord // ** records of the current segment still to yield, in reverse
+
+	entry LogEntry
+	err   error
+	done  bool
+}
+
+// ** an iterator over the log as opts describe, nothing is read before Next
+// ** the iterator must be closed unless Next returned false
+func (w *WAL) NewIterator(opts IterOptions) *Iterator {
+	it := &Iterator{wal: w, opts: opts}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		it.finish(ErrClosed)
+		return it
+	}
+	indexes := w.segments.indexes()
+	var err error
+	if opts.From > 0 {
+		start, position, err := locateOffset(w.fs, w.directory, indexes, opts.From, w.encryption)
+		if err != nil {
+			it.finish(err)
+			return it
+		}
+		if opts.Reverse {
+			if len(indexes) > 0 {
+				indexes = indexes[:start+1]
+			}
+		} else {
+			indexes = indexes[start:]
+			it.position = position
+		}
+	}
+	if opts.Reverse {
+		for i, j := 0, len(indexes)-1; i < j; i, j = i+1, j-1 {
+			indexes[i], indexes[j] = indexes[j], indexes[i]
+		}
+	}
+	if len(opts.Topics) > 0 {
+		indexes, err = w.mayHoldTopics(indexes, opts.Topics)
+		if err != nil {
+			it.finish(err)
+			return it
+		}
+	}
+	it.indexes = indexes
+	return it
+}
+
+// ** the segments of indexes whose topic filter allows one of topics,
+// ** the active segment is always kept, must be called with the mutex held
+func (w *WAL) mayHoldTopics(indexes []int, topics []string) ([]int, error) {
+	kept := indexes[:0]
+	for _, index := range indexes {
+		if index < w.currentSegmentIndex {
+			filter, err := loadTopicFilter(w.fs, w.directory, index, w.encryption)
+			if err != nil {
+				return nil, err
+			}
+			if !filter.mayContainAny(topics) {
+				continue
+			}
+		}
+		kept = append(kept, index)
+	}
+	return kept, nil
+}
+
+// ** move to the next entry, false once there are no more or reading failed
+func (it *Iterator) Next() bool {
+	for !it.done {
+		if it.opts.Reverse && len(it.pending) > 0 {
+			record := it.pending[len(it.pending)-1]
+			it.pending = it.pending[:len(it.pending)-1]
+			if it.yields(record) {
+				it.entry = record.entry()
+				return true
+			}
+			continue
+		}
+		if !it.opts.Reverse && it.lines != nil {
+			record, ok, err := it.readRecord()
+			if err != nil {
+				it.finish(err)
+				return false
+			}
+			if !ok {
+				it.closeSegment()
+				continue
+			}
+			if it.yields(record) {
+				it.entry = record.entry()
+				return true
+			}
+			continue
+		}
+		if len(it.indexes) == 0 {
+			it.finish(nil)
+			return false
+		}
+		if err := it.openSegment(); err != nil {
+			it.finish(err)
+			return false
+		}
+	}
+	return false
+}
+
+// ** the entry Next moved to
+func (it *Iterator) Entry() LogEntry {
+	return it.entry
+}
+
+// ** why the iteration ended early, nil when it simply ran out of entries
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// ** release the segment being read, Next returns false afterwards
+func (it *Iterator) Close() error {
+	it.finish(nil)
+	return nil
+}
+
+func (it *Iterator) yields(record logRecord) bool {
+	if it.opts.From > 0 {
+		if it.opts.Reverse && record.Offset > it.opts.From {
+			return false
+		}
+		if !it.opts.Reverse && record.Offset < it.opts.From {
+			return false
+		}
+	}
+	return record.readable(it.opts.Topics)
+}
+
+// ** open the next segment, in reverse its records are read in one go
+// ** a segment that is gone by now was removed by retention and is skipped
+func (it *Iterator) openSegment() error {
+	index := it.indexes[0]
+	it.indexes = it.indexes[1:]
+	position := int64(0)
+	if !it.opts.Reverse {
+		position, it.position = it.position, 0
+	}
+
+	w := it.wal
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	if _, err := w.fs.Stat(segmentPath(w.fs, w.directory, index)); os.IsNotExist(err) {
+		w.mu.Unlock()
+		return nil
+	}
+	snap, err := w.snapshot([]segmentRange{{index: index, position: position}})
+	w.mu.Unlock()
+	if errors.Is(err, ErrSegmentNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	reader, err := snap.open(snap.segments[0])
+	if err != nil {
+		snap.Close()
+		return err
+	}
+	it.snap, it.reader, it.lines = snap, reader, bufio.NewReader(reader)
+	it.decode = segmentDecoders[segmentVersion]
+	it.read = position
+	if position == 0 {
+		header, size, err := readSegmentHeader(it.lines)
+		if err == errTornHeader {
+			it.closeSegment()
+			return nil
+		}
+		if err != nil {
+			it.closeSegment()
+			return err
+		}
+		it.decode = segmentDecoders[header.Version]
+		it.read = size
+	}
+	if !it.opts.Reverse {
+		return nil
+	}
+
+	defer it.closeSegment()
+	for {
+		record, ok, err := it.readRecord()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		it.pending = append(it.pending, record)
+	}
+}
+
+// ** the next record of the current segment, ok is false at its end or at
+// ** a torn tail of the active segment, which recovery deals with
+// ** anything unreadable in a closed segment is a CorruptError
+func (it *Iterator) readRecord() (logRecord, bool, error) {
+	line, err := it.lines.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return logRecord{}, false, nil
+	}
+	if err != nil && err != io.EOF {
+		return logRecord{}, false, err
+	}
+	record, decodeErr := it.decode(it.snap.encryption, line)
+	if err == nil && decodeErr == nil {
+		it.read += int64(len(line))
+		return record, true, nil
+	}
+	if segment := it.snap.segments[0]; !segment.active {
+		return logRecord{}, false, &CorruptError{Segment: segment.index, Position: it.read, Reason: "unreadable record"}
+	}
+	return logRecord{}, false, nil
+}
+
+func (it *Iterator) closeSegment() {
+	if it.reader != nil {
+		it.reader.Close()
+		it.reader = nil
+	}
+	if it.snap != nil {
+		it.snap.Close()
+		it.snap = nil
+	}
+	it.lines = nil
+}
+
+// ** end the iteration, keeping the first error
+func (it *Iterator) finish(err error) {
+	if it.err == nil {
+		it.err = err
+	}
+	it.done = true
+	it.pending = nil
+	it.indexes = nil
+	it.closeSegment()
+}
+
+// ** the newest entry of topic, or of any topic if it is empty, ok is false
+// ** if there is none
+// ** segments are read backwards from the active one and the search stops at
+// ** the first match, closed segments the topic filter rules out are skipped
+func (w *WAL) LastEntry(topic string) (entry LogEntry, ok bool, err error) {
+	opts := IterOptions{Reverse: true}
+	if topic != "" {
+		opts.Topics = []string{topic}
+	}
+	it := w.NewIterator(opts)
+	defer it.Close()
+	if it.Next() {
+		return it.Entry(), true, nil
+	}
+	return LogEntry{}, false, it.Err()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// ** body limit of the server binary unless -max-body says otherwise
+	defaultMaxBody = 8 << 20
+	// ** clients tracked at most, idle ones are forgotten first and the least
+	// ** recently seen after them
+	maxRateClients = 10000
+)
+
+// ** how many write requests a client may make
+type RateLimit struct {
+	// ** requests per second, 0 turns the limit off
+	Rate float64
+	// ** requests allowed at once after a quiet spell, at least 1
+	Burst int
+	// ** share one budget between all clients instead of one each
+	Global bool
+}
+
+// ** token buckets refilled at limit.Rate, one per client key
+type rateLimiter struct {
+	limit   RateLimit
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// ** nil for a zero rate, which wrap takes as no limit
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = int(math.Ceil(limit.Rate))
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+	}
+	return &rateLimiter{limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+// ** take a token for key, or report how long until the next one is there
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateClients {
+			l.forgetIdle(now)
+		}
+		if len(l.buckets) >= maxRateClients {
+			l.forgetOldest()
+		}
+		bucket = &tokenBucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(l.limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*l.limit.Rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / l.limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+// ** drop buckets that are full again, a new bucket for them starts out the same
+// ** must be called with the mutex held
+func (l *rateLimiter) forgetIdle(now time.Time) {
+	full := time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// ** drop the bucket seen least recently, when every client is busy
+// ** its client starts over with a full bucket, which beats an unbounded map
+// ** must be called with the mutex held
+func (l *rateLimiter) forgetOldest() {
+	oldest, first := "", true
+	for key, bucket := range l.buckets {
+		if first || bucket.last.Before(l.buckets[oldest].last) {
+			oldest, first = key, false
+		}
+	}
+	delete(l.buckets, oldest)
+}
+
+// ** who a request is counted against, its token when requireAuth accepted
+// ** it so clients behind the same proxy are told apart, its address
+// ** otherwise, an unchecked token would let a client pick a fresh bucket
+// ** for every request
+func (l *rateLimiter) clientKey(request *http.Request) string {
+	if l.limit.Global {
+		return ""
+	}
+	if token := authenticatedToken(request); token != "" {
+		return "token:" + token
+	}
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// ** wrap next so requests over the limit get 429 with Retry-After
+// ** handlers wrapped by the same limiter share the clients' budgets
+func (l *rateLimiter) wrap(next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(writer http.ResponseWriter, request *http.Request) {
+		ok, wait := l.allow(l.clientKey(request), time.Now())
+		if !ok {
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(writer, "Rate limit exceeded, retry later", http.StatusTooManyRequests)
+			return
+		}
+		next(writer, request)
+	}
+}
+
+// ** wrap next so request bodies over max bytes fail to read
+// ** handlers answer that with 413 through writeDecodeError
+func limitBody(max int64, next http.Handler) http.Handler {
+	if max <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		request.Body = http.MaxBytesReader(writer, request.Body, max)
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// ** answer a body that could not be decoded, 413 if it was over the limit
+func writeDecodeError(writer http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(writer, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(writer, "Invalid payload", http.StatusBadRequest)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// ** a token nobody checked must not buy a client a bucket of its own
+func TestClientKeyUsesOnlyAcceptedTokens(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 1})
+	request := httptest.NewRequest(http.MethodPost, "/write", nil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("Authorization", "Bearer made-up")
+	if key := limiter.clientKey(request); key != "addr:10.0.0.1" {
+		t.Fatalf("unchecked token gave key %q", key)
+	}
+
+	var key string
+	security := ServerSecurity{Tokens: []string{"secret"}}
+	handler := security.requireAuth(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		key = limiter.clientKey(request)
+	}))
+	request.Header.Set("Authorization", "Bearer secret")
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	if key != "token:secret" {
+		t.Fatalf("accepted token gave key %q", key)
+	}
+}
+
+func TestRateLimiterBucketsAreBounded(t *testing.T) {
+	limiter := newRateLimiter(RateLimit{Rate: 0.001})
+	now := time.Now()
+	for i := 0; i < maxRateClients+100; i++ {
+		limiter.allow(fmt.Sprintf("addr:%d", i), now.Add(time.Duration(i)))
+	}
+	if len(limiter.buckets) > maxRateClients {
+		t.Fatalf("%d buckets tracked, want at most %d", len(limiter.buckets), maxRateClients)
+	}
+	if _, ok := limiter.buckets["addr:0"]; ok {
+		t.Fatal("least recently seen client was kept")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const lockFileName = "wal.lock"
+
+// ** returned when another process already has the wal directory open
+var ErrLocked = errors.New("wal directory is locked by another process")
+
+// ** take the exclusive lock on a wal directory, held until the file is closed
+// ** the lock is advisory and dies with the process, so a crash never leaves
+// ** a stale lock behind
+// ** this is the Lock of osFS, the only fileSystem with other processes to
+// ** keep out, so it goes to the disk directly
+func lockDirectory(directory string) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(directory, lockFileName), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if err == ErrLocked {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to lock wal directory: %w", err)
+	}
+	return file, nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package main
+
+import "os"
+
+// ** no flock here, the lock file is created but not locked
+func lockFile(file *os.File) error {
+	return nil
+}
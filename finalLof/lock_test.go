@@ -0,0 +1,35 @@
+//go:build unix || windows
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// ** a second process, or a second open in this one, must not get the directory
+func TestLockDirectoryIsExclusive(t *testing.T) {
+	dir := t.TempDir()
+	first, err := lockDirectory(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, err := lockDirectory(dir); !errors.Is(err, ErrLocked) {
+		if second != nil {
+			second.Close()
+		}
+		t.Fatalf("second lock returned %v, want ErrLocked", err)
+	}
+	if _, err := newWriteAheadLOG(Options{Directory: dir}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("opening a locked wal returned %v, want ErrLocked", err)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := lockDirectory(dir)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	again.Close()
+}
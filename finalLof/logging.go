@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// ** an fsync taking longer than this is logged as a warning, the disk is
+// ** likely overloaded or failing
+const slowFsyncThreshold = time.Second
+
+// ** the logger of a wal opened without Options.Logger, embedded users that
+// ** do not ask for logs get none
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// ** logger of opts, tagged with the directory so wals that share one, like
+// ** the shards and namespaces of a server, can be told apart
+func walLogger(opts Options, directory string) *slog.Logger {
+	if opts.Logger == nil {
+		return discardLogger
+	}
+	return opts.Logger.With("dir", directory)
+}
+
+// ** logger of the server binary, format is text or json and level one of
+// ** debug, info, warn or error
+func newServerLogger(format, level string) (*slog.Logger, error) {
+	var minimum slog.Level
+	if err := minimum.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	handlerOpts := &slog.HandlerOptions{Level: minimum}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+}
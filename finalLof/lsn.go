@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const metaFileName = "wal.meta"
+
+// ** state that has to survive even when every segment holding it is gone
+type walMeta struct {
+	// ** the lowest offset the next segment may start at
+	NextOffset int64 `json:"next_offset"`
+}
+
+func readMeta(fs fileSystem, directory string) (walMeta, error) {
+	var meta walMeta
+	data, err := readFile(fs, filepath.Join(directory, metaFileName))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, fmt.Errorf("failed to read meta file: %w", err)
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("failed to decode meta file: %w", err)
+	}
+	return meta, nil
+}
+
+// ** replace the meta file atomically through a temp file and rename
+func writeMeta(fs fileSystem, directory string, meta walMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode meta file: %w", err)
+	}
+	if err := writeFileAtomic(fs, filepath.Join(directory, metaFileName), data); err != nil {
+		return fmt.Errorf("failed to write meta file: %w", err)
+	}
+	return nil
+}
+
+// ** write a small file so readers see either the old or the new contents
+// ** the directory is synced too, so once it returns a crash keeps the new ones
+func writeFileAtomic(fs fileSystem, path string, data []byte) error {
+	tmp, err := createFile(fs, path+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := fs.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return fs.SyncDir(filepath.Dir(path))
+}
+
+// ** offset of the newest record in the log, ok is false if there is none
+// ** walks back from the newest segment and only scans past its last index entry
+func lastOffset(fs fileSystem, directory string, encryption *recordEncryption) (offset int64, ok bool, err error) {
+	indexes, err := manifestSegments(fs, directory)
+	if err != nil {
+		return 0, false, err
+	}
+	for i := len(indexes) - 1; i >= 0; i-- {
+		entries, err := loadIndex(fs, directory, indexes[i], encryption)
+		if err != nil {
+			return 0, false, err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		start := entries[len(entries)-1].position
+		err = scanSegment(fs, segmentPath(fs, directory, indexes[i]), start, encryption, func(record logRecord, _ int64) error {
+			offset = record.Offset
+			ok = true
+			return nil
+		})
+		if err != nil {
+			return 0, false, err
+		}
+		if ok {
+			return offset, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// ** the offset the next write will get
+// ** one past the newest record, never below what the meta file promised and at least 1
+func nextOffset(fs fileSystem, directory string, encryption *recordEncryption) (int64, error) {
+	meta, err := readMeta(fs, directory)
+	if err != nil {
+		return 0, err
+	}
+	next := int64(1)
+	if meta.NextOffset > next {
+		next = meta.NextOffset
+	}
+	last, ok, err := lastOffset(fs, directory, encryption)
+	if err != nil {
+		return 0, err
+	}
+	if ok && last+1 > next {
+		next = last + 1
+	}
+	return next, nil
+}
+
+// ** move the next offset forward, leaving a gap in the log
+// ** offsets only have to increase, so readers and the index cope with gaps
+// ** must be called with the mutex held
+func (w *WAL) advanceTo(offset int64) error {
+	if offset <= w.offset {
+		return nil
+	}
+	if err := writeMeta(w.fs, w.directory, walMeta{NextOffset: offset}); err != nil {
+		return err
+	}
+	w.offset = offset
+	return nil
+}
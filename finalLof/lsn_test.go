@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+// ** offsets keep counting up across reopens and rotations, also when the
+// ** segments that held the newest ones were removed by retention
+func TestOffsetsMonotonicAcrossRestartAndRotation(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{Directory: dir, Rotation: RotationPolicy{MaxBytes: 300}}
+	last := int64(0)
+	for round := 0; round < 4; round++ {
+		wal, err := newWriteAheadLOG(options)
+		if err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		for i := 0; i < 15; i++ {
+			offset, err := wal.WriteLog("t", map[string]interface{}{"round": round, "i": i})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if offset != last+1 {
+				t.Fatalf("round %d: write got offset %d after %d", round, offset, last)
+			}
+			last = offset
+		}
+		if len(wal.segments.indexes()) < 2 {
+			t.Fatalf("round %d: no rotation happened", round)
+		}
+		if round%2 == 1 {
+			// ** leaves only the active segment, which may hold nothing yet
+			if err := wal.TruncateBefore(last + 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := wal.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wal, err := newWriteAheadLOG(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadFrom(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Offset <= entries[i-1].Offset {
+			t.Fatalf("offset %d follows %d", entries[i].Offset, entries[i-1].Offset)
+		}
+	}
+}
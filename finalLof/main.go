@@ -2,14 +2,23 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strconv"
-	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 const (
@@ -17,74 +26,198 @@ const (
 	maxSegmentSize = 500
 	walDir         = "wal_data"
 	bufferSize     = 4096
+	// ** how long in-flight requests get to finish on shutdown
+	shutdownTimeout = 10 * time.Second
 )
 
+// ** set by grpc.go when the binary is built with -tags grpc
+var startGRPC func(addr string, wal *WAL, security ServerSecurity) (stop func(), err error)
+
 type WAL struct {
 	directory           string
-	currentSegment      *os.File
+	lock                io.Closer
+	fs                  fileSystem
+	currentSegment      storageFile
+	segmentWriter       *segmentWriter
 	writer              *bufio.Writer
 	currentSegmentIndex int
+	segments            *segmentManager
 	offset              int64
 	mu                  sync.Mutex
-	encoder             *json.Encoder
+	syncPolicy          SyncPolicy
+	dirty               bool
+	syncErr             error
+	stopSync            chan struct{}
+	retention           RetentionPolicy
+	compression         Compression
+	encryption          *recordEncryption
+	indexFile           storageFile
+	sinceIndexed        int
+	segmentSize         int64 // ** bytes written to the active segment, kept in memory
+	closed              bool
+	appended            chan struct{}
+	synced              chan struct{} // ** closed once more entries are durable
+	written             int64         // ** next offset after the records handed to the writer
+	durable             int64         // ** next offset after the records an fsync covered
+	truncations         []int64       // ** cut points of TruncateAfter calls, for watchers
+	checkpoint          *Checkpoint
+	consumers           map[string]int64
+	dedup               *dedupIndex
+	archiver            Archiver
+	archive             []archivedSegment // ** segments only kept in the archive
+	archived            map[int]bool      // ** local segments already uploaded
+	archiveQueue        chan int
+	archiveWorkers      sync.WaitGroup
+	archiveErr          error
+	compaction          CompactionPolicy
+	stopCompact         chan struct{}
+	scrubInterval       time.Duration
+	stopScrub           chan struct{}
+	vacuum              VacuumPolicy
+	maxEntrySize        int64 // ** 0 for no limit
+	stopVacuum          chan struct{}
+	maxSize             int64
+	usage               int64 // ** bytes on disk, only tracked with a max size
+	fullPolicy          FullPolicy
+	fullTimeout         time.Duration
+	preallocate         bool
+	fastSync            bool
+	rotation            RotationPolicy // ** MaxBytes always set
+	segmentEntries      int64          // ** records in the active segment
+	stopRotate          chan struct{}
+	mmapReads           bool
+	spaceFreed          *sync.Cond
+	reservations        map[*Reservation]struct{} // ** open reservations
+	reservationTimeout  time.Duration
+	closing             bool // ** set when Close starts, closed once it is done
+	hooks               []*commitHook
+	uncommitted         []LogEntry // ** written but not yet fsynced, for hooks
+	follower            *Follower  // ** set while the wal follows a leader
+	topics              *topicFilter
+	times               timeRange // ** write times in the active segment
+	metrics             *walMetrics
+	logger              *slog.Logger
+	tracer              Tracer
+	spanCtx             context.Context // ** parent of spans started under the mutex
+	// ** async writes, asyncMu only guards the queue so producers never
+	// ** wait for the mutex held across fsyncs
+	asyncMu     sync.RWMutex
+	asyncOnce   sync.Once
+	asyncQueue  chan asyncWrite
+	asyncDone   chan struct{}
+	asyncClosed bool
+}
+
+// ** tunables for opening a WAL, the zero value gives the defaults
+type Options struct {
+	// ** where segments and meta files live, wal_data if not set
+	Directory string
+	// ** when written entries are fsynced, SyncAlways if not set
+	SyncPolicy SyncPolicy
+	// ** closed segments beyond these limits are deleted after each rotation
+	Retention RetentionPolicy
+	// ** compression applied to segments once they are rotated out
+	Compression Compression
+	// ** when set every record is encrypted with AES-GCM under this key
+	Encryption KeyProvider
+	// ** when set rotated segments are uploaded here and deleted segments
+	// ** stay readable through it
+	Archiver Archiver
+	// ** background compaction of keyed entries, off if not set
+	Compaction CompactionPolicy
+	// ** when the active segment is rotated, at maxSegmentSize bytes if not set
+	Rotation RotationPolicy
+	// ** most bytes all segments together may take, no limit if zero
+	MaxSize int64
+	// ** what writes do once MaxSize is reached, FullReject if not set
+	FullPolicy FullPolicy
+	// ** how long FullBlock waits for space, forever if zero
+	FullTimeout time.Duration
+	// ** grow every segment to its maximum size when it is created, with
+	// ** fallocate on linux, so appends do not change the file size
+	Preallocate bool
+	// ** on macOS sync with plain fsync instead of F_FULLFSYNC, much faster
+	// ** but an entry only survives crashes of the process and the OS, not
+	// ** power loss, since the drive may still hold it in its cache
+	// ** every other platform always syncs to the disk and ignores it
+	FastSync bool
+	// ** read closed segments through a read only memory mapping where the
+	// ** platform supports it instead of positional reads
+	MmapReads bool
+	// ** how often closed segments are verified in the background, the
+	// ** results show up in Stats, off if zero
+	ScrubInterval time.Duration
+	// ** background merging of small closed segments, off if not set
+	Vacuum VacuumPolicy
+	// ** largest encoded entry in bytes, writes of a larger one fail with
+	// ** ErrEntryTooLarge, defaultMaxEntrySize if zero and no limit if negative
+	MaxEntrySize int64
+	// ** how long a Reservation stays open before it is aborted,
+	// ** defaultReservationTimeout if zero
+	ReservationTimeout time.Duration
+	// ** receives opens, recoveries, rotations, truncations, slow fsyncs and
+	// ** failures of background work, nothing is logged if not set
+	Logger *slog.Logger
+	// ** traces writes, batches, fsyncs, rotations and replays, off if not set
+	Tracer Tracer
+	// ** where the wal keeps its files, the real disk if not set
+	// ** newMemFS keeps them in memory, the crash test injects faults
+	fs fileSystem
 }
 
+// ** Key is optional, with compaction on only the newest entry per topic
+// ** and key is kept, and an entry with a key and a nil payload is a tombstone
 type LogEntry struct {
-	Offset  int         `json:"offset"`
+	Offset  int64       `json:"offset"`
 	Topic   string      `json:"topic"`
+	Key     string      `json:"key,omitempty"`
 	Payload interface{} `json:"payload"`
+	// ** when the entry was written, zero for entries from before timestamps
+	Timestamp time.Time `json:"timestamp"`
 }
 
-var segmentNameCache = make(map[string]string)
-var segmentCacheMu sync.RWMutex
+// ** on-disk form of an entry
+// ** the first entry of a batch carries the batch size so recovery can
+// ** drop a batch that was only partially written before a crash
+// ** ID is the idempotency key the entry was written with, if any
+type logRecord struct {
+	LogEntry
+	Batch int    `json:"batch,omitempty"`
+	ID    string `json:"id,omitempty"`
+	// ** the placeholder of a reservation, holds its offset and is never read
+	skip bool
+	// ** the reserved offset a committed reservation is read under, the
+	// ** record itself sits at a later offset nobody reads
+	fills int64
+	// ** payload bytes as stored, set when the record is read back
+	raw json.RawMessage
+	// ** the payload is bytes written with WriteRaw that are not JSON
+	binary bool
+}
 
-// ** genenrate a segment file name
+// ** name of the plain segment file with the given index
 func segmentFileName(directory string, index int) string {
-	key := fmt.Sprintf("%s:%d", directory, index)
-	segmentCacheMu.RLock()
-	if name, exists := segmentNameCache[key]; exists {
-		segmentCacheMu.RUnlock()
-		return name
-	}
-	segmentCacheMu.RUnlock()
-	name := filepath.Join(directory, fmt.Sprintf("%s%d.log", segmentPrefix, index))
-	segmentCacheMu.Lock()
-	segmentNameCache[key] = name
-	segmentCacheMu.Unlock()
-	return name
-}
-
-// ** find the last segment index
-// ** if there is no segment file it will create a new one with index 1
-// ** if there is a segment file it will return the last index
-func findLastSegemtIndex(directory string) (int, error) {
-	entries, err := os.ReadDir(directory)
-	if err != nil {
-		return 1, nil
-		// ** there is no directory so it will create a new one with index 1 for the first segment
-	}
-	maxIndex := 0
-	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasPrefix(entry.Name(), segmentPrefix) {
-			continue
-		}
+	return filepath.Join(directory, segmentPrefix+strconv.Itoa(index)+".log")
+}
 
-		name := entry.Name()
-		indexStr := strings.TrimPrefix(name, segmentPrefix)
-		indexStr = strings.TrimSuffix(indexStr, ".log")
-		if index, err := strconv.Atoi(indexStr); err == nil && index > maxIndex {
-			maxIndex = index
-		}
+// ** find the last segment index, the last one the manifest lists
+// ** if there is no segment it will create a new one with index 1
+// ** if there is a segment it will return the last index
+func findLastSegemtIndex(fs fileSystem, directory string) (int, error) {
+	indexes, err := manifestSegments(fs, directory)
+	if err != nil {
+		return 0, err
 	}
-	if maxIndex == 0 {
+	if len(indexes) == 0 {
+		// ** a new wal, its first segment gets index 1
 		return 1, nil
 	}
-	return maxIndex, nil
+	return indexes[len(indexes)-1], nil
 }
 
 // ** function to get stat of the file
 // ** this will be used to get the size of the file
-func calculateOffset(file *os.File) (int, error) {
+func calculateOffset(file storageFile) (int, error) {
 	stat, err := file.Stat()
 	if err != nil {
 		return 0, err
@@ -92,114 +225,745 @@ func calculateOffset(file *os.File) (int, error) {
 	return int(stat.Size()), nil
 }
 
-func newWriteAheadLOG() (*WAL, error) {
-	if err := os.MkdirAll(walDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create wal directory: %v", err)
+func newWriteAheadLOG(opts Options) (_ *WAL, err error) {
+	directory := opts.Directory
+	if directory == "" {
+		directory = walDir
+	}
+	if err := opts.Compression.validate(); err != nil {
+		return nil, err
+	}
+	encryption, err := newRecordEncryption(opts.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	fs := opts.fs
+	if fs == nil {
+		fs = osFS{}
 	}
-	segementIndex, err := findLastSegemtIndex(walDir)
+	if err := fs.MkdirAll(directory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create wal directory: %w", err)
+	}
+	// ** before anything on disk is touched, a second process would corrupt it
+	lock, err := fs.Lock(directory)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find last segment index: %v", err)
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			lock.Close()
+		}
+	}()
+	if err := checkEncryptionKey(fs, directory, encryption); err != nil {
+		return nil, err
+	}
+	if err := recoverVacuum(fs, directory, encryption); err != nil {
+		return nil, fmt.Errorf("failed to recover vacuum: %w", err)
+	}
+	removed, err := recoverManifest(fs, directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover manifest: %w", err)
+	}
+	segementIndex, err := findLastSegemtIndex(fs, directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find last segment index: %w", err)
+	}
+
+	rotation := opts.Rotation.withDefaults()
+	logger := walLogger(opts, directory)
+	if removed > 0 {
+		logger.Warn("deleted segments missing from the manifest", "segments", removed)
+	}
+	segmentPath := segmentFileName(directory, segementIndex)
+	cut, err := recoverSegment(fs, segmentPath, encryption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover segment: %w", err)
+	}
+	if cut > 0 {
+		logger.Warn("cut off unfinished writes", "segment", segementIndex, "bytes", cut)
+	}
+	file, segment, err := openActiveSegment(fs, segmentPath, opts.Preallocate, rotation.MaxBytes)
+	if err != nil {
+		return nil, err
 	}
 
-	segmentPath := segmentFileName(walDir, segementIndex)
-	file, err := os.OpenFile(segmentPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	// ** the sidecar index of the active segment may be behind or ahead of
+	// ** the recovered segment, so it is always rebuilt on open
+	_, recordCount, err := buildIndex(fs, directory, segementIndex, encryption)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to rebuild index: %w", err)
+	}
+	indexFile, err := openIndexFile(fs, directory, segementIndex)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	next, err := nextOffset(fs, directory, encryption)
+	if err != nil {
+		file.Close()
+		indexFile.Close()
+		return nil, fmt.Errorf("failed to recover last offset: %w", err)
+	}
+	times, err := buildTimeRange(fs, directory, segementIndex, encryption)
+	if err != nil {
+		file.Close()
+		indexFile.Close()
+		return nil, fmt.Errorf("failed to rebuild time range: %w", err)
+	}
+	topics, err := buildTopicFilter(fs, directory, segementIndex, encryption)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open segment file: %v", err)
+		file.Close()
+		indexFile.Close()
+		return nil, fmt.Errorf("failed to rebuild topic filter: %w", err)
 	}
 
-	offset, err := calculateOffset(file)
+	checkpoint, err := readCheckpoint(fs, directory)
+	if err != nil {
+		file.Close()
+		indexFile.Close()
+		return nil, err
+	}
+	consumers, err := readConsumerOffsets(fs, directory)
 	if err != nil {
 		file.Close()
-		return nil, fmt.Errorf("failed to calculate offset: %v", err)
+		indexFile.Close()
+		return nil, err
+	}
+	archive, err := readArchiveCatalog(fs, directory)
+	if err != nil {
+		file.Close()
+		indexFile.Close()
+		return nil, err
 	}
 
-	writer := bufio.NewWriterSize(file, bufferSize)
+	writer := bufio.NewWriterSize(segment, bufferSize)
 	wal := &WAL{
-		directory:           walDir,
+		directory:           directory,
+		lock:                lock,
+		fs:                  fs,
 		currentSegment:      file,
+		segmentWriter:       segment,
 		writer:              writer,
 		currentSegmentIndex: segementIndex,
-		offset:              1 + int64(offset),
+		offset:              next,
+		written:             next,
+		durable:             next,
+		syncPolicy:          opts.SyncPolicy,
+		retention:           opts.Retention,
+		compression:         opts.Compression,
+		encryption:          encryption,
+		indexFile:           indexFile,
+		sinceIndexed:        recordCount % indexInterval,
+		segmentSize:         segment.end,
+		topics:              topics,
+		times:               times,
+		metrics:             newWALMetrics(),
+		checkpoint:          checkpoint,
+		consumers:           consumers,
+		dedup:               newDedupIndex(),
+		archiver:            opts.Archiver,
+		archive:             archive,
+		archived:            make(map[int]bool),
+		compaction:          opts.Compaction,
+		maxSize:             opts.MaxSize,
+		fullPolicy:          opts.FullPolicy,
+		fullTimeout:         opts.FullTimeout,
+		preallocate:         opts.Preallocate,
+		fastSync:            opts.FastSync && runtime.GOOS == "darwin",
+		rotation:            rotation,
+		segmentEntries:      int64(recordCount),
+		mmapReads:           opts.MmapReads,
+		scrubInterval:       opts.ScrubInterval,
+		vacuum:              opts.Vacuum,
+		maxEntrySize:        entrySizeLimit(opts.MaxEntrySize),
+		logger:              logger,
+		tracer:              opts.Tracer,
+		reservationTimeout:  opts.ReservationTimeout,
+	}
+	wal.spaceFreed = sync.NewCond(&wal.mu)
+	wal.reservations = make(map[*Reservation]struct{})
+	if wal.reservationTimeout <= 0 {
+		wal.reservationTimeout = defaultReservationTimeout
+	}
+	if wal.segmentSize == 0 {
+		if err := wal.writeSegmentHeader(); err != nil {
+			file.Close()
+			indexFile.Close()
+			return nil, err
+		}
+	}
+	if wal.segments, err = loadSegments(fs, directory, encryption, segementIndex); err != nil {
+		file.Close()
+		indexFile.Close()
+		return nil, err
+	}
+	if err := wal.refreshUsage(); err != nil {
+		file.Close()
+		indexFile.Close()
+		return nil, err
+	}
+	if err := wal.rebuildDedup(); err != nil {
+		file.Close()
+		indexFile.Close()
+		return nil, fmt.Errorf("failed to rebuild idempotency keys: %w", err)
 	}
 
-	wal.encoder = json.NewEncoder(writer)
+	wal.startSyncLoop()
+	wal.startArchiver()
+	wal.startCompactor()
+	wal.startScrubber()
+	wal.startVacuum()
+	wal.startRotator()
+	logger.Info("wal opened", "segment", segementIndex, "segments", len(wal.segments.indexes()), "next_offset", next)
 	return wal, nil
 }
 
 func (w *WAL) FlushE() error {
 	if err := w.writer.Flush(); err != nil {
-		return fmt.Errorf("failed to flush writer: %v", err)
+		return fmt.Errorf("failed to flush writer: %w", err)
+	}
+	started := time.Now()
+	span := w.startSpan("wal.fsync")
+	span.setInt("wal.segment", int64(w.currentSegmentIndex))
+	err := w.syncSegment()
+	span.end(err)
+	if err != nil {
+		return fmt.Errorf("failed to sync segment file: %w", err)
+	}
+	if w.durable != w.written {
+		w.durable = w.written
+		w.signalDurable()
 	}
-	if err := w.currentSegment.Sync(); err != nil {
-		return fmt.Errorf("failed to sync segment file: %v", err)
+	elapsed := time.Since(started)
+	w.metrics.observeFsync(elapsed)
+	if elapsed > slowFsyncThreshold {
+		w.logger.Warn("slow fsync", "segment", w.currentSegmentIndex, "duration", elapsed)
 	}
+	w.runHooks()
 	return nil
 }
 
-func (w *WAL) rotateSegment() error {
+func (w *WAL) rotateSegment() (err error) {
+	span := w.startSpan("wal.rotate")
+	span.setInt("wal.segment", int64(w.currentSegmentIndex))
+	defer func() { span.end(err) }()
 	if err := w.FlushE(); err != nil {
 		return err
 	}
-	if err := w.currentSegment.Close(); err != nil {
+	if err := w.closeSegmentFile(); err != nil {
+		return err
+	}
+	if err := w.indexFile.Close(); err != nil {
+		return err
+	}
+	if err := writeTopicFilter(w.fs, w.directory, w.currentSegmentIndex, w.topics); err != nil {
+		return err
+	}
+	if err := writeTimeRange(w.fs, w.directory, w.currentSegmentIndex, w.times); err != nil {
 		return err
 	}
 
 	// ** create a new segment file
 	w.currentSegmentIndex++
 	segmentPath := segmentFileName(w.directory, w.currentSegmentIndex)
-	file, err := os.OpenFile(segmentPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	file, segment, err := openActiveSegment(w.fs, segmentPath, w.preallocate, w.rotation.MaxBytes)
+	if err != nil {
+		return fmt.Errorf("failed to open new segment file: %w", err)
+	}
+	indexFile, err := openIndexFile(w.fs, w.directory, w.currentSegmentIndex)
 	if err != nil {
-		return fmt.Errorf("failed to open new segment file: %v", err)
+		file.Close()
+		return err
 	}
 	w.currentSegment = file
-	w.writer = bufio.NewWriterSize(file, bufferSize)
-	w.encoder = json.NewEncoder(w.writer)
+	w.segmentWriter = segment
+	w.indexFile = indexFile
+	w.sinceIndexed = 0
+	w.segmentSize = 0
+	w.segmentEntries = 0
+	w.topics = newTopicFilter()
+	w.times = timeRange{}
+	// ** flushed above, the buffer is only pointed at the new segment
+	w.writer.Reset(segment)
+	w.metrics.rotations.Add(1)
+	w.logger.Debug("rotated segment", "segment", w.currentSegmentIndex-1, "next_offset", w.offset)
+	if err := w.writeSegmentHeader(); err != nil {
+		return err
+	}
+	if err := w.segments.add(w.currentSegmentIndex, w.offset); err != nil {
+		return err
+	}
+	// ** remembered so offsets keep increasing even if retention later
+	// ** removes every segment that holds them
+	if err := writeMeta(w.fs, w.directory, walMeta{NextOffset: w.offset}); err != nil {
+		return err
+	}
+	if w.compression != CompressionNone {
+		if err := compressSegment(w.fs, w.directory, w.currentSegmentIndex-1, w.compression); err != nil {
+			return fmt.Errorf("failed to compress segment: %w", err)
+		}
+	}
+	if err := w.segments.refresh(w.currentSegmentIndex - 1); err != nil {
+		return err
+	}
+	w.queueArchive(w.currentSegmentIndex - 1)
+	if err := w.enforceRetention(); err != nil {
+		return fmt.Errorf("failed to enforce retention: %w", err)
+	}
+	return w.refreshUsage()
+}
+
+// ** append one entry and return the offset it was assigned
+func (w *WAL) WriteLog(topic string, payload interface{}) (offset int64, err error) {
+	return w.writeLogContext(context.Background(), topic, payload)
+}
+
+// ** WriteLog with the spans of the write under ctx
+func (w *WAL) writeLogContext(ctx context.Context, topic string, payload interface{}) (offset int64, err error) {
+	defer w.metrics.countError(&err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	defer w.traceFrom(ctx)()
+	return w.writeLog("", LogEntry{Topic: topic, Payload: payload})
+}
+
+// ** body of WriteLog, must be called with the mutex held
+func (w *WAL) writeLog(id string, entry LogEntry) (int64, error) {
+	return w.appendLog(id, entry, w.commit)
+}
+
+// ** append one entry, see appendRecord
+func (w *WAL) appendLog(id string, entry LogEntry, publish func() error) (int64, error) {
+	return w.appendRecord(logRecord{LogEntry: entry, ID: id}, publish)
+}
+
+// ** append one record, publish either commits it or only flushes it to the
+// ** file for a group commit later, must be called with the mutex held
+// ** the entry gets the next offset, whatever it carries, and the current time
+// ** unless it has one already, which only replication sets
+func (w *WAL) appendRecord(record logRecord, publish func() error) (_ int64, err error) {
+	span := w.startSpan("wal.write")
+	span.setString("wal.topic", record.Topic)
+	defer func() { span.end(err) }()
+	if err := w.waitForSpace(); err != nil {
+		return 0, err
+	}
+	span.setInt("wal.offset", w.offset)
+	record.Offset = w.offset
+	if record.Timestamp.IsZero() {
+		record.Timestamp = time.Now().UTC()
+	}
+	entry := record.LogEntry
+	// ** encoded aside first so an entry over the size limit leaves nothing buffered
+	scratch := getRecordScratch()
+	defer putRecordScratch(scratch)
+	line, err := w.encryption.encodeLine(scratch, record)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode log entry: %w", err)
+	}
+	if err := w.checkEntrySize(len(line)); err != nil {
+		return 0, err
+	}
+	if _, err := w.writer.Write(line); err != nil {
+		return 0, fmt.Errorf("failed to write log entry: %w", err)
+	}
+	w.written = record.Offset + 1
+	held := len(w.uncommitted)
+	if !record.skip {
+		w.holdForHooks(record.entry())
+	}
+	if err := publish(); err != nil {
+		w.releaseHeld(held)
+		return 0, fmt.Errorf("failed to flush log entry: %w", err)
+	}
+	if err := w.indexRecord(w.offset, w.segmentSize); err != nil {
+		return 0, err
+	}
+	w.topics.add(entry.Topic)
+	w.times.add(entry.Timestamp)
+	if record.ID != "" {
+		w.dedup.add(record.ID, w.offset, w.offset+1)
+	}
+	w.signalAppend()
+
+	// ** counted from the encoded record, a Stat per write costs a syscall
+	w.metrics.writes.Add(1)
+	w.metrics.bytesWritten.Add(uint64(len(line)))
+	w.usage += int64(len(line))
+	w.segmentSize += int64(len(line))
+	w.segmentEntries++
 	w.offset = w.offset + 1
-	return nil
+	if err := w.rotateIfDue(); err != nil {
+		return 0, fmt.Errorf("failed to rotate segment: %w", err)
+	}
+	return entry.Offset, nil
 }
 
-func (w *WAL) WriteLog(topic string, payload interface{}) error {
+// ** write a group of entries with a single flush and fsync
+// ** offsets and timestamps are assigned here, any set by the caller are ignored
+// ** the batch is never split across segments and is dropped as a whole
+// ** by recovery if the process dies halfway through writing it
+func (w *WAL) WriteBatch(entries []LogEntry) (err error) {
+	if len(entries) == 0 {
+		return nil
+	}
+	defer w.metrics.countError(&err)
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.writeBatch(entries)
+}
+
+// ** WriteBatch that also returns the offset each entry was assigned
+// ** a batch takes consecutive offsets, so they follow on from the first
+func (w *WAL) WriteBatchOffsets(entries []LogEntry) (offsets []int64, err error) {
+	return w.writeBatchOffsets(context.Background(), entries)
+}
 
-	entry := LogEntry{
-		Offset:  int(w.offset),
-		Topic:   topic,
-		Payload: payload,
+// ** WriteBatchOffsets with the spans of the batch under ctx
+func (w *WAL) writeBatchOffsets(ctx context.Context, entries []LogEntry) (offsets []int64, err error) {
+	if len(entries) == 0 {
+		return nil, nil
 	}
-	if err := w.encoder.Encode(entry); err != nil {
-		return fmt.Errorf("failed to encode log entry: %v", err)
+	defer w.metrics.countError(&err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer w.traceFrom(ctx)()
+	first := w.offset
+	if err := w.writeBatch(entries); err != nil {
+		return nil, err
 	}
-	if err := w.FlushE(); err != nil {
-		return fmt.Errorf("failed to flush log entry: %v", err)
+	offsets = make([]int64, len(entries))
+	for i := range offsets {
+		offsets[i] = first + int64(i)
 	}
+	return offsets, nil
+}
 
-	fileInfo, err := w.currentSegment.Stat()
-	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+// ** body of WriteBatch, must be called with the mutex held
+func (w *WAL) writeBatch(entries []LogEntry) (err error) {
+	span := w.startSpan("wal.write_batch")
+	span.setInt("wal.entries", int64(len(entries)))
+	span.setInt("wal.offset", w.offset)
+	defer func() { span.end(err) }()
+	if w.closed {
+		return ErrClosed
 	}
-	currentFileSize := fileInfo.Size()
-	w.offset = w.offset + 1
-	if currentFileSize >= maxSegmentSize {
-		if err := w.rotateSegment(); err != nil {
-			return fmt.Errorf("failed to rotate segment: %v", err)
+	if err := w.waitForSpace(); err != nil {
+		return err
+	}
+
+	// ** encode everything up front so a bad payload leaves nothing buffered
+	buf := getBatchBuffer()
+	defer putBatchBuffer(buf)
+	scratch := getRecordScratch()
+	defer putRecordScratch(scratch)
+	offset := w.offset
+	now := time.Now().UTC()
+	positions := make([]int64, len(entries))
+	for i, entry := range entries {
+		start := buf.Len()
+		positions[i] = w.segmentSize + int64(start)
+		record := logRecord{
+			LogEntry: LogEntry{
+				Offset:    offset,
+				Topic:     entry.Topic,
+				Key:       entry.Key,
+				Payload:   entry.Payload,
+				Timestamp: now,
+			},
+		}
+		if i == 0 {
+			record.Batch = len(entries)
 		}
+		line, err := w.encryption.encodeLine(scratch, record)
+		if err != nil {
+			return fmt.Errorf("failed to encode log entry: %w", err)
+		}
+		if err := w.checkEntrySize(len(line)); err != nil {
+			return err
+		}
+		buf.Write(line)
+		offset++
+	}
+
+	held := len(w.uncommitted)
+	for i, entry := range entries {
+		w.holdForHooks(LogEntry{
+			Offset:    w.offset + int64(i),
+			Topic:     entry.Topic,
+			Key:       entry.Key,
+			Payload:   entry.Payload,
+			Timestamp: now,
+		})
+	}
+	if _, err := w.writer.Write(buf.Bytes()); err != nil {
+		w.releaseHeld(held)
+		return fmt.Errorf("failed to write batch: %w", err)
+	}
+	w.written = offset
+	if err := w.commit(); err != nil {
+		w.releaseHeld(held)
+		return fmt.Errorf("failed to flush batch: %w", err)
+	}
+
+	for i, position := range positions {
+		if err := w.indexRecord(w.offset+int64(i), position); err != nil {
+			return err
+		}
+		w.topics.add(entries[i].Topic)
+	}
+	w.times.add(now)
+	w.signalAppend()
+	w.metrics.writes.Add(uint64(len(entries)))
+	w.metrics.bytesWritten.Add(uint64(buf.Len()))
+	w.usage += int64(buf.Len())
+
+	w.offset = offset
+	w.segmentSize += int64(buf.Len())
+	w.segmentEntries += int64(len(entries))
+	if err := w.rotateIfDue(); err != nil {
+		return fmt.Errorf("failed to rotate segment: %w", err)
 	}
 	return nil
 }
 
 func main() {
-	wal, err := newWriteAheadLOG()
+	if isWalctl(os.Args) {
+		os.Exit(runWalctl(walctlArgs(os.Args), os.Stdout, os.Stderr))
+	}
+
+	flag.String("config", "", "read settings not given as flags or WAL_ environment variables from this file")
+	port := flag.Int("port", 9090, "port the HTTP API listens on")
+	dir := flag.String("dir", walDir, "directory the wal keeps its segments in")
+	var rotation RotationPolicy
+	flag.Int64Var(&rotation.MaxBytes, "segment-size", maxSegmentSize, "bytes a segment grows to before it is rotated")
+	flag.Int64Var(&rotation.MaxEntries, "segment-entries", 0, "entries a segment holds before it is rotated, 0 for no limit")
+	flag.DurationVar(&rotation.MaxAge, "segment-age", 0, "rotate a segment this long after its oldest entry, e.g. 10m, 0 for no limit")
+	syncPolicy := flag.String("sync", "always", "when writes are fsynced: always, manual or an interval such as 10ms")
+	fastSync := flag.Bool("fast-sync", false, "on macOS fsync without F_FULLFSYNC, faster but not safe against power loss")
+	metrics := flag.Bool("metrics", true, "serve prometheus metrics on /metrics")
+	logFormat := flag.String("log-format", "text", "format of the log written to stderr: text or json")
+	logLevel := flag.String("log-level", "info", "least severe log messages written: debug, info, warn or error")
+	var retention RetentionPolicy
+	flag.Int64Var(&retention.MaxBytes, "retention-bytes", 0, "delete the oldest closed segments beyond this many bytes, 0 for no limit")
+	flag.IntVar(&retention.MaxSegments, "retention-segments", 0, "delete the oldest closed segments beyond this many, 0 for no limit")
+	flag.DurationVar(&retention.MaxAge, "retention-age", 0, "delete closed segments older than this, e.g. 168h, 0 for no limit")
+	otelEndpoint := flag.String("otel-endpoint", "", "export traces to the OTLP/HTTP collector at this host:port, needs -tags otel")
+	grpcAddr := flag.String("grpc", "", "also serve the gRPC API on this address, e.g. :9091")
+	s3Bucket := flag.String("s3-bucket", "", "archive rotated segments to this S3 bucket, credentials come from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	s3Region := flag.String("s3-region", "us-east-1", "region of the S3 bucket")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3 endpoint URL, defaults to the AWS endpoint of the region")
+	s3Prefix := flag.String("s3-prefix", "", "key prefix for archived segments")
+	replicateFrom := flag.String("replicate-from", "", "follow the wal server at this URL as a warm standby, e.g. http://primary:9090")
+	replicateToken := flag.String("replicate-token", "", "token sent to the leader")
+	replicateCA := flag.String("replicate-ca", "", "CA file trusted for the leader's certificate, defaults to the system roots")
+	replicateCert := flag.String("replicate-cert", "", "client certificate presented to a leader that requires mTLS")
+	replicateKey := flag.String("replicate-key", "", "key of -replicate-cert")
+	tlsCert := flag.String("tls-cert", "", "serve HTTP and gRPC over TLS with this certificate")
+	tlsKey := flag.String("tls-key", "", "key of -tls-cert")
+	tlsClientCA := flag.String("tls-client-ca", "", "require client certificates signed by a CA in this file (mTLS)")
+	tokensFile := flag.String("auth-tokens-file", "", "require a bearer token or X-API-Key from this file, one per line")
+	scrubInterval := flag.Duration("scrub-interval", 0, "verify closed segments in the background this often, e.g. 1h, 0 for never")
+	vacuumInterval := flag.Duration("vacuum-interval", 0, "merge small closed segments this often, e.g. 10m, 0 for never")
+	vacuumMinSize := flag.Int64("vacuum-min-size", 0, "closed segments below this many bytes are merged by vacuum")
+	maxEntrySize := flag.Int64("max-entry-size", defaultMaxEntrySize, "largest encoded entry in bytes, -1 for no limit")
+	maxBody := flag.Int64("max-body", defaultMaxBody, "largest request body in bytes, 0 for no limit")
+	var writeLimit RateLimit
+	flag.Float64Var(&writeLimit.Rate, "rate-limit", 0, "write requests per second allowed per client, 0 for no limit")
+	flag.IntVar(&writeLimit.Burst, "rate-burst", 0, "write requests a client may make at once, defaults to the rate")
+	flag.BoolVar(&writeLimit.Global, "rate-global", false, "share the rate limit between all clients instead of one per client")
+	flag.Parse()
+	if err := loadConfig(flag.CommandLine, os.LookupEnv); err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	logger, err := newServerLogger(*logFormat, *logLevel)
 	if err != nil {
-		fmt.Printf("Error creating WAL: %v\n", err)
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	policy, err := parseSyncPolicy(*syncPolicy)
+	if err == nil {
+		err = checkServerConfig(*port, rotation, retention)
+	}
+	if err != nil {
+		logger.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+
+	var security ServerSecurity
+	if *tlsCert != "" || *tlsKey != "" || *tlsClientCA != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			logger.Error("failed to configure TLS", "err", "-tls-cert and -tls-key are both required")
+			os.Exit(1)
+		}
+		config, err := loadServerTLS(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			logger.Error("failed to configure TLS", "err", err)
+			os.Exit(1)
+		}
+		security.TLS = config
+	}
+	if *tokensFile != "" {
+		tokens, err := loadTokens(*tokensFile)
+		if err != nil {
+			logger.Error("failed to load tokens", "err", err)
+			os.Exit(1)
+		}
+		security.Tokens = tokens
+	}
+
+	opts := Options{
+		Directory:     *dir,
+		SyncPolicy:    policy,
+		Retention:     retention,
+		Rotation:      rotation,
+		ScrubInterval: *scrubInterval,
+		Vacuum:        VacuumPolicy{Interval: *vacuumInterval, MinSize: *vacuumMinSize},
+		MaxEntrySize:  *maxEntrySize,
+		FastSync:      *fastSync,
+		Logger:        logger,
+	}
+	shutdownTracer := func(context.Context) error { return nil }
+	if *otelEndpoint != "" {
+		if newServerTracer == nil {
+			logger.Error("failed to start tracing", "err", "binary built without OpenTelemetry support, rebuild with -tags otel")
+			os.Exit(1)
+		}
+		if opts.Tracer, shutdownTracer, err = newServerTracer(*otelEndpoint); err != nil {
+			logger.Error("failed to start tracing", "err", err)
+			os.Exit(1)
+		}
+	}
+	if *s3Bucket != "" {
+		endpoint := *s3Endpoint
+		if endpoint == "" {
+			endpoint = "https://s3." + *s3Region + ".amazonaws.com"
+		}
+		opts.Archiver = &S3Archiver{
+			Endpoint:        endpoint,
+			Region:          *s3Region,
+			Bucket:          *s3Bucket,
+			Prefix:          *s3Prefix,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+
+	wal, err := newWriteAheadLOG(opts)
+	if err != nil {
+		logger.Error("failed to open wal", "err", err)
 		os.Exit(1)
 		return
 	}
-	fmt.Println(wal)
-	http.HandleFunc("/write", wal.ServerHTTP)
-	fmt.Println("Server started on :9090")
-	http.ListenAndServe(":9090", nil)
+	mux := http.NewServeMux()
+	writeLimiter := newRateLimiter(writeLimit)
+	// ** a follower is read only, its entries come from the leader
+	writes := func(handle http.HandlerFunc) http.HandlerFunc {
+		return wal.leaderOnly(writeLimiter.wrap(handle))
+	}
+	mux.HandleFunc("/write", writes(wal.ServerHTTP))
+	mux.HandleFunc("/write/batch", writes(wal.handleWriteBatch))
+	mux.HandleFunc("/read", wal.handleRead)
+	mux.HandleFunc("/stream", wal.handleStream)
+	if *metrics {
+		mux.HandleFunc("/metrics", wal.handleMetrics)
+	}
+	mux.HandleFunc("/status", wal.handleStatus)
+	mux.HandleFunc("/healthz", wal.handleHealthz)
+	mux.HandleFunc("/commit", wal.handleCommit)
+	mux.HandleFunc("/offset", wal.handleOffset)
+	mux.HandleFunc("/topic/", wal.leaderOnly(wal.handlePurgeTopic))
+	mux.HandleFunc("/replication/status", wal.handleReplicationStatus)
+	namespaces := NewNamespaces(opts)
+	mux.HandleFunc("/ns", namespaces.handler(writes))
+	mux.HandleFunc("/ns/", namespaces.handler(writes))
+
+	// ** streams never finish on their own, cancelling the base context on
+	// ** shutdown ends them while plain writes are still allowed to drain
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:        fmt.Sprintf(":%d", *port),
+		Handler:     traceHTTP(opts.Tracer, security.requireAuth(limitBody(*maxBody, mux))),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+		TLSConfig:   security.TLS,
+	}
+	server.RegisterOnShutdown(cancelBase)
+	go func() {
+		var err error
+		if security.TLS != nil {
+			// ** the certificate is in TLSConfig already
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("server failed", "err", err)
+			os.Exit(1)
+		}
+	}()
+	logger.Info("server started", "addr", server.Addr, "tls", security.TLS != nil)
 
+	stopGRPC := func() {}
+	if *grpcAddr != "" {
+		if startGRPC == nil {
+			logger.Error("failed to start gRPC", "err", "binary built without gRPC support, rebuild with -tags grpc")
+			os.Exit(1)
+		}
+		if stopGRPC, err = startGRPC(*grpcAddr, wal, security); err != nil {
+			logger.Error("failed to start gRPC", "err", err)
+			os.Exit(1)
+		}
+		logger.Info("gRPC server started", "addr", *grpcAddr)
+	}
+
+	stopFollower := func() {}
+	if *replicateFrom != "" {
+		config := FollowerConfig{Token: *replicateToken}
+		if *replicateCA != "" || *replicateCert != "" {
+			if config.TLS, err = loadClientTLS(*replicateCA, *replicateCert, *replicateKey); err != nil {
+				logger.Error("failed to configure replication TLS", "err", err)
+				os.Exit(1)
+			}
+		}
+		follower, err := wal.FollowWith(*replicateFrom, config)
+		if err != nil {
+			logger.Error("failed to start replication", "err", err)
+			os.Exit(1)
+		}
+		stopFollower = follower.Stop
+		logger.Info("following leader", "leader", *replicateFrom)
+	}
+
+	// ** on SIGINT/SIGTERM stop accepting requests, let in-flight writes
+	// ** finish and only then close the wal so nothing is left unsynced
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	logger.Info("shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Error("failed to drain requests", "err", err)
+	}
+	stopGRPC()
+	stopFollower()
+	if err := namespaces.Close(); err != nil {
+		logger.Error("failed to close namespaces", "err", err)
+	}
+	if err := wal.Close(); err != nil {
+		logger.Error("failed to close wal", "err", err)
+		os.Exit(1)
+	}
+	if err := shutdownTracer(ctx); err != nil {
+		logger.Error("failed to flush traces", "err", err)
+	}
 }
 
 func (w *WAL) ServerHTTP(writer http.ResponseWriter, request *http.Request) {
@@ -211,42 +975,457 @@ func (w *WAL) ServerHTTP(writer http.ResponseWriter, request *http.Request) {
 	}
 }
 
+// ** handle the read request
+// ** returns every entry from the given offset onwards, from the start if none is given
+// ** topic may be repeated to read several topics at once
+// ** since and until take RFC 3339 times and limit the entries to those
+// ** written at or after since and before until
+func (w *WAL) handleRead(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := request.URL.Query()
+	var from int64
+	if value := query.Get("offset"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(writer, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		from = parsed
+	}
+	var since, until time.Time
+	for name, bound := range map[string]*time.Time{"since": &since, "until": &until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				http.Error(writer, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*bound = parsed
+		}
+	}
+
+	var entries []LogEntry
+	var err error
+	if since.IsZero() && until.IsZero() {
+		entries, err = w.ReadFromContext(request.Context(), from, query["topic"]...)
+	} else {
+		var inRange []LogEntry
+		inRange, err = w.ReadRangeContext(request.Context(), since, until, query["topic"]...)
+		for _, entry := range inRange {
+			if entry.Offset >= from {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if err != nil {
+		if request.Context().Err() != nil {
+			writeContextError(writer, err)
+			return
+		}
+		writeReadError(writer, err)
+		return
+	}
+	if entries == nil {
+		entries = []LogEntry{}
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"offset":  from,
+		"count":   len(entries),
+		"entries": entries,
+	})
+}
+
+// ** a blocking wal frees space as consumers catch up, so the client is told
+// ** to retry, otherwise the wal stays full until someone intervenes
+func (w *WAL) writeFullError(writer http.ResponseWriter) {
+	if w.fullPolicy == FullBlock {
+		writer.Header().Set("Retry-After", "1")
+		http.Error(writer, "WAL is full, retry later", http.StatusTooManyRequests)
+		return
+	}
+	http.Error(writer, "WAL is full", http.StatusInsufficientStorage)
+}
+
+// ** the request context ended before the wal answered, usually the client
+// ** is gone already but a proxy with a deadline still gets a status
+func writeContextError(writer http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(writer, "Request timed out", http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(writer, "Request cancelled", http.StatusServiceUnavailable)
+}
 
+// ** answer a failed read, a corrupt segment is named so it can be repaired
+func writeReadError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrClosed):
+		http.Error(writer, "WAL is closed", http.StatusServiceUnavailable)
+	case errors.Is(err, ErrCorrupt):
+		http.Error(writer, "Failed to read log: "+err.Error(), http.StatusInternalServerError)
+	default:
+		http.Error(writer, "Failed to read log", http.StatusInternalServerError)
+	}
+}
 
-func ( w *WAL) handleRead(writer http.ResponseWriter, request *http.Request){
-	
+// ** handle the batch write request
+// ** the body is a JSON array of {"topic", "payload"} objects, written with
+// ** a single fsync as one batch that either lands whole or not at all
+// ** answers with the offset of every entry, in the order they were sent
+func (w *WAL) handleWriteBatch(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body []struct {
+		Topic   string                 `json:"topic"`
+		Payload map[string]interface{} `json:"payload"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		writeDecodeError(writer, err)
+		return
+	}
+	if len(body) == 0 {
+		http.Error(writer, "Empty batch", http.StatusBadRequest)
+		return
+	}
+	entries := make([]LogEntry, len(body))
+	for i, item := range body {
+		if item.Payload == nil {
+			http.Error(writer, fmt.Sprintf("Missing payload in entry %d", i), http.StatusBadRequest)
+			return
+		}
+		if item.Topic == "" {
+			item.Topic = "default"
+		}
+		entries[i] = LogEntry{Topic: item.Topic, Payload: item.Payload}
+	}
+
+	var offsets []int64
+	var err error
+	ctxErr := waitContext(request.Context(), func() {
+		offsets, err = w.writeBatchOffsets(request.Context(), entries)
+	})
+	if ctxErr != nil {
+		writeContextError(writer, ctxErr)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, ErrClosed) {
+			http.Error(writer, "WAL is closed", http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, ErrWALFull) {
+			w.writeFullError(writer)
+			return
+		}
+		if errors.Is(err, ErrEntryTooLarge) {
+			http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(writer, "Failed to write batch", http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"offsets": offsets,
+		"count":   len(offsets),
+		"message": "Log entries written successfully",
+	})
+}
+
+// ** handle the consumer commit request
+// ** the body names the consumer and the next offset it wants to read
+func (w *WAL) handleCommit(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var body struct {
+		Consumer string `json:"consumer"`
+		Offset   *int64 `json:"offset"`
+	}
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		writeDecodeError(writer, err)
+		return
+	}
+	if body.Consumer == "" || body.Offset == nil {
+		http.Error(writer, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	if err := w.CommitOffset(body.Consumer, *body.Offset); err != nil {
+		if errors.Is(err, ErrClosed) {
+			http.Error(writer, "WAL is closed", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"consumer": body.Consumer,
+		"offset":   *body.Offset,
+	})
+}
+
+// ** handle the committed offset lookup for ?consumer=
+func (w *WAL) handleOffset(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	consumer := request.URL.Query().Get("consumer")
+	if consumer == "" {
+		http.Error(writer, "Missing consumer", http.StatusBadRequest)
+		return
+	}
+	offset, ok := w.CommittedOffset(consumer)
+	if !ok {
+		http.Error(writer, "No committed offset", http.StatusNotFound)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"consumer": consumer,
+		"offset":   offset,
+	})
+}
+
+// ** handle the metrics request
+// ** serves Stats in the prometheus text format for scraping
+func (w *WAL) handleMetrics(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := w.Stats()
+	if err != nil {
+		http.Error(writer, "Failed to collect stats", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writePrometheus(writer, stats)
+}
+
+// ** handle the status request
+// ** a human readable summary of where the log stands
+func (w *WAL) handleStatus(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := w.Stats()
+	if err != nil {
+		http.Error(writer, "Failed to collect stats", http.StatusInternalServerError)
+		return
+	}
+	var lastSync interface{}
+	if !stats.LastSync.IsZero() {
+		lastSync = stats.LastSync.UTC().Format(time.RFC3339Nano)
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"last_offset":     stats.LastOffset,
+		"next_offset":     stats.NextOffset,
+		"current_segment": stats.CurrentSegment,
+		"segment_size":    stats.SegmentSize,
+		"total_segments":  stats.TotalSegments,
+		"total_bytes":     stats.TotalBytes,
+		"last_sync":       lastSync,
+		"uptime_seconds":  stats.Uptime.Seconds(),
+	})
+}
+
+// ** handle the health probe
+// ** healthy while the wal accepts writes and the last background sync worked
+func (w *WAL) handleHealthz(writer http.ResponseWriter, request *http.Request) {
+	w.mu.Lock()
+	closed, syncErr := w.closed, w.syncErr
+	w.mu.Unlock()
+	switch {
+	case closed:
+		http.Error(writer, "closed", http.StatusServiceUnavailable)
+	case syncErr != nil:
+		http.Error(writer, "sync failing", http.StatusServiceUnavailable)
+	default:
+		writer.Write([]byte("ok\n"))
+	}
+}
+
+// ** handle the stream request
+// ** pushes entries as server-sent events, replaying from the given offset
+// ** and then following the log until the client goes away
+// ** a reconnecting client resumes after Last-Event-ID if no offset is given
+// ** unlike Watch in the process, an entry is only sent once it is durable,
+// ** with -sync manual or an interval that is after the next fsync
+func (w *WAL) handleStream(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := request.URL.Query()
+	var from int64
+	if value := query.Get("from"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(writer, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		from = parsed
+	} else if value := request.Header.Get("Last-Event-ID"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(writer, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		from = parsed + 1
+	}
+	topic := query.Get("topic")
+
+	entries := w.watchDurable(request.Context(), from)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case record, ok := <-entries:
+			if !ok {
+				return
+			}
+			if topic != "" && record.Topic != topic {
+				continue
+			}
+			entry, err := newReplicatedEntry(record)
+			if err != nil {
+				return
+			}
+			data, err := json.Marshal(entry)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(writer, "id: %d\nevent: entry\ndata: %s\n\n", entry.Offset, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
 }
 
 // ** handle the write request
 // ** this will be used to write the log entry to the file
+// ** an Idempotency-Key header makes retries safe, a repeated key answers
+// ** with the offset of the first write instead of writing again
+// ** ?key= writes a compaction keyed entry, a null body is a tombstone
+// ** ?ack= picks how durable the entry is before the answer, fsync, flush or
+// ** none for only queued, without it the sync policy decides
 func (w *WAL) handleWrite(writer http.ResponseWriter, request *http.Request) {
 	var payload map[string]interface{}
 	if err := json.NewDecoder(request.Body).Decode(&payload); err != nil {
-		http.Error(writer, "Invalid payload", http.StatusBadRequest)
+		writeDecodeError(writer, err)
 		return
 	}
-	topic := request.URL.Query().Get("topic")
+	query := request.URL.Query()
+	topic := query.Get("topic")
 	if topic == "" {
 		topic = "default"
 	}
+	ack, err := parseAck(query.Get("ack"))
+	if err != nil {
+		http.Error(writer, "Invalid ack, use fsync, flush or none", http.StatusBadRequest)
+		return
+	}
+	entry := LogEntry{Topic: topic, Key: query.Get("key"), Payload: payload}
+	idempotencyKey := request.Header.Get("Idempotency-Key")
+
+	if ack == AckNone {
+		result := w.writeLogAsync(idempotencyKey, entry)
+		// ** a wal that is closed answers at once, anything else is queued
+		select {
+		case res := <-result:
+			if res.Err != nil {
+				w.writeWriteError(writer, res.Err)
+				return
+			}
+		default:
+		}
+		writer.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(writer).Encode(map[string]interface{}{
+			"topic":   topic,
+			"payload": payload,
+			"message": "Log entry queued",
+			"ack":     AckNone.String(),
+		})
+		return
+	}
 
-	if err := w.WriteLog(topic, payload); err != nil {
-		http.Error(writer, "Failed to write log", http.StatusInternalServerError)
+	var offset int64
+	var duplicate bool
+	var achieved Ack
+	ctxErr := waitContext(request.Context(), func() {
+		offset, duplicate, achieved, err = w.writeLogAck(request.Context(), idempotencyKey, entry, ack)
+	})
+	if ctxErr != nil {
+		writeContextError(writer, ctxErr)
+		return
+	}
+	if err != nil {
+		w.writeWriteError(writer, err)
 		return
 	}
 
 	w.mu.Lock()
-	currentOffset := w.offset
 	currentSegment := w.currentSegmentIndex
+	segmentName := w.currentSegment.Name()
 	w.mu.Unlock()
 
-	writer.WriteHeader(http.StatusCreated)
+	status, message := http.StatusCreated, "Log entry written successfully"
+	if duplicate {
+		status, message = http.StatusOK, "Duplicate idempotency key, entry already written"
+	}
+	writer.WriteHeader(status)
 	json.NewEncoder(writer).Encode(map[string]interface{}{
-		"offset":   currentOffset,
-		"segment":  currentSegment,
-		"topic":    topic,
-		"payload":  payload,
-		"message":  "Log entry written successfully",
-		"fileSize": w.currentSegment.Name(),
+		"offset":    offset,
+		"segment":   currentSegment,
+		"topic":     topic,
+		"payload":   payload,
+		"message":   message,
+		"fileSize":  segmentName,
+		"duplicate": duplicate,
+		"ack":       achieved.String(),
 	})
 }
+
+// ** answer a failed write with the status that fits the error
+func (w *WAL) writeWriteError(writer http.ResponseWriter, err error) {
+	if errors.Is(err, ErrClosed) {
+		http.Error(writer, "WAL is closed", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, ErrWALFull) {
+		w.writeFullError(writer)
+		return
+	}
+	if errors.Is(err, ErrEntryTooLarge) {
+		http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(writer, "Failed to write log", http.StatusInternalServerError)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	manifestFileName = "MANIFEST"
+	manifestVersion  = 1
+)
+
+// ** the segments a wal consists of, with their base offsets
+// ** it is replaced atomically and synced before segment files are deleted
+// ** and after new ones are created, so after a crash a segment file that is
+// ** not listed is either a removal that did not finish or a rotation that
+// ** wrote nothing yet, and open finishes the job by deleting it
+// ** a wal from before the manifest gets one from its directory on open
+// ** open, the read only wal and lastOffset take the segments from it, only
+// ** a directory without one is listed
+// ** checkpoints, consumer offsets and the next offset are not part of it,
+// ** they keep files of their own that are replaced the same way
+type walManifest struct {
+	Version  int               `json:"version"`
+	Segments []manifestSegment `json:"segments"`
+}
+
+type manifestSegment struct {
+	Index   int   `json:"index"`
+	Base    int64 `json:"base"`
+	HasBase bool  `json:"has_base,omitempty"`
+}
+
+// ** the manifest of directory, ok is false if it has none yet
+func readManifest(fs fileSystem, directory string) (manifest walManifest, ok bool, err error) {
+	data, err := readFile(fs, filepath.Join(directory, manifestFileName))
+	if os.IsNotExist(err) {
+		return walManifest{}, false, nil
+	}
+	if err != nil {
+		return walManifest{}, false, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return walManifest{}, false, fmt.Errorf("%w: damaged manifest: %v", ErrCorrupt, err)
+	}
+	if manifest.Version > manifestVersion {
+		return walManifest{}, false, fmt.Errorf("manifest version %d is newer than this binary supports", manifest.Version)
+	}
+	return manifest, true, nil
+}
+
+func writeManifest(fs fileSystem, directory string, manifest walManifest) error {
+	manifest.Version = manifestVersion
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := writeFileAtomic(fs, filepath.Join(directory, manifestFileName), data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// ** the segment indexes of directory in ascending order, as its manifest
+// ** lists them, a directory without a manifest yet is listed instead
+func manifestSegments(fs fileSystem, directory string) ([]int, error) {
+	manifest, ok, err := readManifest(fs, directory)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return listSegments(fs, directory)
+	}
+	indexes := make([]int, len(manifest.Segments))
+	for i, segment := range manifest.Segments {
+		indexes[i] = segment.Index
+	}
+	return indexes, nil
+}
+
+// ** bring the directory in line with its manifest before anything else
+// ** looks at the segments: files that are not listed are deleted, and a
+// ** listed segment that is missing is an error rather than a silent gap
+// ** returns how many files were deleted
+func recoverManifest(fs fileSystem, directory string) (int, error) {
+	manifest, ok, err := readManifest(fs, directory)
+	if err != nil || !ok {
+		return 0, err
+	}
+	indexes, err := listSegments(fs, directory)
+	if err != nil {
+		return 0, err
+	}
+	onDisk := make(map[int]bool, len(indexes))
+	for _, index := range indexes {
+		onDisk[index] = true
+	}
+	listed := make(map[int]bool, len(manifest.Segments))
+	for _, segment := range manifest.Segments {
+		if !onDisk[segment.Index] {
+			return 0, fmt.Errorf("%w: segment %d is in the manifest of %s", ErrSegmentNotFound, segment.Index, directory)
+		}
+		listed[segment.Index] = true
+	}
+	removed := 0
+	for _, index := range indexes {
+		if listed[index] {
+			continue
+		}
+		if err := fs.Remove(segmentPath(fs, directory, index)); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove segment %d: %w", index, err)
+		}
+		if err := removeSidecars(fs, directory, index); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	if removed > 0 {
+		return removed, fs.SyncDir(directory)
+	}
+	return 0, nil
+}
+
+// ** take segments out of the manifest of directory, if it has one, for
+// ** code that removes segments without a segmentManager
+func dropFromManifest(fs fileSystem, directory string, indexes []int) error {
+	manifest, ok, err := readManifest(fs, directory)
+	if err != nil || !ok {
+		return err
+	}
+	drop := make(map[int]bool, len(indexes))
+	for _, index := range indexes {
+		drop[index] = true
+	}
+	kept := manifest.Segments[:0]
+	for _, segment := range manifest.Segments {
+		if !drop[segment.Index] {
+			kept = append(kept, segment)
+		}
+	}
+	if len(kept) == len(manifest.Segments) {
+		return nil
+	}
+	manifest.Segments = kept
+	return writeManifest(fs, directory, manifest)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// ** a segment file the manifest does not list is a rotation or removal
+// ** that never finished, neither a reader nor the writer may use it
+func TestSegmentsComeFromTheManifest(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := newWriteAheadLOG(Options{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := wal.WriteLog("t", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stray := segmentFileName(dir, 999)
+	if err := os.WriteFile(stray, []byte("not a segment\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := reader.ReadFrom(0)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("read only wal read the unlisted segment: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("read only wal got %d entries, want 3", len(entries))
+	}
+
+	wal, err = newWriteAheadLOG(Options{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if wal.currentSegmentIndex == 999 {
+		t.Fatal("the unlisted segment became the active one")
+	}
+	offset, err := wal.WriteLog("t", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 4 {
+		t.Fatalf("next write got offset %d, want 4", offset)
+	}
+}
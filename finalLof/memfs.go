@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ** a fileSystem held in memory, for tests that should not touch the disk
+// ** files opened before a Remove or a Rename over them keep their contents,
+// ** like they do on unix, and nothing survives the process
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+	locks map[string]bool
+}
+
+type memNode struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newMemFS() *memFS {
+	return &memFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]bool{".": true, string(filepath.Separator): true},
+		locks: make(map[string]bool),
+	}
+}
+
+func memError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (storageFile, error) {
+	path := filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirs[path] {
+		return nil, memError("open", name, errors.New("is a directory"))
+	}
+	node, ok := m.files[path]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, memError("open", name, fs.ErrNotExist)
+	case !ok && !m.dirs[filepath.Dir(path)]:
+		return nil, memError("open", name, fs.ErrNotExist)
+	case !ok:
+		node = &memNode{modTime: time.Now()}
+		m.files[path] = node
+	case flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memError("open", name, fs.ErrExist)
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{fs: m, node: node, name: name, flag: flag}, nil
+}
+
+func (m *memFS) Remove(name string) error {
+	path := filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[path]; ok {
+		delete(m.files, path)
+		return nil
+	}
+	if !m.dirs[path] {
+		return memError("remove", name, fs.ErrNotExist)
+	}
+	if len(m.children(path)) > 0 {
+		return memError("remove", name, errors.New("directory not empty"))
+	}
+	delete(m.dirs, path)
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	from, to := filepath.Clean(oldpath), filepath.Clean(newpath)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.files[from]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	if !m.dirs[filepath.Dir(to)] || m.dirs[to] {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrInvalid}
+	}
+	delete(m.files, from)
+	m.files[to] = node
+	return nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	path := filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if node, ok := m.files[path]; ok {
+		return memFileInfo{name: filepath.Base(path), size: int64(len(node.data)), modTime: node.modTime}, nil
+	}
+	if m.dirs[path] {
+		return memFileInfo{name: filepath.Base(path), dir: true}, nil
+	}
+	return nil, memError("stat", name, fs.ErrNotExist)
+}
+
+func (m *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	path := filepath.Clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirs[path] {
+		return nil, memError("open", name, fs.ErrNotExist)
+	}
+	var entries []os.DirEntry
+	for _, child := range m.children(path) {
+		info := memFileInfo{name: filepath.Base(child), dir: m.dirs[child]}
+		if node, ok := m.files[child]; ok {
+			info.size, info.modTime = int64(len(node.data)), node.modTime
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// ** paths of the files and directories directly inside dir
+// ** must be called with the mutex held
+func (m *memFS) children(dir string) []string {
+	var children []string
+	for path := range m.files {
+		if filepath.Dir(path) == dir {
+			children = append(children, path)
+		}
+	}
+	for path := range m.dirs {
+		if path != dir && filepath.Dir(path) == dir {
+			children = append(children, path)
+		}
+	}
+	return children
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	path = filepath.Clean(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for !m.dirs[path] {
+		if _, ok := m.files[path]; ok {
+			return memError("mkdir", path, errors.New("not a directory"))
+		}
+		m.dirs[path] = true
+		path = filepath.Dir(path)
+	}
+	return nil
+}
+
+func (m *memFS) Chtimes(name string, atime, mtime time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	node, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return memError("chtimes", name, fs.ErrNotExist)
+	}
+	node.modTime = mtime
+	return nil
+}
+
+func (m *memFS) SyncDir(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirs[filepath.Clean(path)] {
+		return memError("open", path, fs.ErrNotExist)
+	}
+	return nil
+}
+
+func (m *memFS) Lock(directory string) (io.Closer, error) {
+	path := filepath.Clean(directory)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks[path] {
+		return nil, ErrLocked
+	}
+	m.locks[path] = true
+	return &memLock{fs: m, path: path}, nil
+}
+
+type memLock struct {
+	fs   *memFS
+	path string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.path)
+		l.fs.mu.Unlock()
+	})
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+func (i memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0666
+}
+
+// ** an open handle on a memFS file, with its own position like an *os.File
+type memFile struct {
+	fs       *memFS
+	node     *memNode
+	name     string
+	flag     int
+	position int64
+	closed   bool
+}
+
+func (f *memFile) writable() bool {
+	return f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.position >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.position:])
+	f.position += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.position = int64(len(f.node.data))
+	}
+	n, err := f.writeAt(p, f.position)
+	f.position += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, offset int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		return 0, memError("writeat", f.name, errors.New("invalid use of WriteAt on file opened with O_APPEND"))
+	}
+	return f.writeAt(p, offset)
+}
+
+// ** must be called with the mutex held
+func (f *memFile) writeAt(p []byte, offset int64) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.writable() {
+		return 0, memError("write", f.name, fs.ErrPermission)
+	}
+	if end := offset + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.data = append(f.node.data, make([]byte, end-int64(len(f.node.data)))...)
+	}
+	copy(f.node.data[offset:], p)
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.position
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, memError("seek", f.name, fs.ErrInvalid)
+	}
+	f.position = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	if !f.writable() {
+		return memError("truncate", f.name, fs.ErrPermission)
+	}
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		f.node.data = append(f.node.data, make([]byte, size-int64(len(f.node.data)))...)
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	return memFileInfo{name: filepath.Base(f.name), size: int64(len(f.node.data)), modTime: f.node.modTime}, nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
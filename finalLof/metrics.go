@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ** upper bounds in seconds of the fsync latency histogram buckets
+var fsyncBuckets = []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// ** counters updated on the write path, safe to read without the wal mutex
+type walMetrics struct {
+	started         time.Time
+	writes          atomic.Uint64
+	bytesWritten    atomic.Uint64
+	rotations       atomic.Uint64
+	errors          atomic.Uint64
+	compacted       atomic.Uint64 // ** entries dropped by compaction
+	vacuumed        atomic.Uint64 // ** segments merged away by vacuum
+	purged          atomic.Uint64 // ** entries removed by PurgeTopic
+	hookPanics      atomic.Uint64
+	lastSync        atomic.Int64 // ** unix nanoseconds of the last successful fsync
+	scrubRuns       atomic.Uint64
+	corruptSegments atomic.Int64 // ** closed segments the last scrub found corrupt
+	lastScrub       atomic.Int64 // ** unix nanoseconds of the last finished scrub
+
+	fsyncMu      sync.Mutex
+	fsyncCounts  []uint64 // ** per bucket, not cumulative
+	fsyncCount   uint64
+	fsyncSeconds float64
+}
+
+func newWALMetrics() *walMetrics {
+	return &walMetrics{
+		started:     time.Now(),
+		fsyncCounts: make([]uint64, len(fsyncBuckets)+1),
+	}
+}
+
+func (m *walMetrics) observeFsync(elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	bucket := len(fsyncBuckets)
+	for i, bound := range fsyncBuckets {
+		if seconds <= bound {
+			bucket = i
+			break
+		}
+	}
+	m.fsyncMu.Lock()
+	m.fsyncCounts[bucket]++
+	m.fsyncCount++
+	m.fsyncSeconds += seconds
+	m.fsyncMu.Unlock()
+	m.lastSync.Store(time.Now().UnixNano())
+}
+
+// ** meant to be deferred with a pointer to a named error result
+func (m *walMetrics) countError(err *error) {
+	if *err != nil {
+		m.errors.Add(1)
+	}
+}
+
+// ** fsync latency distribution, counts are cumulative like a prometheus histogram
+type FsyncHistogram struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Count   uint64    `json:"count"`
+	Sum     float64   `json:"sum_seconds"`
+}
+
+// ** point in time view of the wal for embedded users and the metrics endpoint
+type Stats struct {
+	Writes          uint64         `json:"writes"`
+	WritesPerSecond float64        `json:"writes_per_second"` // ** averaged since open
+	BytesWritten    uint64         `json:"bytes_written"`
+	Rotations       uint64         `json:"rotations"`
+	Errors          uint64         `json:"errors"`
+	Compacted       uint64         `json:"compacted"`
+	Vacuumed        uint64         `json:"vacuumed"`
+	Purged          uint64         `json:"purged"`
+	HookPanics      uint64         `json:"hook_panics"`
+	CurrentSegment  int            `json:"current_segment"`
+	SegmentSize     int64          `json:"segment_size"`
+	TotalSegments   int            `json:"total_segments"`
+	TotalBytes      int64          `json:"total_bytes"`
+	LastOffset      int64          `json:"last_offset"` // ** 0 while the log is empty
+	NextOffset      int64          `json:"next_offset"`
+	LastSync        time.Time      `json:"last_sync"` // ** zero if nothing was synced yet
+	ScrubRuns       uint64         `json:"scrub_runs"`
+	CorruptSegments int64          `json:"corrupt_segments"` // ** found by the last scrub
+	LastScrub       time.Time      `json:"last_scrub"`       // ** zero if no scrub finished yet
+	Uptime          time.Duration  `json:"uptime"`
+	FsyncLatency    FsyncHistogram `json:"fsync_latency"`
+}
+
+func (w *WAL) Stats() (Stats, error) {
+	w.mu.Lock()
+	currentSegment := w.currentSegmentIndex
+	segmentSize := w.segmentSize
+	next := w.offset
+	indexes, totalBytes, err := w.diskUsage()
+	w.mu.Unlock()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	m := w.metrics
+	stats := Stats{
+		Writes:          m.writes.Load(),
+		BytesWritten:    m.bytesWritten.Load(),
+		Rotations:       m.rotations.Load(),
+		Errors:          m.errors.Load(),
+		Compacted:       m.compacted.Load(),
+		Vacuumed:        m.vacuumed.Load(),
+		Purged:          m.purged.Load(),
+		HookPanics:      m.hookPanics.Load(),
+		ScrubRuns:       m.scrubRuns.Load(),
+		CorruptSegments: m.corruptSegments.Load(),
+		CurrentSegment:  currentSegment,
+		SegmentSize:     segmentSize,
+		TotalSegments:   len(indexes),
+		TotalBytes:      totalBytes,
+		LastOffset:      next - 1,
+		NextOffset:      next,
+		Uptime:          time.Since(m.started),
+	}
+	if lastSync := m.lastSync.Load(); lastSync != 0 {
+		stats.LastSync = time.Unix(0, lastSync)
+	}
+	if lastScrub := m.lastScrub.Load(); lastScrub != 0 {
+		stats.LastScrub = time.Unix(0, lastScrub)
+	}
+	if elapsed := stats.Uptime.Seconds(); elapsed > 0 {
+		stats.WritesPerSecond = float64(stats.Writes) / elapsed
+	}
+
+	m.fsyncMu.Lock()
+	histogram := FsyncHistogram{
+		Buckets: fsyncBuckets,
+		Counts:  make([]uint64, len(fsyncBuckets)),
+		Count:   m.fsyncCount,
+		Sum:     m.fsyncSeconds,
+	}
+	var cumulative uint64
+	for i := range fsyncBuckets {
+		cumulative += m.fsyncCounts[i]
+		histogram.Counts[i] = cumulative
+	}
+	m.fsyncMu.Unlock()
+	stats.FsyncLatency = histogram
+	return stats, nil
+}
+
+// ** segments on disk and their combined size
+// ** closed segments come from the segment manager, only the active one,
+// ** which grows with every write, is looked at on disk
+// ** must be called with the mutex held
+func (w *WAL) diskUsage() ([]int, int64, error) {
+	var indexes []int
+	var total int64
+	for _, segment := range w.segments.all() {
+		indexes = append(indexes, segment.index)
+		if segment.index != w.currentSegmentIndex {
+			total += segment.size
+		}
+	}
+	info, err := w.fs.Stat(segmentFileName(w.directory, w.currentSegmentIndex))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get file info: %w", err)
+	}
+	return indexes, total + info.Size(), nil
+}
+
+// ** render stats in the prometheus text exposition format
+func writePrometheus(out io.Writer, stats Stats) {
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	metric("wal_writes_total", "counter", "Entries written to the log.", stats.Writes)
+	metric("wal_bytes_written_total", "counter", "Bytes appended to segment files.", stats.BytesWritten)
+	metric("wal_rotations_total", "counter", "Segment rotations.", stats.Rotations)
+	metric("wal_errors_total", "counter", "Failed write, batch and sync calls.", stats.Errors)
+	metric("wal_compacted_entries_total", "counter", "Superseded entries and tombstones removed by compaction.", stats.Compacted)
+	metric("wal_vacuumed_segments_total", "counter", "Small segments merged into a neighbour by vacuum.", stats.Vacuumed)
+	metric("wal_purged_entries_total", "counter", "Entries of purged topics removed from the log.", stats.Purged)
+	metric("wal_hook_panics_total", "counter", "Panics recovered from commit hooks.", stats.HookPanics)
+	metric("wal_current_segment_index", "gauge", "Index of the active segment.", stats.CurrentSegment)
+	metric("wal_segments", "gauge", "Segments on disk.", stats.TotalSegments)
+	metric("wal_scrub_runs_total", "counter", "Background verifications of the closed segments.", stats.ScrubRuns)
+	metric("wal_corrupt_segments", "gauge", "Closed segments the last scrub found corrupt.", stats.CorruptSegments)
+
+	histogram := stats.FsyncLatency
+	fmt.Fprintf(out, "# HELP wal_fsync_duration_seconds Latency of segment fsyncs.\n# TYPE wal_fsync_duration_seconds histogram\n")
+	for i, bound := range histogram.Buckets {
+		fmt.Fprintf(out, "wal_fsync_duration_seconds_bucket{le=\"%g\"} %d\n", bound, histogram.Counts[i])
+	}
+	fmt.Fprintf(out, "wal_fsync_duration_seconds_bucket{le=\"+Inf\"} %d\n", histogram.Count)
+	fmt.Fprintf(out, "wal_fsync_duration_seconds_sum %g\n", histogram.Sum)
+	fmt.Fprintf(out, "wal_fsync_duration_seconds_count %d\n", histogram.Count)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ** file in a namespace's directory holding its NamespaceConfig
+const namespaceConfigFileName = "namespace.json"
+
+var (
+	ErrNamespaceNotFound = errors.New("namespace not found")
+	// ** names end up as directory names, so they are kept to a safe set
+	namespaceName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,63}$`)
+)
+
+// ** settings and quotas of one namespace, anything left empty falls back
+// ** to the server's own
+type NamespaceConfig struct {
+	// ** always, manual or an interval such as 10ms
+	Sync string `json:"sync,omitempty"`
+	// ** quota on the bytes its segments may take, writes over it get 507
+	MaxSize int64 `json:"max_size,omitempty"`
+	// ** largest encoded entry in bytes, -1 for no limit
+	MaxEntrySize int64 `json:"max_entry_size,omitempty"`
+	// ** closed segments beyond these are deleted
+	RetentionBytes int64  `json:"retention_bytes,omitempty"`
+	RetentionAge   string `json:"retention_age,omitempty"`
+	// ** write requests per second for the whole namespace, no limit if zero
+	RateLimit float64 `json:"rate_limit,omitempty"`
+}
+
+// ** options of a wal for the namespace, based on the server's
+func (c NamespaceConfig) options(base Options) (Options, error) {
+	opts := base
+	if c.Sync != "" {
+		policy, err := parseSyncPolicy(c.Sync)
+		if err != nil {
+			return Options{}, err
+		}
+		opts.SyncPolicy = policy
+	}
+	if c.MaxSize < 0 || c.RetentionBytes < 0 || c.RateLimit < 0 {
+		return Options{}, errors.New("max_size, retention_bytes and rate_limit must not be negative")
+	}
+	if c.MaxSize > 0 {
+		opts.MaxSize = c.MaxSize
+	}
+	if c.MaxEntrySize != 0 {
+		opts.MaxEntrySize = c.MaxEntrySize
+	}
+	if c.RetentionBytes > 0 {
+		opts.Retention.MaxBytes = c.RetentionBytes
+	}
+	if c.RetentionAge != "" {
+		age, err := time.ParseDuration(c.RetentionAge)
+		if err != nil || age <= 0 {
+			return Options{}, fmt.Errorf("invalid retention age %q", c.RetentionAge)
+		}
+		opts.Retention.MaxAge = age
+	}
+	return opts, nil
+}
+
+// ** one server hosting the logs of several applications
+// ** every namespace is a wal of its own under wal_data/<namespace>/, opened
+// ** on first use and kept open until the server shuts down or it is deleted
+type Namespaces struct {
+	directory string
+	opts      Options
+	mu        sync.Mutex
+	open      map[string]*namespace
+	closed    bool
+}
+
+type namespace struct {
+	wal     *WAL
+	config  NamespaceConfig
+	limiter *rateLimiter
+}
+
+// ** namespaces under opts.Directory, each opened with opts and its own config
+func NewNamespaces(opts Options) *Namespaces {
+	if opts.Directory == "" {
+		opts.Directory = walDir
+	}
+	if opts.fs == nil {
+		opts.fs = osFS{}
+	}
+	return &Namespaces{directory: opts.Directory, opts: opts, open: make(map[string]*namespace)}
+}
+
+func checkNamespaceName(name string) error {
+	if !namespaceName.MatchString(name) {
+		return fmt.Errorf("invalid namespace name %q", name)
+	}
+	return nil
+}
+
+func (n *Namespaces) configPath(name string) string {
+	return filepath.Join(n.directory, name, namespaceConfigFileName)
+}
+
+// ** config of a namespace on disk, ErrNamespaceNotFound if it was never created
+func (n *Namespaces) readConfig(name string) (NamespaceConfig, error) {
+	var config NamespaceConfig
+	data, err := readFile(n.opts.fs, n.configPath(name))
+	if os.IsNotExist(err) {
+		return config, ErrNamespaceNotFound
+	}
+	if err != nil {
+		return config, fmt.Errorf("failed to read namespace config: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to decode namespace config: %w", err)
+	}
+	return config, nil
+}
+
+func (n *Namespaces) writeConfig(name string, config NamespaceConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := n.opts.fs.MkdirAll(filepath.Join(n.directory, name), 0755); err != nil {
+		return fmt.Errorf("failed to create namespace directory: %w", err)
+	}
+	if err := writeFileAtomic(n.opts.fs, n.configPath(name), data); err != nil {
+		return fmt.Errorf("failed to write namespace config: %w", err)
+	}
+	return nil
+}
+
+// ** open the wal of a namespace with its config, must be called with the mutex held
+func (n *Namespaces) openLocked(name string, config NamespaceConfig) (*namespace, error) {
+	opts, err := config.options(n.opts)
+	if err != nil {
+		return nil, err
+	}
+	opts.Directory = filepath.Join(n.directory, name)
+	if opts.Archiver != nil {
+		opts.Archiver = &prefixedArchiver{Archiver: n.opts.Archiver, prefix: name + "/"}
+	}
+	wal, err := newWriteAheadLOG(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open namespace %q: %w", name, err)
+	}
+	ns := &namespace{
+		wal:     wal,
+		config:  config,
+		limiter: newRateLimiter(RateLimit{Rate: config.RateLimit, Global: true}),
+	}
+	n.open[name] = ns
+	return ns, nil
+}
+
+// ** the open namespace called name, with create a namespace that does not
+// ** exist yet is created with the default config, ErrNamespaceNotFound otherwise
+func (n *Namespaces) get(name string, create bool) (*namespace, error) {
+	if err := checkNamespaceName(name); err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrClosed
+	}
+	if ns, ok := n.open[name]; ok {
+		return ns, nil
+	}
+	config, err := n.readConfig(name)
+	if errors.Is(err, ErrNamespaceNotFound) && create {
+		err = n.writeConfig(name, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n.openLocked(name, config)
+}
+
+// ** the wal of a namespace, created with the default config on first use
+func (n *Namespaces) WAL(name string) (*WAL, error) {
+	ns, err := n.get(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return ns.wal, nil
+}
+
+// ** create a namespace or change its config
+// ** an open namespace is reopened with the new config, requests that
+// ** still hold the old wal fail with ErrClosed
+func (n *Namespaces) Configure(name string, config NamespaceConfig) error {
+	if err := checkNamespaceName(name); err != nil {
+		return err
+	}
+	if _, err := config.options(n.opts); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return ErrClosed
+	}
+	if ns, ok := n.open[name]; ok {
+		delete(n.open, name)
+		if err := ns.wal.Close(); err != nil {
+			return err
+		}
+	}
+	if err := n.writeConfig(name, config); err != nil {
+		return err
+	}
+	_, err := n.openLocked(name, config)
+	return err
+}
+
+// ** names of every namespace on disk, sorted
+func (n *Namespaces) List() ([]string, error) {
+	entries, err := n.opts.fs.ReadDir(n.directory)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wal directory: %w", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() || checkNamespaceName(entry.Name()) != nil {
+			continue
+		}
+		if _, err := n.opts.fs.Stat(n.configPath(entry.Name())); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ** close a namespace and delete everything it holds
+// ** the config goes first, so a delete cut short leaves no namespace behind
+func (n *Namespaces) Delete(name string) error {
+	if err := checkNamespaceName(name); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return ErrClosed
+	}
+	if ns, ok := n.open[name]; ok {
+		delete(n.open, name)
+		if err := ns.wal.Close(); err != nil {
+			return err
+		}
+	}
+	err := n.opts.fs.Remove(n.configPath(name))
+	if os.IsNotExist(err) {
+		return ErrNamespaceNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete namespace config: %w", err)
+	}
+	return removeDirectory(n.opts.fs, filepath.Join(n.directory, name))
+}
+
+// ** remove a directory of plain files and the directory itself
+func removeDirectory(fs fileSystem, directory string) error {
+	entries, err := fs.ReadDir(directory)
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+	for _, entry := range entries {
+		if err := fs.Remove(filepath.Join(directory, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", entry.Name(), err)
+		}
+	}
+	if err := fs.Remove(directory); err != nil {
+		return fmt.Errorf("failed to remove directory: %w", err)
+	}
+	return nil
+}
+
+// ** close every open namespace, the first error is returned after trying all
+func (n *Namespaces) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil
+	}
+	n.closed = true
+	var firstErr error
+	for name, ns := range n.open {
+		if err := ns.wal.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(n.open, name)
+	}
+	return firstErr
+}
+
+// ** endpoints of the single wal server served per namespace under
+// ** /ns/{namespace}/..., writes go through the rate limiters
+var namespaceRoutes = map[string]struct {
+	handle func(*WAL, http.ResponseWriter, *http.Request)
+	write  bool
+}{
+	"write":       {(*WAL).ServerHTTP, true},
+	"write/batch": {(*WAL).handleWriteBatch, true},
+	"read":        {(*WAL).handleRead, false},
+	"stream":      {(*WAL).handleStream, false},
+	"status":      {(*WAL).handleStatus, false},
+	"commit":      {(*WAL).handleCommit, false},
+	"offset":      {(*WAL).handleOffset, false},
+}
+
+// ** handler for /ns and everything below it
+// ** GET /ns lists the namespaces, GET, PUT and DELETE /ns/{namespace} show,
+// ** configure and delete one, and /ns/{namespace}/write and the other wal
+// ** endpoints work on its wal, creating it on the first write
+// ** writes wraps a write endpoint with the server's per client limit, applied
+// ** before the namespace's own, and turns it away while the server follows
+func (n *Namespaces) handler(writes func(http.HandlerFunc) http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(request.URL.Path, "/ns"), "/")
+		if path == "" {
+			n.handleList(writer, request)
+			return
+		}
+		parts := strings.SplitN(path, "/", 2)
+		name := parts[0]
+		if checkNamespaceName(name) != nil {
+			http.Error(writer, "Invalid namespace name", http.StatusBadRequest)
+			return
+		}
+		if len(parts) == 1 {
+			n.handleNamespace(writer, request, name)
+			return
+		}
+		route, ok := namespaceRoutes[parts[1]]
+		if !ok {
+			http.NotFound(writer, request)
+			return
+		}
+		// ** the namespace is looked up inside, so a write that is turned away
+		// ** does not create it
+		handle := func(writer http.ResponseWriter, request *http.Request) {
+			ns, err := n.get(name, route.write)
+			if err != nil {
+				writeNamespaceError(writer, err)
+				return
+			}
+			serve := func(writer http.ResponseWriter, request *http.Request) {
+				route.handle(ns.wal, writer, request)
+			}
+			if route.write {
+				serve = ns.limiter.wrap(serve)
+			}
+			serve(writer, request)
+		}
+		if route.write {
+			handle = writes(handle)
+		}
+		handle(writer, request)
+	}
+}
+
+func (n *Namespaces) handleList(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	names, err := n.List()
+	if err != nil {
+		http.Error(writer, "Failed to list namespaces", http.StatusInternalServerError)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{"namespaces": names})
+}
+
+func (n *Namespaces) handleNamespace(writer http.ResponseWriter, request *http.Request, name string) {
+	switch request.Method {
+	case http.MethodGet:
+		config, err := n.readConfig(name)
+		if err != nil {
+			writeNamespaceError(writer, err)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]interface{}{"name": name, "config": config})
+	case http.MethodPut:
+		var config NamespaceConfig
+		decoder := json.NewDecoder(request.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			writeDecodeError(writer, err)
+			return
+		}
+		if _, err := config.options(n.opts); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := n.Configure(name, config); err != nil {
+			writeNamespaceError(writer, err)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]interface{}{"name": name, "config": config})
+	case http.MethodDelete:
+		if err := n.Delete(name); err != nil {
+			writeNamespaceError(writer, err)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeNamespaceError(writer http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNamespaceNotFound):
+		http.Error(writer, "Namespace not found", http.StatusNotFound)
+	case errors.Is(err, ErrClosed):
+		http.Error(writer, "Server is shutting down", http.StatusServiceUnavailable)
+	default:
+		http.Error(writer, "Namespace request failed", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,96 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func init() {
+	newServerTracer = newOTLPTracer
+}
+
+// ** a Tracer backed by OpenTelemetry, for embedders that set up their own
+// ** provider, e.g. NewOTelTracer(otel.Tracer("wal"), otel.GetTextMapPropagator())
+func NewOTelTracer(tracer trace.Tracer, propagator propagation.TextMapPropagator) Tracer {
+	return otelTracer{tracer: tracer, propagator: propagator}
+}
+
+type otelTracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func (t otelTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, otelSpan{span}
+}
+
+func (t otelTracer) Extract(ctx context.Context, header func(key string) string) context.Context {
+	return t.propagator.Extract(ctx, headerCarrier(header))
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttribute(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+func (s otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+// ** a propagation.TextMapCarrier that can only be read, extracting is all
+// ** the servers do
+type headerCarrier func(key string) string
+
+func (c headerCarrier) Get(key string) string { return c(key) }
+func (c headerCarrier) Set(key, value string) {}
+func (c headerCarrier) Keys() []string        { return nil }
+
+// ** the tracer of the server binary, batching spans to an OTLP/HTTP
+// ** collector at endpoint, host:port like localhost:4318
+func newOTLPTracer(endpoint string) (Tracer, func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpoint(endpoint),
+		otlptracehttp.WithInsecure(),
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "go-wal"))),
+	)
+	propagator := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+	return NewOTelTracer(provider.Tracer("go-wal"), propagator), provider.Shutdown, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// ** buffers that grew past this are dropped instead of pooled, so a single
+// ** huge entry does not pin its memory for the life of the process
+const maxPooledBuffer = 256 << 10
+
+// ** everything encoding one record needs, reused between writes so the
+// ** hot path allocates next to nothing of its own
+// ** each json encoder writes into the buffer it was made for, the disk
+// ** record and its checksum live here so taking their address is free
+type recordScratch struct {
+	payload        bytes.Buffer
+	payloadEncoder *json.Encoder
+	line           bytes.Buffer
+	lineEncoder    *json.Encoder
+	disk           diskRecord
+	crc            uint32
+	checksum       []byte // ** what the crc covers before the payload
+	sealed         []byte // ** nonce || ciphertext of an encrypted record
+	encoded        []byte // ** its base64 line
+}
+
+var recordScratches = sync.Pool{New: func() interface{} {
+	scratch := &recordScratch{}
+	scratch.payloadEncoder = json.NewEncoder(&scratch.payload)
+	scratch.lineEncoder = json.NewEncoder(&scratch.line)
+	// ** the payload goes into the line as it was checksummed, escaping <, >
+	// ** and & in a raw JSON payload here would break its checksum
+	scratch.lineEncoder.SetEscapeHTML(false)
+	return scratch
+}}
+
+func getRecordScratch() *recordScratch {
+	return recordScratches.Get().(*recordScratch)
+}
+
+func putRecordScratch(scratch *recordScratch) {
+	if scratch.payload.Cap() > maxPooledBuffer || scratch.line.Cap() > maxPooledBuffer || cap(scratch.checksum) > maxPooledBuffer ||
+		cap(scratch.sealed) > maxPooledBuffer || cap(scratch.encoded) > maxPooledBuffer {
+		return
+	}
+	// ** let go of the strings of the last record
+	scratch.disk = diskRecord{}
+	recordScratches.Put(scratch)
+}
+
+// ** buffers a whole batch is encoded into before it is written
+var batchBuffers = sync.Pool{New: func() interface{} {
+	return new(bytes.Buffer)
+}}
+
+func getBatchBuffer() *bytes.Buffer {
+	buf := batchBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBatchBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		batchBuffers.Put(buf)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// ** writes to the active segment at its logical end instead of appending
+// ** a preallocated segment is already its full size on disk, so the
+// ** end of what was written has to be tracked here
+type segmentWriter struct {
+	file storageFile
+	end  int64
+}
+
+func (s *segmentWriter) Write(p []byte) (int, error) {
+	n, err := s.file.WriteAt(p, s.end)
+	s.end += int64(n)
+	return n, err
+}
+
+// ** open a segment for appending, with preallocate set the file is grown to
+// ** segmentSize up front so appends neither change its size nor its extents
+// ** the segment must not have a preallocated tail, recovery and
+// ** closeSegmentFile both cut it off
+func openActiveSegment(fs fileSystem, path string, preallocate bool, segmentSize int64) (storageFile, *segmentWriter, error) {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open segment file: %w", err)
+	}
+	size, err := calculateOffset(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to calculate offset: %w", err)
+	}
+	if preallocate && int64(size) < segmentSize {
+		if err := preallocateSegment(file, segmentSize); err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to preallocate segment: %w", err)
+		}
+	}
+	return file, &segmentWriter{file: file, end: int64(size)}, nil
+}
+
+// ** fallocate needs a real file, any other one is grown the portable way
+func preallocateSegment(file storageFile, size int64) error {
+	if osFile, ok := file.(*os.File); ok {
+		return preallocateFile(osFile, size)
+	}
+	return file.Truncate(size)
+}
+
+// ** fsync the active segment, a preallocated one only needs its data synced
+// ** since its size does not change
+func (w *WAL) syncSegment() error {
+	osFile, ok := w.currentSegment.(*os.File)
+	if !ok {
+		return w.currentSegment.Sync()
+	}
+	if w.fastSync {
+		return cacheSync(osFile)
+	}
+	if w.preallocate {
+		return syncData(osFile)
+	}
+	return osFile.Sync()
+}
+
+// ** close the active segment, cutting off the preallocated space after the
+// ** last record so closed segments end on a complete record like before
+// ** must be called with the mutex held and the writer flushed
+func (w *WAL) closeSegmentFile() error {
+	if w.preallocate {
+		if err := w.currentSegment.Truncate(w.segmentWriter.end); err != nil {
+			w.currentSegment.Close()
+			return fmt.Errorf("failed to trim segment file: %w", err)
+		}
+	}
+	if err := w.currentSegment.Close(); err != nil {
+		return fmt.Errorf("failed to close segment file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ** reserve the blocks of a segment with fallocate, falling back to growing
+// ** the file on filesystems that do not support it
+func preallocateFile(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return file.Truncate(size)
+	}
+	return err
+}
+
+// ** fdatasync skips the inode flush when only data changed
+func syncData(file *os.File) error {
+	return syscall.Fdatasync(int(file.Fd()))
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// ** no portable fallocate, growing the file still keeps its size fixed
+func preallocateFile(file *os.File, size int64) error {
+	return file.Truncate(size)
+}
+
+func syncData(file *os.File) error {
+	return file.Sync()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ** remove every entry of a topic, for a topic that was decommissioned
+// ** the active segment is rotated out first if it holds the topic, then
+// ** every closed segment that may hold it is rewritten without its entries
+// ** offsets of other topics stay the same, the purged ones become gaps
+// ** segments only kept in the archive are not downloaded and rewritten,
+// ** the catalog records the purge instead and reads skip the topic there,
+// ** a local segment that was uploaded already is uploaded again once it
+// ** is removed, replacing the old copy
+// ** returns how many entries were removed from local segments
+func (w *WAL) PurgeTopic(topic string) (purged int, err error) {
+	defer w.metrics.countError(&err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if err := w.purgeArchived(topic); err != nil {
+		return 0, err
+	}
+	if w.topics.mayContain(topic) {
+		if err := w.rotateSegment(); err != nil {
+			return 0, fmt.Errorf("failed to rotate segment: %w", err)
+		}
+	}
+
+	for _, index := range w.segments.indexes() {
+		if index >= w.currentSegmentIndex {
+			break
+		}
+		filter, err := loadTopicFilter(w.fs, w.directory, index, w.encryption)
+		if err != nil {
+			return purged, err
+		}
+		if !filter.mayContain(topic) {
+			continue
+		}
+		dropped, err := w.rewriteSegment(index, func(record logRecord, _ time.Time) bool {
+			return record.Topic == topic
+		})
+		purged += dropped
+		w.metrics.purged.Add(uint64(dropped))
+		if err != nil {
+			return purged, fmt.Errorf("failed to purge segment %d: %w", index, err)
+		}
+	}
+	return purged, w.refreshUsage()
+}
+
+// ** handle DELETE /topic/{name}, purging the topic
+func (w *WAL) handlePurgeTopic(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodDelete {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := strings.TrimPrefix(request.URL.Path, "/topic/")
+	if topic == "" {
+		http.Error(writer, "Missing topic", http.StatusBadRequest)
+		return
+	}
+	purged, err := w.PurgeTopic(topic)
+	if errors.Is(err, ErrClosed) {
+		http.Error(writer, "WAL is closed", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(writer, "Failed to purge topic", http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"topic":  topic,
+		"purged": purged,
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"testing"
+)
+
+// ** keeps uploads in memory
+type memArchiver struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (a *memArchiver) Upload(ctx context.Context, name string, data io.Reader) error {
+	body, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.objects[name] = body
+	return nil
+}
+
+func (a *memArchiver) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	body, ok := a.objects[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(body)), nil
+}
+
+// ** a purged topic must not come back from segments only the archive holds
+func TestPurgeTopicHidesArchivedEntries(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{Directory: dir, Archiver: &memArchiver{objects: make(map[string][]byte)}}
+	wal, err := newWriteAheadLOG(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last int64
+	for i := 0; i < 20; i++ {
+		topic := "kept"
+		if i%2 == 0 {
+			topic = "purged"
+		}
+		if last, err = wal.WriteLog(topic, map[string]interface{}{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.TruncateBefore(last); err != nil {
+		t.Fatal(err)
+	}
+	if len(wal.archive) == 0 {
+		t.Fatal("no segment was moved to the archive")
+	}
+	if _, err := wal.PurgeTopic("purged"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ** reopened, so the purge has to come from the catalog on disk
+	wal, err = newWriteAheadLOG(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadFrom(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 {
+		t.Fatalf("got %d entries, want the 10 of the kept topic", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Topic != "kept" {
+			t.Fatalf("entry %d of topic %q survived the purge", entry.Offset, entry.Topic)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+//go:build raft
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	raftTopic          = "raft"
+	raftStableFileName = "raft.stable"
+)
+
+// ** raft compares the message, like raft-boltdb does
+var errRaftKeyNotFound = errors.New("not found")
+
+// ** a raft.Log as stored in the payload of a wal entry
+// ** the log index is not stored, it is the offset of the entry
+type raftRecord struct {
+	Term       uint64       `json:"term"`
+	Type       raft.LogType `json:"type"`
+	Data       []byte       `json:"data,omitempty"`
+	Extensions []byte       `json:"extensions,omitempty"`
+	AppendedAt time.Time    `json:"appended_at"`
+}
+
+// ** contents of the stable store file
+type raftStable struct {
+	// ** logs below this index were deleted even if their segment is still on disk
+	FirstIndex uint64            `json:"first_index"`
+	Values     map[string][]byte `json:"values"`
+}
+
+// ** lets hashicorp/raft keep its log in a WAL
+// ** log indexes are wal offsets, so nothing else may write to the wal
+// ** the stable store lives in a small file next to the segments
+type RaftStore struct {
+	wal *WAL
+
+	mu     sync.Mutex
+	path   string
+	stable raftStable
+}
+
+var (
+	_ raft.LogStore    = (*RaftStore)(nil)
+	_ raft.StableStore = (*RaftStore)(nil)
+)
+
+func NewRaftStore(wal *WAL) (*RaftStore, error) {
+	store := &RaftStore{
+		wal:    wal,
+		path:   filepath.Join(wal.directory, raftStableFileName),
+		stable: raftStable{Values: make(map[string][]byte)},
+	}
+	data, err := readFile(wal.fs, store.path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read raft stable store: %w", err)
+	}
+	if err := json.Unmarshal(data, &store.stable); err != nil {
+		return nil, fmt.Errorf("failed to decode raft stable store: %w", err)
+	}
+	if store.stable.Values == nil {
+		store.stable.Values = make(map[string][]byte)
+	}
+	return store, nil
+}
+
+// ** must be called with mu held
+func (s *RaftStore) saveStable() error {
+	data, err := json.Marshal(s.stable)
+	if err != nil {
+		return fmt.Errorf("failed to encode raft stable store: %w", err)
+	}
+	if err := writeFileAtomic(s.wal.fs, s.path, data); err != nil {
+		return fmt.Errorf("failed to write raft stable store: %w", err)
+	}
+	return nil
+}
+
+func (s *RaftStore) firstIndexFloor() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stable.FirstIndex
+}
+
+func (s *RaftStore) FirstIndex() (uint64, error) {
+	first, last, ok, err := s.wal.offsetRange()
+	if err != nil || !ok {
+		return 0, err
+	}
+	floor := s.firstIndexFloor()
+	if floor > uint64(last) {
+		return 0, nil
+	}
+	if floor > uint64(first) {
+		return floor, nil
+	}
+	return uint64(first), nil
+}
+
+func (s *RaftStore) LastIndex() (uint64, error) {
+	_, last, ok, err := s.wal.offsetRange()
+	if err != nil || !ok || s.firstIndexFloor() > uint64(last) {
+		return 0, err
+	}
+	return uint64(last), nil
+}
+
+func (s *RaftStore) GetLog(index uint64, log *raft.Log) error {
+	if index < s.firstIndexFloor() {
+		return raft.ErrLogNotFound
+	}
+	entry, ok, err := s.wal.readAt(int64(index))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return raft.ErrLogNotFound
+	}
+	if entry.Topic != raftTopic {
+		return fmt.Errorf("entry %d is not a raft log", index)
+	}
+	// ** payloads come back as generic JSON values
+	data, err := json.Marshal(entry.Payload)
+	if err != nil {
+		return err
+	}
+	var record raftRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return fmt.Errorf("failed to decode raft log %d: %w", index, err)
+	}
+	*log = raft.Log{
+		Index:      index,
+		Term:       record.Term,
+		Type:       record.Type,
+		Data:       record.Data,
+		Extensions: record.Extensions,
+		AppendedAt: record.AppendedAt,
+	}
+	return nil
+}
+
+func (s *RaftStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// ** the logs are written as one wal batch, so they land atomically
+func (s *RaftStore) StoreLogs(logs []*raft.Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	entries := make([]LogEntry, len(logs))
+	for i, log := range logs {
+		if i > 0 && log.Index != logs[i-1].Index+1 {
+			return fmt.Errorf("raft logs are not contiguous: %d follows %d", log.Index, logs[i-1].Index)
+		}
+		entries[i] = LogEntry{
+			Topic: raftTopic,
+			Payload: raftRecord{
+				Term:       log.Term,
+				Type:       log.Type,
+				Data:       log.Data,
+				Extensions: log.Extensions,
+				AppendedAt: log.AppendedAt,
+			},
+		}
+	}
+
+	first := int64(logs[0].Index)
+	skipped, err := s.wal.writeBatchAt(first, entries)
+	if err != nil {
+		return err
+	}
+	if skipped {
+		// ** raft jumped ahead, e.g. after installing a snapshot, so the logs
+		// ** before the gap are no longer part of its log
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.stable.FirstIndex = logs[0].Index
+		return s.saveStable()
+	}
+	return nil
+}
+
+// ** raft only deletes a prefix after a snapshot or a suffix on conflicts
+func (s *RaftStore) DeleteRange(min, max uint64) error {
+	first, err := s.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := s.LastIndex()
+	if err != nil {
+		return err
+	}
+	switch {
+	case max >= last:
+		if min == 0 {
+			min = 1
+		}
+		return s.wal.TruncateAfter(int64(min) - 1)
+	case min <= first:
+		s.mu.Lock()
+		s.stable.FirstIndex = max + 1
+		err := s.saveStable()
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		// ** only whole segments go, the floor hides the rest
+		return s.wal.TruncateBefore(int64(max) + 1)
+	default:
+		return fmt.Errorf("cannot delete raft logs %d-%d from the middle of the log", min, max)
+	}
+}
+
+func (s *RaftStore) Set(key []byte, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stable.Values[string(key)] = append([]byte(nil), val...)
+	return s.saveStable()
+}
+
+func (s *RaftStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.stable.Values[string(key)]
+	if !ok {
+		return nil, errRaftKeyNotFound
+	}
+	return append([]byte(nil), val...), nil
+}
+
+func (s *RaftStore) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, []byte(fmt.Sprint(val)))
+}
+
+func (s *RaftStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	if _, err := fmt.Sscan(string(val), &n); err != nil {
+		return 0, fmt.Errorf("raft stable key %q is not a number: %w", key, err)
+	}
+	return n, nil
+}
+
+// ** offsets of the oldest and newest entry on disk, ok is false if there are none
+func (w *WAL) offsetRange() (first, last int64, ok bool, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	indexes := w.segments.indexes()
+	for _, index := range indexes {
+		first, ok, err = firstOffset(w.fs, segmentPath(w.fs, w.directory, index), w.encryption)
+		if err != nil || ok {
+			break
+		}
+	}
+	if err != nil || !ok {
+		return 0, 0, false, err
+	}
+	return first, w.offset - 1, true, nil
+}
+
+// ** write a batch whose first entry must get exactly offset
+// ** moving forward over a gap is allowed and reported, going back is not
+func (w *WAL) writeBatchAt(offset int64, entries []LogEntry) (skipped bool, err error) {
+	defer w.metrics.countError(&err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return false, ErrClosed
+	}
+	if offset < w.offset {
+		return false, fmt.Errorf("offset %d conflicts with the log, next offset is %d", offset, w.offset)
+	}
+	if offset > w.offset {
+		if err := w.advanceTo(offset); err != nil {
+			return false, err
+		}
+		skipped = true
+	}
+	return skipped, w.writeBatch(entries)
+}
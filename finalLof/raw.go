@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// ** bytes from WriteRaw, stored as they are instead of being marshalled
+type rawPayload []byte
+
+// ** LogEntry with the payload as the bytes that were written
+type RawEntry struct {
+	Offset    int64     `json:"offset"`
+	Topic     string    `json:"topic"`
+	Key       string    `json:"key,omitempty"`
+	Payload   []byte    `json:"payload"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ** append already serialized bytes without going through interface{}
+// ** JSON is stored verbatim as the payload, only compacted so the record
+// ** stays on one line, and reads like any other entry
+// ** anything else is kept as binary and read back as []byte, base64 is the
+// ** only way to fit it into a line of the segment
+func (w *WAL) WriteRaw(topic string, data []byte) (offset int64, err error) {
+	defer w.metrics.countError(&err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	return w.writeLog("", LogEntry{Topic: topic, Payload: rawPayload(data)})
+}
+
+// ** the stored form of a record's payload into scratch.payload, and
+// ** whether it is binary
+func marshalPayload(scratch *recordScratch, record logRecord) (bool, error) {
+	scratch.payload.Reset()
+	data, ok := record.Payload.(rawPayload)
+	if !ok && record.binary {
+		// ** a binary record read back and written again, by compaction
+		data, ok = record.Payload.([]byte)
+	}
+	if !ok {
+		return false, encodePayload(scratch, record.Payload)
+	}
+	if json.Valid(data) {
+		return false, json.Compact(&scratch.payload, data)
+	}
+	return true, encodePayload(scratch, []byte(data))
+}
+
+// ** json.Marshal of payload into scratch.payload, without Encode's newline
+func encodePayload(scratch *recordScratch, payload interface{}) error {
+	if err := scratch.payloadEncoder.Encode(payload); err != nil {
+		return err
+	}
+	scratch.payload.Truncate(scratch.payload.Len() - 1)
+	return nil
+}
+
+// ** entries from offset onwards with their payloads as stored, JSON ones
+// ** as their JSON text and binary ones as the bytes given to WriteRaw
+func (w *WAL) ReadRawFrom(offset int64, topics ...string) ([]RawEntry, error) {
+	return w.ReadRawFromContext(context.Background(), offset, topics...)
+}
+
+func (w *WAL) ReadRawFromContext(ctx context.Context, offset int64, topics ...string) ([]RawEntry, error) {
+	w.mu.Lock()
+	snap, err := w.snapshotFrom(offset, topics)
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+
+	var result []RawEntry
+	err = snap.scan(ctx, offset, topics, func(record logRecord) error {
+		result = append(result, RawEntry{
+			Offset:    record.entry().Offset,
+			Topic:     record.Topic,
+			Key:       record.Key,
+			Payload:   record.raw,
+			Timestamp: record.Timestamp,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
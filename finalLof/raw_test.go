@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// ** <, > and & must come back as written, json.Marshal would escape them
+// ** after the checksum was taken and the record would read as corrupt
+func TestWriteRawKeepsHTMLCharacters(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := newWriteAheadLOG(Options{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"html": "<b>a & b</b>", "cmp": "1 > 0"}`)
+	want := []byte(`{"html":"<b>a & b</b>","cmp":"1 > 0"}`)
+	offset, err := wal.WriteRaw("raw", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = newWriteAheadLOG(Options{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadRawFrom(offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	if !bytes.Equal(entries[0].Payload, want) {
+		t.Fatalf("payload %s, want %s", entries[0].Payload, want)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ** a segment picked for reading and the byte position to start at
+type segmentRange struct {
+	index    int
+	position int64
+}
+
+type snapshotSegment struct {
+	index    int
+	path     string
+	file     storageFile
+	position int64
+	end      int64 // ** bytes to read up to, unknown for compressed segments
+	active   bool
+}
+
+// ** the segments a read needs, opened under the mutex and read without it
+// ** every segment has its own read only handle, so retention, compaction or
+// ** compression replacing a segment meanwhile does not disturb the reader,
+// ** and the active segment is only read up to what was committed when the
+// ** snapshot was taken
+// ** a reader racing TruncateAfter may see entries from either side of the cut
+type logSnapshot struct {
+	segments   []snapshotSegment
+	encryption *recordEncryption
+	mmap       bool
+	// ** entries below archiveBefore are read from the archive first
+	archiver      Archiver
+	archive       []archivedSegment
+	archiveBefore int64
+}
+
+// ** open the given segments for reading, must be called with the mutex held
+func (w *WAL) snapshot(ranges []segmentRange) (*logSnapshot, error) {
+	snap := &logSnapshot{encryption: w.encryption, mmap: w.mmapReads}
+	for _, r := range ranges {
+		path := segmentPath(w.fs, w.directory, r.index)
+		file, err := openFile(w.fs, path)
+		if os.IsNotExist(err) {
+			snap.Close()
+			return nil, fmt.Errorf("%w: %s", ErrSegmentNotFound, path)
+		}
+		if err != nil {
+			snap.Close()
+			return nil, fmt.Errorf("failed to open segment file: %w", err)
+		}
+		segment := snapshotSegment{index: r.index, path: path, file: file, position: r.position, end: -1}
+		if r.index == w.currentSegmentIndex {
+			segment.active = true
+			segment.end = w.segmentSize
+		} else if compressionOf(path) == CompressionNone {
+			size, err := calculateOffset(file)
+			if err != nil {
+				file.Close()
+				snap.Close()
+				return nil, fmt.Errorf("failed to calculate offset: %w", err)
+			}
+			segment.end = int64(size)
+		}
+		snap.segments = append(snap.segments, segment)
+	}
+	return snap, nil
+}
+
+// ** snapshot of everything from offset onwards, optionally limited to topics
+// ** the segment holding offset is located through the sidecar indexes and
+// ** closed segments whose topic filter rules out every topic are left out
+// ** must be called with the mutex held
+func (w *WAL) snapshotFrom(offset int64, topics []string) (*logSnapshot, error) {
+	indexes := w.segments.indexes()
+	var archiveBefore int64
+	if w.archiver != nil && len(w.archive) > 0 {
+		localFirst := w.offset
+		if len(indexes) > 0 {
+			first, ok, err := firstOffset(w.fs, segmentPath(w.fs, w.directory, indexes[0]), w.encryption)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				localFirst = first
+			}
+		}
+		if offset < localFirst {
+			archiveBefore = localFirst
+		}
+	}
+	start, startPosition, err := locateOffset(w.fs, w.directory, indexes, offset, w.encryption)
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges []segmentRange
+	for i := start; i < len(indexes); i++ {
+		if len(topics) > 0 && indexes[i] < w.currentSegmentIndex {
+			filter, err := loadTopicFilter(w.fs, w.directory, indexes[i], w.encryption)
+			if err != nil {
+				return nil, err
+			}
+			if !filter.mayContainAny(topics) {
+				continue
+			}
+		}
+		r := segmentRange{index: indexes[i]}
+		if i == start {
+			r.position = startPosition
+		}
+		ranges = append(ranges, r)
+	}
+	snap, err := w.snapshot(ranges)
+	if err != nil {
+		return nil, err
+	}
+	if archiveBefore > 0 {
+		snap.archiver = w.archiver
+		snap.archive = append([]archivedSegment(nil), w.archive...)
+		snap.archiveBefore = archiveBefore
+	}
+	return snap, nil
+}
+
+// ** call fn for every entry in the snapshot from offset onwards that matches topics
+// ** fn can return errStopScan to end the scan early, a done ctx ends it with ctx.Err()
+func (s *logSnapshot) scan(ctx context.Context, offset int64, topics []string, fn func(logRecord) error) error {
+	if s.archiveBefore > 0 {
+		err := s.scanArchive(ctx, offset, s.archiveBefore, topics, fn)
+		if err == errStopScan {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := s.scanSegments(ctx, func(record logRecord) error {
+		if record.Offset >= offset && record.readable(topics) {
+			return fn(record)
+		}
+		return nil
+	})
+	if err == errStopScan {
+		return nil
+	}
+	return err
+}
+
+// ** call fn for every record of the local segments in the snapshot
+func (s *logSnapshot) scanSegments(ctx context.Context, fn func(logRecord) error) error {
+	for _, segment := range s.segments {
+		reader, err := s.open(segment)
+		if err != nil {
+			return err
+		}
+		err = s.scanSegment(reader, segment, func(record logRecord) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return fn(record)
+		})
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ** call fn for every record read from segment, an unreadable record in a
+// ** closed segment is a CorruptError
+func (s *logSnapshot) scanSegment(reader io.Reader, segment snapshotSegment, fn func(logRecord) error) error {
+	each := func(record logRecord, _ int64) error { return fn(record) }
+	if segment.active {
+		return scanRecords(reader, segment.position, s.encryption, each)
+	}
+	return scanClosedRecords(reader, segment.index, segment.position, s.encryption, each)
+}
+
+// ** reader over a segment of the snapshot from its start position
+// ** plain segments are read with positional reads on the snapshot's own
+// ** handle, closed ones through a read only mapping if mmap reads are on
+func (s *logSnapshot) open(segment snapshotSegment) (io.ReadCloser, error) {
+	if segment.end < 0 {
+		return decompressSegment(segment.path, io.NopCloser(segment.file), segment.position)
+	}
+	if segment.position > segment.end {
+		segment.position = segment.end
+	}
+	if osFile, ok := segment.file.(*os.File); ok && s.mmap && !segment.active && segment.end > 0 {
+		if data, err := mmapFile(osFile, int(segment.end)); err == nil {
+			return &mappedSegment{Reader: bytes.NewReader(data[segment.position:]), data: data}, nil
+		}
+	}
+	return io.NopCloser(io.NewSectionReader(segment.file, segment.position, segment.end-segment.position)), nil
+}
+
+// ** close every segment handle of the snapshot
+func (s *logSnapshot) Close() error {
+	var firstErr error
+	for _, segment := range s.segments {
+		if err := segment.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.segments = nil
+	return firstErr
+}
+
+// ** a closed segment mapped into memory, closing it unmaps it
+type mappedSegment struct {
+	*bytes.Reader
+	data []byte
+}
+
+func (m *mappedSegment) Close() error {
+	return munmapFile(m.data)
+}
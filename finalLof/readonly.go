@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ** returned by the file system of a read only wal for anything that would
+// ** change the directory
+var ErrReadOnly = errors.New("wal is opened read only")
+
+// ** a view of a wal directory another process may be writing to, for
+// ** analytics jobs and other readers that must not get in the writer's way
+// ** it never takes the directory lock and has no write methods, and its file
+// ** system refuses anything that would create, change or remove a file, so
+// ** sidecars that are missing are worked around instead of rebuilt
+// ** only committed entries are read: whole records, and batches only once
+// ** every entry of them is there
+type ReadOnlyWAL struct {
+	directory  string
+	fs         fileSystem
+	encryption *recordEncryption
+	mu         sync.Mutex
+	closed     bool
+}
+
+// ** open dir read only, see ReadOnlyWAL
+func OpenReadOnly(dir string) (*ReadOnlyWAL, error) {
+	return OpenReadOnlyOptions(Options{Directory: dir})
+}
+
+// ** OpenReadOnly for an encrypted wal, only Directory and Encryption of opts
+// ** are used
+func OpenReadOnlyOptions(opts Options) (*ReadOnlyWAL, error) {
+	directory := opts.Directory
+	if directory == "" {
+		directory = walDir
+	}
+	encryption, err := newRecordEncryption(opts.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	fs := opts.fs
+	if fs == nil {
+		fs = osFS{}
+	}
+	fs = readOnlyFS{fs}
+	if _, err := fs.Stat(directory); err != nil {
+		return nil, fmt.Errorf("failed to open wal directory: %w", err)
+	}
+	// ** checkEncryptionKey would write the key check file of a wal that is
+	// ** opened with a key for the first time
+	if _, err := fs.Stat(filepath.Join(directory, keyCheckFileName)); encryption != nil && os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is not an encrypted wal", directory)
+	}
+	if err := checkEncryptionKey(fs, directory, encryption); err != nil {
+		return nil, err
+	}
+	return &ReadOnlyWAL{directory: directory, fs: fs, encryption: encryption}, nil
+}
+
+// ** committed entries with an offset of at least offset, in write order,
+// ** optionally only those of topics
+func (r *ReadOnlyWAL) ReadFrom(offset int64, topics ...string) ([]LogEntry, error) {
+	it := r.NewIterator(offset, topics...)
+	defer it.Close()
+	var entries []LogEntry
+	for it.Next() {
+		entries = append(entries, it.Entry())
+	}
+	return entries, it.Err()
+}
+
+// ** later calls fail with ErrClosed, iterators already made keep working
+// ** until they are closed
+func (r *ReadOnlyWAL) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *ReadOnlyWAL) isClosed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// ** forward cursor over the committed entries of a ReadOnlyWAL
+// ** Next returns false once it is at the end of what the writer committed so
+// ** far, calling it again later picks up what was written meanwhile, also
+// ** in segments created since, so the iterator can follow a live wal
+// ** Err reports why it stopped for good, nil while it is only caught up
+type ReadOnlyIterator struct {
+	wal    *ReadOnlyWAL
+	topics []string
+	// ** offset of the next entry to yield
+	next int64
+	// ** segment being read or to open next, 0 until the first is picked
+	segment int
+
+	reader io.ReadCloser
+	lines  *bufio.Reader
+	decode func(*recordEncryption, []byte) (logRecord, error)
+	// ** records of a batch whose later entries have not been seen yet
+	batch     []logRecord
+	batchSize int
+	// ** records ready to yield, in order
+	ready []logRecord
+
+	entry  LogEntry
+	err    error
+	closed bool
+}
+
+// ** an iterator from offset onwards, optionally only over topics
+func (r *ReadOnlyWAL) NewIterator(offset int64, topics ...string) *ReadOnlyIterator {
+	return &ReadOnlyIterator{wal: r, topics: topics, next: offset}
+}
+
+// ** move to the next committed entry, false when there is none yet or the
+// ** iteration failed
+func (it *ReadOnlyIterator) Next() bool {
+	for it.err == nil && !it.closed {
+		if len(it.ready) > 0 {
+			record := it.ready[0]
+			it.ready = it.ready[1:]
+			it.next = record.Offset + 1
+			if record.readable(it.topics) {
+				it.entry = record.entry()
+				return true
+			}
+			continue
+		}
+		if it.wal.isClosed() {
+			it.fail(ErrClosed)
+			return false
+		}
+		if it.lines == nil {
+			opened, err := it.openSegment()
+			if err != nil {
+				it.fail(err)
+				return false
+			}
+			if !opened {
+				return false
+			}
+		}
+		more, err := it.readRecord()
+		if err != nil {
+			it.fail(err)
+			return false
+		}
+		if more {
+			continue
+		}
+		// ** at the end of what is in the segment, unless a newer one exists
+		// ** the writer is still appending to it and it is read again later
+		it.closeSegment()
+		newer, err := it.newerSegment()
+		if err != nil {
+			it.fail(err)
+			return false
+		}
+		if newer < 0 {
+			return false
+		}
+		it.segment = newer
+	}
+	return false
+}
+
+// ** the entry Next moved to
+func (it *ReadOnlyIterator) Entry() LogEntry {
+	return it.entry
+}
+
+// ** why the iteration stopped for good, nil if it is only caught up
+func (it *ReadOnlyIterator) Err() error {
+	return it.err
+}
+
+// ** release the segment being read, Next returns false afterwards
+func (it *ReadOnlyIterator) Close() error {
+	it.closed = true
+	it.ready = nil
+	it.closeSegment()
+	return nil
+}
+
+func (it *ReadOnlyIterator) fail(err error) {
+	it.err = err
+	it.closeSegment()
+}
+
+// ** open the segment holding it.next, or the first one from it.segment on,
+// ** and seek close to it.next through its index if there is a whole one
+// ** false if there is no segment to read
+func (it *ReadOnlyIterator) openSegment() (bool, error) {
+	w := it.wal
+	indexes, err := manifestSegments(w.fs, w.directory)
+	if err != nil {
+		return false, err
+	}
+	// ** a segment that is gone may have been merged into an earlier one by
+	// ** vacuum, so it is looked up by offset again
+	if !containsIndex(indexes, it.segment) {
+		if it.segment, err = it.wal.segmentHolding(indexes, it.next); err != nil {
+			return false, err
+		}
+	}
+	for _, index := range indexes {
+		if index < it.segment {
+			continue
+		}
+		position := int64(0)
+		if entries, ok, err := readIndex(w.fs, w.directory, index); err != nil {
+			return false, err
+		} else if ok {
+			position = indexEntryList(entries).seek(it.next)
+		}
+		path := segmentPath(w.fs, w.directory, index)
+		reader, err := openSegment(w.fs, path, position)
+		if errors.Is(err, ErrSegmentNotFound) {
+			// ** removed by retention since it was listed
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		it.segment = index
+		it.reader, it.lines = reader, bufio.NewReader(reader)
+		it.decode = segmentDecoders[segmentVersion]
+		if position == 0 {
+			header, _, err := readSegmentHeader(it.lines)
+			if err == errTornHeader {
+				// ** a segment the writer has only just created
+				it.closeSegment()
+				return false, nil
+			}
+			if err != nil {
+				it.closeSegment()
+				return false, err
+			}
+			it.decode = segmentDecoders[header.Version]
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// ** the last of indexes starting at or before offset, the first if there is
+// ** none and 0 for an empty directory
+func (r *ReadOnlyWAL) segmentHolding(indexes []int, offset int64) (int, error) {
+	holding := 0
+	for _, index := range indexes {
+		path := segmentPath(r.fs, r.directory, index)
+		base, ok, err := segmentBase(r.fs, path, r.encryption)
+		if errors.Is(err, ErrSegmentNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if holding != 0 && (!ok || base > offset) {
+			break
+		}
+		holding = index
+	}
+	return holding, nil
+}
+
+func containsIndex(indexes []int, index int) bool {
+	for _, candidate := range indexes {
+		if candidate == index {
+			return true
+		}
+	}
+	return false
+}
+
+// ** the index of the first segment after it.segment, -1 if there is none
+func (it *ReadOnlyIterator) newerSegment() (int, error) {
+	indexes, err := manifestSegments(it.wal.fs, it.wal.directory)
+	if err != nil {
+		return -1, err
+	}
+	for _, index := range indexes {
+		if index > it.segment {
+			return index, nil
+		}
+	}
+	return -1, nil
+}
+
+// ** read one record of the current segment, false at the end of what is
+// ** committed, a line the writer has not finished or a torn tail
+func (it *ReadOnlyIterator) readRecord() (bool, error) {
+	line, err := it.lines.ReadBytes('\n')
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read segment: %w", err)
+	}
+	record, err := it.decode(it.wal.encryption, line)
+	if err != nil {
+		return false, nil
+	}
+	switch {
+	case record.Batch > 1:
+		it.batch, it.batchSize = []logRecord{record}, record.Batch
+	case len(it.batch) > 0:
+		it.batch = append(it.batch, record)
+	default:
+		it.commit(record)
+	}
+	if len(it.batch) > 0 && len(it.batch) == it.batchSize {
+		it.commit(it.batch...)
+		it.batch, it.batchSize = nil, 0
+	}
+	return true, nil
+}
+
+// ** queue committed records, leaving out those before it.next that were
+// ** yielded already or come before where the iteration started
+func (it *ReadOnlyIterator) commit(records ...logRecord) {
+	for _, record := range records {
+		if record.Offset >= it.next {
+			it.ready = append(it.ready, record)
+		}
+	}
+}
+
+// ** close the current segment, a batch not finished in it is read again
+// ** from its start when the segment is reopened
+func (it *ReadOnlyIterator) closeSegment() {
+	if it.reader != nil {
+		it.reader.Close()
+		it.reader = nil
+	}
+	it.lines = nil
+	it.batch, it.batchSize = nil, 0
+}
+
+// ** a fileSystem that passes reads through and refuses every change
+type readOnlyFS struct {
+	fileSystem
+}
+
+func (f readOnlyFS) OpenFile(name string, flag int, perm os.FileMode) (storageFile, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrReadOnly}
+	}
+	return f.fileSystem.OpenFile(name, flag, perm)
+}
+
+func (readOnlyFS) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: ErrReadOnly}
+}
+
+func (readOnlyFS) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: ErrReadOnly}
+}
+
+func (readOnlyFS) MkdirAll(path string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: path, Err: ErrReadOnly}
+}
+
+func (readOnlyFS) Chtimes(name string, atime, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: ErrReadOnly}
+}
+
+func (readOnlyFS) SyncDir(path string) error {
+	return ErrReadOnly
+}
+
+func (readOnlyFS) Lock(directory string) (io.Closer, error) {
+	return nil, ErrReadOnly
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ** the record decoded fine but its contents do not match the checksum
+var errChecksumMismatch = errors.New("record checksum mismatch")
+
+// ** exact on-disk layout of a record
+// ** the payload is kept raw so the checksum covers the bytes actually written
+// ** records from before checksums were added have no crc and are not verified
+type diskRecord struct {
+	Offset  int64           `json:"offset"`
+	Topic   string          `json:"topic"`
+	Key     string          `json:"key,omitempty"`
+	Time    int64           `json:"ts,omitempty"` // ** unix nanoseconds
+	Payload json.RawMessage `json:"payload"`
+	Batch   int             `json:"batch,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	Binary  bool            `json:"bin,omitempty"`   // ** payload is base64 of raw bytes
+	Skip    bool            `json:"skip,omitempty"`  // ** a reservation placeholder
+	Fills   int64           `json:"fills,omitempty"` // ** reserved offset of a commit
+	CRC     *uint32         `json:"crc,omitempty"`
+}
+
+// ** crc32c over offset, topic, compaction key, write time, idempotency id,
+// ** binary and skip flags, reserved offset and payload
+// ** an empty key, time, id or reserved offset adds nothing so older records
+// ** keep their checksum
+// ** everything before the payload is assembled in scratch, which is
+// ** returned so the caller can keep it for the next record
+func recordChecksum(scratch []byte, disk diskRecord) (uint32, []byte) {
+	buf := binary.BigEndian.AppendUint64(scratch[:0], uint64(disk.Offset))
+	buf = append(buf, disk.Topic...)
+	buf = append(buf, 0)
+	if disk.Key != "" {
+		buf = append(buf, 'k')
+		buf = append(buf, disk.Key...)
+		buf = append(buf, 0)
+	}
+	if disk.Time != 0 {
+		buf = append(buf, 't')
+		buf = binary.BigEndian.AppendUint64(buf, uint64(disk.Time))
+	}
+	if disk.ID != "" {
+		buf = append(buf, 'i')
+		buf = append(buf, disk.ID...)
+		buf = append(buf, 0)
+	}
+	if disk.Binary {
+		buf = append(buf, 'b')
+	}
+	if disk.Skip {
+		buf = append(buf, 's')
+	}
+	if disk.Fills != 0 {
+		buf = append(buf, 'f')
+		buf = binary.BigEndian.AppendUint64(buf, uint64(disk.Fills))
+	}
+	sum := crc32.Update(0, crcTable, buf)
+	return crc32.Update(sum, crcTable, disk.Payload), buf
+}
+
+// ** JSON form of a record with its checksum and the trailing newline
+// ** it is encoded in scratch and only valid until scratch is used again
+func marshalRecord(scratch *recordScratch, record logRecord) ([]byte, error) {
+	binary, err := marshalPayload(scratch, record)
+	if err != nil {
+		return nil, err
+	}
+	scratch.disk = diskRecord{
+		Offset:  record.Offset,
+		Topic:   record.Topic,
+		Key:     record.Key,
+		Payload: scratch.payload.Bytes(),
+		Batch:   record.Batch,
+		ID:      record.ID,
+		Binary:  binary,
+		Skip:    record.skip,
+		Fills:   record.fills,
+	}
+	if !record.Timestamp.IsZero() {
+		scratch.disk.Time = record.Timestamp.UnixNano()
+	}
+	scratch.crc, scratch.checksum = recordChecksum(scratch.checksum, scratch.disk)
+	scratch.disk.CRC = &scratch.crc
+	scratch.line.Reset()
+	// ** Encode writes what json.Marshal would, apart from HTML escaping,
+	// ** followed by a newline
+	if err := scratch.lineEncoder.Encode(&scratch.disk); err != nil {
+		return nil, err
+	}
+	return scratch.line.Bytes(), nil
+}
+
+// ** parse and verify the JSON form of a record
+func unmarshalRecord(data []byte) (logRecord, error) {
+	var disk diskRecord
+	if err := json.Unmarshal(data, &disk); err != nil {
+		return logRecord{}, err
+	}
+	if disk.CRC != nil {
+		if sum, _ := recordChecksum(nil, disk); sum != *disk.CRC {
+			return logRecord{}, errChecksumMismatch
+		}
+	}
+	record := logRecord{
+		LogEntry: LogEntry{Offset: disk.Offset, Topic: disk.Topic, Key: disk.Key},
+		Batch:    disk.Batch,
+		ID:       disk.ID,
+		raw:      disk.Payload,
+		binary:   disk.Binary,
+		skip:     disk.Skip,
+		fills:    disk.Fills,
+	}
+	if disk.Time != 0 {
+		record.Timestamp = time.Unix(0, disk.Time).UTC()
+	}
+	if disk.Binary {
+		var data []byte
+		if err := json.Unmarshal(disk.Payload, &data); err != nil {
+			return logRecord{}, err
+		}
+		record.Payload = data
+		record.raw = data
+		return record, nil
+	}
+	if len(disk.Payload) > 0 {
+		if err := json.Unmarshal(disk.Payload, &record.Payload); err != nil {
+			return logRecord{}, err
+		}
+	}
+	return record, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ** scan a segment and cut off anything that was not fully written
+// ** a torn last line or a batch with missing entries is removed so the
+// ** segment always ends on a complete record
+// ** returns how many bytes were cut off
+func recoverSegment(fs fileSystem, path string, encryption *recordEncryption) (int64, error) {
+	file, err := fs.OpenFile(path, os.O_RDWR, 0666)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to open segment file: %w", err)
+	}
+	defer file.Close()
+
+	valid, err := validSegmentSize(file, encryption)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get file info: %w", err)
+	}
+	if valid == stat.Size() {
+		return 0, nil
+	}
+	if err := file.Truncate(valid); err != nil {
+		return 0, fmt.Errorf("failed to truncate segment: %w", err)
+	}
+	return stat.Size() - valid, file.Sync()
+}
+
+// ** returns the byte length of the committed prefix of the segment
+func validSegmentSize(file io.Reader, encryption *recordEncryption) (int64, error) {
+	reader := bufio.NewReader(file)
+	header, size, err := readSegmentHeader(reader)
+	if err == errTornHeader {
+		// ** created but cut short, it is started again on open
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	decode := segmentDecoders[header.Version]
+	position, committed := size, size
+	pending := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// ** a line without its newline never finished writing
+			return committed, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read segment: %w", err)
+		}
+		record, err := decode(encryption, line)
+		if err != nil {
+			return committed, nil
+		}
+		position += int64(len(line))
+
+		if record.Batch > 0 {
+			if pending > 0 {
+				// ** a new batch started before the previous one completed
+				return committed, nil
+			}
+			pending = record.Batch
+		}
+		if pending > 0 {
+			pending--
+		}
+		if pending == 0 {
+			committed = position
+		}
+	}
+}
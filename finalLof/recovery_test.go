@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// ** a batch cut off while it was written is dropped whole on reopen and
+// ** its offsets go to the next writes
+func TestTornBatchIsDroppedWhole(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{Directory: dir, Rotation: RotationPolicy{MaxBytes: 1 << 30}}
+	wal, err := newWriteAheadLOG(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := wal.WriteLog("single", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offsets, err := wal.WriteBatchOffsets(batchEntries("batch", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := segmentFileName(dir, wal.currentSegmentIndex)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ** cut in the middle of the second record of the batch, as if the
+	// ** process died while the batch was written
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.TrimRight(data, "\x00")
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	lines = lines[:len(lines)-1] // ** the empty rest after the last newline
+	third := len(data) - len(lines[len(lines)-1])
+	second := third - len(lines[len(lines)-2])
+	if err := os.Truncate(segment, int64(second+len(lines[len(lines)-2])/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = newWriteAheadLOG(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadFrom(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries after recovery, want the 2 before the batch", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Topic != "single" {
+			t.Fatalf("entry %d of the torn batch survived", entry.Offset)
+		}
+	}
+	offset, err := wal.WriteLog("after", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != offsets[0] {
+		t.Fatalf("next write got offset %d, want the torn batch's first offset %d", offset, offsets[0])
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ** suffix of the file keeping the bytes repair cut off a segment
+const quarantineSuffix = ".corrupt"
+
+// ** what Repair did to one corrupt segment
+type SegmentRepair struct {
+	Segment int    `json:"segment"`
+	Path    string `json:"path"`
+	// ** the segment now ends here, where the first bad record started
+	Position int64  `json:"position"`
+	Reason   string `json:"reason"`
+	// ** records kept before Position
+	KeptEntries  int   `json:"kept_entries"`
+	DroppedBytes int64 `json:"dropped_bytes"`
+	// ** file holding the dropped bytes, empty if they were discarded
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// ** cut every corrupt segment of the wal in dir off at its first bad record
+// ** and rebuild its index, so the wal opens again with everything before
+// ** that point intact
+// ** with quarantine the dropped bytes are kept next to the segment in a
+// ** .corrupt file for a closer look, otherwise they are gone for good
+// ** key must be the key of an encrypted wal and nil otherwise, the wal must
+// ** not be open, Repair takes its lock and fails with ErrLocked if it is
+func Repair(dir string, key KeyProvider, quarantine bool) ([]SegmentRepair, error) {
+	encryption, err := newRecordEncryption(key)
+	if err != nil {
+		return nil, err
+	}
+	fs := osFS{}
+	// ** checkEncryptionKey would set up a key check file for a fresh wal
+	if _, err := fs.Stat(filepath.Join(dir, keyCheckFileName)); encryption != nil && os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is not an encrypted wal", dir)
+	}
+	if err := checkEncryptionKey(fs, dir, encryption); err != nil {
+		return nil, err
+	}
+	return repairDirectory(fs, dir, encryption, quarantine)
+}
+
+func repairDirectory(fs fileSystem, dir string, encryption *recordEncryption, quarantine bool) ([]SegmentRepair, error) {
+	lock, err := fs.Lock(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+
+	indexes, err := listSegments(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	var repairs []SegmentRepair
+	for _, index := range indexes {
+		report, err := inspectSegment(fs, dir, index, encryption)
+		if err != nil {
+			return repairs, err
+		}
+		if report.Corruption == nil {
+			continue
+		}
+		repair, err := repairSegment(fs, dir, index, report, quarantine)
+		if err != nil {
+			return repairs, err
+		}
+		if _, _, err := buildIndex(fs, dir, index, encryption); err != nil {
+			return repairs, err
+		}
+		repairs = append(repairs, repair)
+	}
+	return repairs, nil
+}
+
+// ** cut the segment at the corruption inspectSegment reported
+// ** a compressed segment cannot be cut in place, its good records are
+// ** written out as a plain segment that replaces it
+func repairSegment(fs fileSystem, dir string, index int, report segmentReport, quarantine bool) (SegmentRepair, error) {
+	repair := SegmentRepair{
+		Segment:     index,
+		Path:        report.Path,
+		Position:    report.Corruption.Position,
+		Reason:      report.Corruption.Reason,
+		KeptEntries: report.Entries,
+	}
+	source, err := openSegment(fs, report.Path, 0)
+	if err != nil {
+		return repair, err
+	}
+	contents, err := io.ReadAll(source)
+	source.Close()
+	if err != nil {
+		return repair, fmt.Errorf("failed to read segment: %w", err)
+	}
+	if repair.Position > int64(len(contents)) {
+		return repair, fmt.Errorf("corruption at %d is past the end of %s", repair.Position, report.Path)
+	}
+	tail := contents[repair.Position:]
+	repair.DroppedBytes = int64(len(tail))
+
+	plain := segmentFileName(dir, index)
+	// ** zeros are unused preallocated space, not worth keeping
+	if quarantine && len(bytes.Trim(tail, "\x00")) > 0 {
+		repair.Quarantine = plain + quarantineSuffix
+		if err := appendQuarantine(fs, repair.Quarantine, tail); err != nil {
+			return repair, err
+		}
+	}
+
+	if compressionOf(report.Path) == CompressionNone {
+		file, err := fs.OpenFile(report.Path, os.O_RDWR, 0666)
+		if err != nil {
+			return repair, fmt.Errorf("failed to open segment file: %w", err)
+		}
+		defer file.Close()
+		if err := file.Truncate(repair.Position); err != nil {
+			return repair, fmt.Errorf("failed to truncate segment: %w", err)
+		}
+		if err := file.Sync(); err != nil {
+			return repair, fmt.Errorf("failed to sync segment: %w", err)
+		}
+		return repair, nil
+	}
+
+	if err := writeFileAtomic(fs, plain, contents[:repair.Position]); err != nil {
+		return repair, fmt.Errorf("failed to write repaired segment: %w", err)
+	}
+	if err := fs.Remove(report.Path); err != nil {
+		return repair, fmt.Errorf("failed to remove damaged segment: %w", err)
+	}
+	repair.Path = plain
+	return repair, fs.SyncDir(dir)
+}
+
+// ** add the bytes cut off a segment to its quarantine file, a segment
+// ** repaired more than once keeps every tail in the order they were cut
+func appendQuarantine(fs fileSystem, path string, tail []byte) error {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open quarantine file: %w", err)
+	}
+	if _, err := file.Write(tail); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write quarantine file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync quarantine file: %w", err)
+	}
+	return file.Close()
+}
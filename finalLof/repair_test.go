@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// ** repair cuts each segment at its first bad record, keeps the cut bytes
+// ** aside and leaves a wal that verifies clean
+func TestRepairCutsAtDamage(t *testing.T) {
+	dir := t.TempDir()
+	wal := writeVerifyWAL(t, dir)
+	indexes := wal.segments.indexes()
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	badCRC, tornTail := damageSegments(t, dir, indexes)
+	damaged, err := os.ReadFile(segmentFileName(dir, indexes[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repairs, err := Repair(dir, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repairs) != 2 {
+		t.Fatalf("got %d repairs, want 2: %+v", len(repairs), repairs)
+	}
+	if repairs[0].Position != badCRC || repairs[0].KeptEntries != 1 {
+		t.Fatalf("first segment repaired as %+v, want a cut at %d keeping 1 entry", repairs[0], badCRC)
+	}
+	if repairs[1].Position != tornTail || repairs[1].KeptEntries != 4 {
+		t.Fatalf("second segment repaired as %+v, want a cut at %d keeping 4 entries", repairs[1], tornTail)
+	}
+	quarantined, err := os.ReadFile(repairs[0].Quarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(quarantined) != string(damaged[badCRC:]) {
+		t.Fatalf("quarantine holds %q, want the cut off %q", quarantined, damaged[badCRC:])
+	}
+
+	wal, err = newWriteAheadLOG(Options{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if found, err := wal.Verify(); err != nil || len(found) != 0 {
+		t.Fatalf("repaired wal: %+v, %v", found, err)
+	}
+	entries, err := wal.ReadFrom(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1+4+4 {
+		t.Fatalf("got %d entries after repair, want 9", len(entries))
+	}
+}
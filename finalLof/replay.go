@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// ** records of one segment decoded by a replay worker
+type decodedSegment struct {
+	records []logRecord
+	err     error
+}
+
+// ** call fn for every entry from offset onwards, optionally limited to topics,
+// ** decoding up to workers segments at the same time
+// ** entries still reach fn one at a time and in offset order, so fn needs no
+// ** locking of its own, and the first error fn returns ends the replay
+// ** workers <= 0 uses one worker per CPU, 1 replays serially
+// ** like ReadFrom the mutex is only held to pick the segments
+func (w *WAL) Replay(offset int64, workers int, fn func(LogEntry) error, topics ...string) error {
+	return w.ReplayContext(context.Background(), offset, workers, fn, topics...)
+}
+
+// ** Replay that stops with ctx.Err() once ctx is done
+func (w *WAL) ReplayContext(ctx context.Context, offset int64, workers int, fn func(LogEntry) error, topics ...string) (err error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if w.tracer != nil {
+		var span Span
+		ctx, span = w.tracer.Start(ctx, "wal.replay")
+		span.SetAttribute("wal.offset", offset)
+		span.SetAttribute("wal.workers", workers)
+		defer func() { span.End(err) }()
+	}
+	w.mu.Lock()
+	snap, err := w.snapshotFrom(offset, topics)
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	deliver := func(record logRecord) error {
+		return fn(record.entry())
+	}
+	if snap.archiveBefore > 0 {
+		if err := snap.scanArchive(ctx, offset, snap.archiveBefore, topics, deliver); err != nil {
+			return err
+		}
+	}
+	return snap.replaySegments(ctx, offset, topics, workers, deliver)
+}
+
+// ** decode the local segments of the snapshot concurrently and hand their
+// ** records to fn in segment order
+// ** a segment is only decoded once fewer than workers segments are waiting
+// ** to be delivered, which bounds how much is held in memory
+func (s *logSnapshot) replaySegments(ctx context.Context, offset int64, topics []string, workers int, fn func(logRecord) error) error {
+	results := make([]chan decodedSegment, len(s.segments))
+	for i := range results {
+		results[i] = make(chan decodedSegment, 1)
+	}
+	slots := make(chan struct{}, workers)
+	done := make(chan struct{})
+	var running sync.WaitGroup
+	// ** workers read through the snapshot's handles, so they have to be
+	// ** finished before the snapshot is closed
+	defer running.Wait()
+	defer close(done)
+
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		for i, segment := range s.segments {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			running.Add(1)
+			go func(i int, segment snapshotSegment) {
+				defer running.Done()
+				results[i] <- s.decodeSegment(ctx, segment, offset, topics)
+			}(i, segment)
+		}
+	}()
+
+	for i := range s.segments {
+		decoded := <-results[i]
+		<-slots
+		if decoded.err != nil {
+			return decoded.err
+		}
+		for _, record := range decoded.records {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ** every record of a segment from offset onwards that matches topics
+func (s *logSnapshot) decodeSegment(ctx context.Context, segment snapshotSegment, offset int64, topics []string) decodedSegment {
+	reader, err := s.open(segment)
+	if err != nil {
+		return decodedSegment{err: err}
+	}
+	defer reader.Close()
+
+	var decoded decodedSegment
+	decoded.err = s.scanSegment(reader, segment, func(record logRecord) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if record.Offset >= offset && record.readable(topics) {
+			decoded.records = append(decoded.records, record)
+		}
+		return nil
+	})
+	return decoded
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ** how long a follower waits before connecting again after losing the leader
+	replicationRetry = time.Second
+	// ** how often a follower asks the leader for its last offset to work out the lag
+	replicationPoll = time.Second
+)
+
+// ** the wal is following a leader already
+var ErrFollowing = errors.New("wal is already following a leader")
+
+// ** a write sent to a server whose wal follows a leader, it belongs on the
+// ** leader since a local entry would take an offset the leader hands out
+var ErrFollower = errors.New("wal follows a leader, write to the leader instead")
+
+// ** how far a follower is behind its leader
+type ReplicationStatus struct {
+	Leader    string
+	Connected bool
+	// ** last offset written locally and last offset the leader reported
+	LastApplied      int64
+	LeaderLastOffset int64
+	Lag              int64
+	// ** when the leader last sent an entry or answered a status poll
+	LastContact time.Time
+	LastError   string
+}
+
+// ** keeps a wal a copy of a leader by following the leader's /stream
+// ** entries are written with the offsets and timestamps they have on the
+// ** leader, so the follower can take over as a warm standby
+// ** nothing else may write to the wal while it follows, the server turns
+// ** its write endpoints away with ErrFollower meanwhile
+// ** a leader that lost entries and wrote others in their place is only
+// ** noticed when it streams an offset below the follower's next one, one
+// ** that is back at or past it by the time the follower reconnects is not,
+// ** and the follower keeps its old entries under those offsets
+type Follower struct {
+	wal    *WAL
+	leader string
+	token  string
+	client *http.Client
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu          sync.Mutex
+	connected   bool
+	leaderLast  int64
+	lastContact time.Time
+	lastErr     error
+}
+
+// ** how a follower reaches a leader that is protected by ServerSecurity
+type FollowerConfig struct {
+	// ** sent as a bearer token with every request, empty sends none
+	Token string
+	// ** for an https leader, nil trusts the system roots
+	TLS *tls.Config
+}
+
+// ** an entry as the leader streams it, the payload is kept as the JSON it
+// ** was sent as so it is stored exactly as the leader holds it
+// ** a binary payload is sent as base64 with Binary set, and ID carries the
+// ** idempotency key so retries are still recognised after a failover
+// ** Offset is where the record sits in the log, a committed reservation
+// ** is read under Fills instead
+type replicatedEntry struct {
+	Offset    int64           `json:"offset"`
+	Topic     string          `json:"topic"`
+	Key       string          `json:"key,omitempty"`
+	Payload   json.RawMessage `json:"payload"`
+	Timestamp time.Time       `json:"timestamp"`
+	Binary    bool            `json:"bin,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Fills     int64           `json:"fills,omitempty"`
+}
+
+// ** the stream form of a record, its payload as the leader stored it
+func newReplicatedEntry(record logRecord) (replicatedEntry, error) {
+	entry := replicatedEntry{
+		Offset:    record.Offset,
+		Topic:     record.Topic,
+		Key:       record.Key,
+		Payload:   json.RawMessage(record.raw),
+		Timestamp: record.Timestamp,
+		Binary:    record.binary,
+		ID:        record.ID,
+		Fills:     record.fills,
+	}
+	if record.binary {
+		// ** raw holds the decoded bytes of a binary payload
+		payload, err := json.Marshal([]byte(record.raw))
+		if err != nil {
+			return replicatedEntry{}, err
+		}
+		entry.Payload = payload
+	}
+	if len(entry.Payload) == 0 {
+		entry.Payload = json.RawMessage("null")
+	}
+	return entry, nil
+}
+
+// ** start following the wal server at leader, e.g. http://primary:9090
+// ** the follower resumes from the next local offset, reconnects on its own
+// ** when the connection drops and runs until Stop or until the wal is closed
+func (w *WAL) Follow(leader string) (*Follower, error) {
+	return w.FollowWith(leader, FollowerConfig{})
+}
+
+// ** Follow a leader that needs a token or a custom TLS config
+func (w *WAL) FollowWith(leader string, config FollowerConfig) (*Follower, error) {
+	parsed, err := url.Parse(leader)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid leader url %q", leader)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config.TLS
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Follower{
+		wal:    w,
+		leader: strings.TrimSuffix(leader, "/"),
+		token:  config.Token,
+		client: &http.Client{Transport: transport},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		cancel()
+		return nil, ErrClosed
+	}
+	if w.follower != nil {
+		w.mu.Unlock()
+		cancel()
+		return nil, ErrFollowing
+	}
+	w.follower = f
+	w.mu.Unlock()
+
+	go f.run(ctx)
+	return f, nil
+}
+
+// ** stop following, returns once no more entries are being written
+func (f *Follower) Stop() {
+	f.cancel()
+	<-f.done
+	f.wal.mu.Lock()
+	if f.wal.follower == f {
+		f.wal.follower = nil
+	}
+	f.wal.mu.Unlock()
+}
+
+func (f *Follower) Status() ReplicationStatus {
+	f.wal.mu.Lock()
+	applied := f.wal.offset - 1
+	f.wal.mu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := ReplicationStatus{
+		Leader:           f.leader,
+		Connected:        f.connected,
+		LastApplied:      applied,
+		LeaderLastOffset: f.leaderLast,
+		LastContact:      f.lastContact,
+	}
+	if f.leaderLast > applied {
+		status.Lag = f.leaderLast - applied
+	}
+	if f.lastErr != nil {
+		status.LastError = f.lastErr.Error()
+	}
+	return status
+}
+
+func (f *Follower) run(ctx context.Context) {
+	defer close(f.done)
+	var running sync.WaitGroup
+	defer running.Wait()
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		f.poll(ctx)
+	}()
+
+	for {
+		err := f.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		f.mu.Lock()
+		f.lastErr = err
+		f.mu.Unlock()
+		f.wal.logger.Warn("lost the leader's stream", "leader", f.leader, "err", err)
+		// ** the wal was closed under the follower, nothing left to do
+		if errors.Is(err, ErrClosed) {
+			f.cancel()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicationRetry):
+		}
+	}
+}
+
+// ** read the leader's stream from the next local offset and write every
+// ** entry, returns when the connection fails or ctx is done
+func (f *Follower) stream(ctx context.Context) error {
+	f.wal.mu.Lock()
+	from := f.wal.offset
+	f.wal.mu.Unlock()
+
+	request, err := f.newRequest(ctx, "/stream?from="+strconv.FormatInt(from, 10))
+	if err != nil {
+		return fmt.Errorf("failed to create stream request: %w", err)
+	}
+	response, err := f.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to connect to leader: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader refused the stream: %s", response.Status)
+	}
+
+	f.mu.Lock()
+	f.connected = true
+	f.lastErr = nil
+	f.lastContact = time.Now()
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.connected = false
+		f.mu.Unlock()
+	}()
+
+	reader := bufio.NewReader(response.Body)
+	var event, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return fmt.Errorf("leader closed the stream")
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read stream: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if event == "entry" && data != "" {
+				if err := f.apply(data); err != nil {
+					return err
+				}
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		}
+	}
+}
+
+func (f *Follower) apply(data string) error {
+	var entry replicatedEntry
+	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+		return fmt.Errorf("failed to decode replicated entry: %w", err)
+	}
+	if err := f.wal.writeReplicated(entry); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if entry.Offset > f.leaderLast {
+		f.leaderLast = entry.Offset
+	}
+	f.lastContact = time.Now()
+	f.mu.Unlock()
+	return nil
+}
+
+// ** a GET of path on the leader, carrying the token if there is one
+func (f *Follower) newRequest(ctx context.Context, path string) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.token != "" {
+		request.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	return request, nil
+}
+
+// ** ask the leader for its last offset every replicationPoll until ctx is done
+func (f *Follower) poll(ctx context.Context) {
+	ticker := time.NewTicker(replicationPoll)
+	defer ticker.Stop()
+	for {
+		if last, err := f.leaderOffset(ctx); err == nil {
+			f.mu.Lock()
+			f.leaderLast = last
+			f.lastContact = time.Now()
+			f.mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *Follower) leaderOffset(ctx context.Context) (int64, error) {
+	request, err := f.newRequest(ctx, "/status")
+	if err != nil {
+		return 0, err
+	}
+	response, err := f.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("leader status: %s", response.Status)
+	}
+	var status struct {
+		LastOffset int64 `json:"last_offset"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&status); err != nil {
+		return 0, err
+	}
+	return status.LastOffset, nil
+}
+
+// ** write an entry received from the leader under the leader's offset
+// ** an offset below the next local one means the leader truncated its log,
+// ** the follower drops the same entries before writing the replacement
+// ** entries are not compared, see Follower for a truncation this misses
+func (w *WAL) writeReplicated(entry replicatedEntry) error {
+	w.mu.Lock()
+	next := w.offset
+	w.mu.Unlock()
+	if entry.Offset < next {
+		if err := w.TruncateAfter(entry.Offset - 1); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if err := w.advanceTo(entry.Offset); err != nil {
+		return err
+	}
+	var payload interface{}
+	switch {
+	case entry.Binary:
+		var data []byte
+		if err := json.Unmarshal(entry.Payload, &data); err != nil {
+			return fmt.Errorf("failed to decode binary payload: %w", err)
+		}
+		// ** never valid JSON, or the leader would not have stored it as
+		// ** binary, so it is stored as binary here too
+		payload = rawPayload(data)
+	case len(entry.Payload) > 0:
+		payload = rawPayload(entry.Payload)
+	}
+	record := logRecord{
+		LogEntry: LogEntry{
+			Topic:     entry.Topic,
+			Key:       entry.Key,
+			Payload:   payload,
+			Timestamp: entry.Timestamp,
+		},
+		ID:    entry.ID,
+		fills: entry.Fills,
+	}
+	_, err := w.appendRecord(record, w.commit)
+	return err
+}
+
+// ** whether a Follower is writing to the wal
+func (w *WAL) following() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.follower != nil
+}
+
+// ** turn a write endpoint away while the wal follows a leader
+func (w *WAL) leaderOnly(handle http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if w.following() {
+			http.Error(writer, "Following a leader, write to the leader instead", http.StatusServiceUnavailable)
+			return
+		}
+		handle(writer, request)
+	}
+}
+
+// ** handle the replication status request
+// ** reports the leader, whether the stream is connected and how many
+// ** entries the follower is behind
+func (w *WAL) handleReplicationStatus(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.mu.Lock()
+	follower := w.follower
+	w.mu.Unlock()
+	if follower == nil {
+		http.Error(writer, "Not following a leader", http.StatusNotFound)
+		return
+	}
+	status := follower.Status()
+	var lastContact interface{}
+	if !status.LastContact.IsZero() {
+		lastContact = status.LastContact.UTC().Format(time.RFC3339Nano)
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(map[string]interface{}{
+		"leader":             status.Leader,
+		"connected":          status.Connected,
+		"last_applied":       status.LastApplied,
+		"leader_last_offset": status.LeaderLastOffset,
+		"lag":                status.Lag,
+		"last_contact":       lastContact,
+		"last_error":         status.LastError,
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ** a local write on a follower would take an offset the leader hands out
+func TestFollowerRejectsWrites(t *testing.T) {
+	leader := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Error(writer, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer leader.Close()
+	wal, err := newWriteAheadLOG(Options{Directory: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	write := wal.leaderOnly(wal.ServerHTTP)
+
+	follower, err := wal.Follow(leader.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	write(recorder, httptest.NewRequest(http.MethodPost, "/write", strings.NewReader(`{"topic":"t","payload":"a"}`)))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("write while following got status %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+	}
+	if entries, err := wal.ReadFrom(0); err != nil || len(entries) != 0 {
+		t.Fatalf("write while following reached the wal: %d entries, %v", len(entries), err)
+	}
+
+	follower.Stop()
+	recorder = httptest.NewRecorder()
+	write(recorder, httptest.NewRequest(http.MethodPost, "/write", strings.NewReader(`{"topic":"t","payload":"a"}`)))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("write after Stop got status %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// ** a follower must hold what the leader holds, binary payloads as bytes
+// ** with the same checksum and idempotency keys that still deduplicate
+func TestFollowerKeepsBinaryAndIdempotencyKey(t *testing.T) {
+	leaderDir := t.TempDir()
+	leaderWAL, err := newWriteAheadLOG(Options{Directory: leaderDir, SyncPolicy: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leaderWAL.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", leaderWAL.handleStream)
+	mux.HandleFunc("/status", leaderWAL.handleStatus)
+	leader := httptest.NewServer(mux)
+	defer leader.Close()
+
+	binary := []byte{0xff, 0x00, 'x'}
+	if _, err := leaderWAL.WriteRaw("t", binary); err != nil {
+		t.Fatal(err)
+	}
+	first, _, err := leaderWAL.WriteLogIdempotent("order-1", "t", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	followerDir := t.TempDir()
+	wal, err := newWriteAheadLOG(Options{Directory: followerDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	follower, err := wal.Follow(leader.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := wal.ReadFrom(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 2 {
+			if payload, ok := entries[0].Payload.([]byte); !ok || !bytes.Equal(payload, binary) {
+				t.Fatalf("follower read the binary payload as %#v", entries[0].Payload)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower has %d entries, want 2: %+v", len(entries), follower.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	follower.Stop()
+
+	// ** same records byte for byte, headers aside, so the checksums match
+	leaderData, err := os.ReadFile(segmentFileName(leaderDir, leaderWAL.currentSegmentIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	followerData, err := os.ReadFile(segmentFileName(followerDir, wal.currentSegmentIndex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(leaderData[segmentHeaderSize:], followerData[segmentHeaderSize:]) {
+		t.Fatalf("follower records differ from the leader's:\n%s\n%s", leaderData[segmentHeaderSize:], followerData[segmentHeaderSize:])
+	}
+
+	offset, duplicate, err := wal.WriteLogIdempotent("order-1", "t", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !duplicate || offset != first {
+		t.Fatalf("retry on the follower got offset %d, duplicate %v, want offset %d as a duplicate", offset, duplicate, first)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ** how long a reservation may stay open before it is aborted for its holder
+const defaultReservationTimeout = 30 * time.Second
+
+// ** the reservation was committed, aborted or timed out already
+var ErrReservationDone = errors.New("reservation is already resolved")
+
+// ** an offset held for an entry that is only written once the work it
+// ** depends on is done, for transactional outbox patterns
+// ** Reserve writes a placeholder at the offset right away, a record readers
+// ** skip, so other writes carry on behind it while the reservation is open
+// ** Commit appends the entry at the end of the log under the reserved
+// ** offset, readers and watchers get it where it was committed, after the
+// ** entries written meanwhile, and the offset its record takes is never read
+// ** an aborted reservation or one the process dies with is only its
+// ** placeholder, so the offset stays a gap and is never reused
+type Reservation struct {
+	wal    *WAL
+	topic  string
+	offset int64
+	timer  *time.Timer
+	// ** guarded by the wal's mutex
+	done bool
+}
+
+// ** hold the next offset for an entry of topic
+// ** it is aborted after Options.ReservationTimeout, ReserveFor takes a
+// ** timeout for this reservation alone
+func (w *WAL) Reserve(topic string) (*Reservation, error) {
+	return w.ReserveFor(topic, 0)
+}
+
+// ** Reserve that is aborted after timeout instead of the wal's reservation
+// ** timeout, zero or less keeps the wal's
+func (w *WAL) ReserveFor(topic string, timeout time.Duration) (_ *Reservation, err error) {
+	if timeout <= 0 {
+		timeout = w.reservationTimeout
+	}
+	defer w.metrics.countError(&err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, ErrClosed
+	}
+	reserved, err := w.appendRecord(logRecord{LogEntry: LogEntry{Topic: topic}, skip: true}, w.commit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write reservation: %w", err)
+	}
+	r := &Reservation{wal: w, topic: topic, offset: reserved}
+	w.reservations[r] = struct{}{}
+	r.timer = time.AfterFunc(timeout, func() {
+		if err := r.Abort(); err != nil && !errors.Is(err, ErrReservationDone) && !errors.Is(err, ErrClosed) {
+			w.metrics.errors.Add(1)
+			w.logger.Error("failed to abort timed out reservation", "offset", r.offset, "err", err)
+		}
+	})
+	return r, nil
+}
+
+// ** the offset the entry is read under
+func (r *Reservation) Offset() int64 {
+	return r.offset
+}
+
+// ** append the entry under the reserved offset
+func (r *Reservation) Commit(payload interface{}) (err error) {
+	w := r.wal
+	defer w.metrics.countError(&err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if r.done {
+		return ErrReservationDone
+	}
+	if w.closed {
+		return ErrClosed
+	}
+	// ** released even if the write fails, the placeholder then stays a gap
+	// ** like after a crash
+	defer w.releaseReservation(r)
+	_, err = w.appendRecord(logRecord{LogEntry: LogEntry{Topic: r.topic, Payload: payload}, fills: r.offset}, w.commit)
+	return err
+}
+
+// ** give the offset up, its placeholder is all that is left of it
+func (r *Reservation) Abort() error {
+	w := r.wal
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if r.done {
+		return ErrReservationDone
+	}
+	if w.closed {
+		return ErrClosed
+	}
+	w.releaseReservation(r)
+	return nil
+}
+
+// ** must be called with the mutex held
+func (w *WAL) releaseReservation(r *Reservation) {
+	r.done = true
+	r.timer.Stop()
+	delete(w.reservations, r)
+}
+
+// ** resolve every open reservation whose placeholder a truncation to
+// ** offset removes, the offset is handed out again and a commit under it
+// ** would clash with the entry written there
+// ** must be called with the mutex held
+func (w *WAL) dropReservationsAfter(offset int64) {
+	for r := range w.reservations {
+		if r.offset > offset {
+			w.releaseReservation(r)
+		}
+	}
+}
+
+// ** the entry as readers see it, a committed reservation under the offset
+// ** it reserved
+func (r logRecord) entry() LogEntry {
+	entry := r.LogEntry
+	if r.fills > 0 {
+		entry.Offset = r.fills
+	}
+	return entry
+}
+
+// ** whether readers see record, an aborted reservation is never read
+func (r logRecord) readable(topics []string) bool {
+	return !r.skip && matchesTopic(r.Topic, topics)
+}
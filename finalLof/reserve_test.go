@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// ** writes go on while a reservation is open, and the committed entry is
+// ** read under its reserved offset where it was committed
+func TestReserveDoesNotBlockWriters(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{Directory: dir}
+	wal, err := newWriteAheadLOG(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reservation, err := wal.Reserve("outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	watched, stop := wal.Watch(0)
+	defer stop()
+
+	written := make(chan int64, 1)
+	go func() {
+		offset, err := wal.WriteLog("orders", "unrelated")
+		if err != nil {
+			t.Error(err)
+		}
+		written <- offset
+	}()
+	var after int64
+	select {
+	case after = <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write blocked behind an open reservation")
+	}
+	if after != reservation.Offset()+1 {
+		t.Fatalf("write got offset %d, want %d right after the reserved one", after, reservation.Offset()+1)
+	}
+	if entries, err := wal.ReadFrom(0); err != nil || len(entries) != 1 || entries[0].Offset != after {
+		t.Fatalf("before the commit read %v, %v, want only offset %d", entries, err, after)
+	}
+	if err := reservation.Commit("event"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []int64{after, reservation.Offset()}
+	for _, offset := range want {
+		select {
+		case entry := <-watched:
+			if entry.Offset != offset {
+				t.Fatalf("watch got offset %d, want %d", entry.Offset, offset)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch did not see offset %d", offset)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// ** the same after a reopen, and the offset taken by the commit's
+	// ** record is not handed out again
+	wal, err = newWriteAheadLOG(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadFrom(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Offset != after || entries[1].Offset != reservation.Offset() || entries[1].Payload != "event" {
+		t.Fatalf("read %+v after reopen, want offset %d then the committed %d", entries, after, reservation.Offset())
+	}
+	next, err := wal.WriteLog("orders", "next")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != after+2 {
+		t.Fatalf("next write got offset %d, want %d", next, after+2)
+	}
+}
+
+// ** a reservation whose holder never returns is aborted after its own
+// ** timeout and leaves its offset as a gap
+func TestReserveForAbortsAfterItsTimeout(t *testing.T) {
+	wal, err := newWriteAheadLOG(Options{Directory: t.TempDir(), ReservationTimeout: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	reservation, err := wal.ReserveFor("outbox", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := reservation.Commit("late"); !errors.Is(err, ErrReservationDone) {
+		t.Fatalf("commit after the timeout returned %v, want ErrReservationDone", err)
+	}
+	offset, err := wal.WriteLog("t", "after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset <= reservation.Offset() {
+		t.Fatalf("write got offset %d, the reserved %d was handed out again", offset, reservation.Offset())
+	}
+	if entries, err := wal.ReadFrom(0); err != nil || len(entries) != 1 {
+		t.Fatalf("read %v, %v, want only the write after the gap", entries, err)
+	}
+}
+
+// ** a truncation that removes the placeholder resolves the reservation,
+// ** its offset goes to the next write
+func TestTruncateResolvesReservation(t *testing.T) {
+	wal, err := newWriteAheadLOG(Options{Directory: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	first, err := wal.WriteLog("t", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reservation, err := wal.Reserve("outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.TruncateAfter(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := reservation.Commit("event"); !errors.Is(err, ErrReservationDone) {
+		t.Fatalf("commit after its placeholder was cut returned %v, want ErrReservationDone", err)
+	}
+	if offset, err := wal.WriteLog("t", "b"); err != nil || offset != reservation.Offset() {
+		t.Fatalf("write after the cut got %d, %v, want offset %d", offset, err, reservation.Offset())
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ** limits on how much closed data the WAL keeps around
+// ** a zero field means that limit is not enforced
+// ** the active segment is never removed, whatever the limits say
+type RetentionPolicy struct {
+	MaxBytes    int64
+	MaxSegments int
+	MaxAge      time.Duration
+}
+
+func (r RetentionPolicy) enabled() bool {
+	return r.MaxBytes > 0 || r.MaxSegments > 0 || r.MaxAge > 0
+}
+
+// ** all segment indexes in the directory in ascending order
+func listSegments(fs fileSystem, directory string) ([]int, error) {
+	entries, err := fs.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wal directory: %w", err)
+	}
+	var indexes []int
+	// ** a crash during compression can leave both forms of a segment
+	seen := make(map[int]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if suffix, ok := compressionSuffixes[compressionOf(name)]; ok {
+			name = strings.TrimSuffix(name, suffix)
+		}
+		if entry.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		indexStr := strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), ".log")
+		if index, err := strconv.Atoi(indexStr); err == nil && !seen[index] {
+			seen[index] = true
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
+
+// ** offset of the first record in a segment, ok is false for an empty segment
+func firstOffset(fs fileSystem, path string, encryption *recordEncryption) (offset int64, ok bool, err error) {
+	file, err := openSegment(fs, path, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, _, err := readSegmentHeader(reader)
+	if err == errTornHeader {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	line, err := reader.ReadBytes('\n')
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read segment: %w", err)
+	}
+	record, err := segmentDecoders[header.Version](encryption, line)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to decode first entry of %s: %w", path, err)
+	}
+	return record.Offset, true, nil
+}
+
+// ** delete every closed segment whose entries are all below offset
+// ** a segment is only removed once the segment after it starts at or
+// ** before offset, so no entry >= offset is ever lost
+func (w *WAL) TruncateBefore(offset int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	return w.truncateBefore(offset)
+}
+
+// ** must be called with the mutex held
+func (w *WAL) truncateBefore(offset int64) error {
+	segments := w.segments.all()
+	removed := 0
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i].index >= w.currentSegmentIndex {
+			break
+		}
+		next := segments[i+1]
+		if !next.hasBase || next.base > offset {
+			break
+		}
+		if err := w.removeSegment(segments[i].index); err != nil {
+			return err
+		}
+		removed++
+	}
+	if removed > 0 {
+		w.logger.Info("truncated before offset", "offset", offset, "segments_removed", removed)
+	}
+	return w.refreshUsage()
+}
+
+// ** drop the oldest closed segments until the retention limits hold
+// ** must be called with the mutex held
+func (w *WAL) enforceRetention() error {
+	if !w.retention.enabled() {
+		return nil
+	}
+	segments := w.segments.all()
+	var closed []segmentInfo
+	var totalSize int64
+	for _, segment := range segments {
+		if segment.index < w.currentSegmentIndex {
+			closed = append(closed, segment)
+			totalSize += segment.size
+		}
+	}
+	// ** the active segment's size changes with every write
+	totalSize += w.segmentSize
+
+	now := time.Now()
+	count := len(segments)
+	for _, segment := range closed {
+		overBytes := w.retention.MaxBytes > 0 && totalSize > w.retention.MaxBytes
+		overCount := w.retention.MaxSegments > 0 && count > w.retention.MaxSegments
+		tooOld := w.retention.MaxAge > 0 && now.Sub(segment.modTime) > w.retention.MaxAge
+		if !overBytes && !overCount && !tooOld {
+			break
+		}
+		if err := w.removeSegment(segment.index); err != nil {
+			return err
+		}
+		w.logger.Info("removed segment by retention", "segment", segment.index, "bytes", segment.size, "modified", segment.modTime)
+		totalSize -= segment.size
+		count--
+	}
+	return nil
+}
+
+// ** remove a segment because its entries are no longer needed locally
+// ** with an archiver configured the segment is uploaded first if a worker
+// ** has not done so yet, and stays readable through the archive
+func (w *WAL) removeSegment(index int) error {
+	if w.archiver != nil {
+		if err := w.archiveBeforeRemove(index); err != nil {
+			return err
+		}
+	}
+	return w.deleteSegmentFiles(index)
+}
+
+// ** delete a segment and its sidecar files
+// ** it leaves the manifest first, a crash before the files are gone only
+// ** leaves files the next open deletes
+func (w *WAL) deleteSegmentFiles(index int) error {
+	if err := w.segments.remove(index); err != nil {
+		return err
+	}
+	if err := w.fs.Remove(segmentPath(w.fs, w.directory, index)); err != nil {
+		return fmt.Errorf("failed to remove segment %d: %w", index, err)
+	}
+	return removeSidecars(w.fs, w.directory, index)
+}
+
+// ** delete the index, topic filter and time range of a segment
+func removeSidecars(fs fileSystem, directory string, index int) error {
+	if err := fs.Remove(indexFileName(directory, index)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove index of segment %d: %w", index, err)
+	}
+	if err := fs.Remove(bloomFileName(directory, index)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove topic filter of segment %d: %w", index, err)
+	}
+	if err := fs.Remove(timeRangeFileName(directory, index)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove time range of segment %d: %w", index, err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// ** when the active segment is closed and a new one started
+// ** every limit applies at once and the first one reached rotates, a zero
+// ** MaxEntries or MaxAge is not enforced
+type RotationPolicy struct {
+	// ** bytes a segment grows to, maxSegmentSize if zero
+	MaxBytes int64
+	// ** entries a segment holds
+	MaxEntries int64
+	// ** how long after its oldest entry was written a segment is rotated,
+	// ** checked in the background too so a quiet wal still rotates
+	MaxAge time.Duration
+}
+
+// ** fastest and slowest the background check of MaxAge runs
+const (
+	minRotationCheck = 10 * time.Millisecond
+	maxRotationCheck = time.Minute
+)
+
+func (p RotationPolicy) withDefaults() RotationPolicy {
+	if p.MaxBytes <= 0 {
+		p.MaxBytes = maxSegmentSize
+	}
+	return p
+}
+
+// ** whether a limit of the rotation policy is reached by the active segment
+// ** must be called with the mutex held
+func (w *WAL) rotationDue(now time.Time) bool {
+	if w.segmentSize >= w.rotation.MaxBytes {
+		return true
+	}
+	if w.rotation.MaxEntries > 0 && w.segmentEntries >= w.rotation.MaxEntries {
+		return true
+	}
+	// ** an empty segment is never rotated, whatever its age
+	return w.rotation.MaxAge > 0 && w.times.min != 0 && now.Sub(time.Unix(0, w.times.min)) >= w.rotation.MaxAge
+}
+
+// ** rotate once a limit is reached after a write, must be called with the mutex held
+func (w *WAL) rotateIfDue() error {
+	if !w.rotationDue(time.Now()) {
+		return nil
+	}
+	return w.rotateSegment()
+}
+
+func (w *WAL) startRotator() {
+	if w.rotation.MaxAge <= 0 {
+		return
+	}
+	interval := w.rotation.MaxAge / 10
+	if interval < minRotationCheck {
+		interval = minRotationCheck
+	}
+	if interval > maxRotationCheck {
+		interval = maxRotationCheck
+	}
+	w.stopRotate = make(chan struct{})
+	go w.rotateLoop(interval, w.stopRotate)
+}
+
+// ** background rotation of a segment that got too old without further writes
+func (w *WAL) rotateLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := w.rotateAged(); err != nil && !errors.Is(err, ErrClosed) {
+				w.metrics.errors.Add(1)
+				w.logger.Error("background rotation failed", "err", err)
+			}
+		}
+	}
+}
+
+func (w *WAL) rotateAged() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	return w.rotateIfDue()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ** what the wal knows about one segment on disk
+type segmentInfo struct {
+	index int
+	path  string // ** as it exists on disk, compressed or not
+	// ** offset the segment starts at, from its header, or its first record
+	// ** for segments from before headers, hasBase is false for such a
+	// ** segment that holds no record
+	base    int64
+	hasBase bool
+	// ** size and modification time of the file, the active segment's are
+	// ** only as of when it was opened
+	size    int64
+	modTime time.Time
+}
+
+// ** the segments of one wal, kept in ascending index order
+// ** retention, readers and usage accounting look segments up here instead
+// ** of listing and stat-ing the directory every time
+// ** owned by the WAL and only used with its mutex held
+type segmentManager struct {
+	fs         fileSystem
+	directory  string
+	encryption *recordEncryption
+	segments   []segmentInfo
+}
+
+// ** a manager for the segments the manifest of directory lists and the
+// ** active segment, which is added if it was only just created
+// ** without a manifest the directory is listed and one is written
+func loadSegments(fs fileSystem, directory string, encryption *recordEncryption, active int) (*segmentManager, error) {
+	m := &segmentManager{fs: fs, directory: directory, encryption: encryption}
+	manifest, ok, err := readManifest(fs, directory)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		indexes, err := listSegments(fs, directory)
+		if err != nil {
+			return nil, err
+		}
+		for _, index := range indexes {
+			manifest.Segments = append(manifest.Segments, manifestSegment{Index: index})
+		}
+	}
+	for _, listed := range manifest.Segments {
+		var info segmentInfo
+		if ok {
+			// ** the base offset is trusted, only size and time are read
+			info, err = m.stat(listed.Index)
+			info.base, info.hasBase = listed.Base, listed.HasBase
+		} else {
+			info, err = m.describe(listed.Index)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.segments = append(m.segments, info)
+	}
+	if i := m.find(active); i == len(m.segments) || m.segments[i].index != active {
+		info, err := m.describe(active)
+		if err != nil {
+			return nil, err
+		}
+		m.segments = append(m.segments, info)
+	}
+	return m, m.save()
+}
+
+// ** write the segments to the manifest
+func (m *segmentManager) save() error {
+	manifest := walManifest{Segments: make([]manifestSegment, len(m.segments))}
+	for i, segment := range m.segments {
+		manifest.Segments[i] = manifestSegment{Index: segment.index, Base: segment.base, HasBase: segment.hasBase}
+	}
+	return writeManifest(m.fs, m.directory, manifest)
+}
+
+// ** size and modification time of a segment's file
+func (m *segmentManager) stat(index int) (segmentInfo, error) {
+	path := segmentPath(m.fs, m.directory, index)
+	stat, err := m.fs.Stat(path)
+	if err != nil {
+		return segmentInfo{}, fmt.Errorf("failed to get file info: %w", err)
+	}
+	return segmentInfo{index: index, path: path, size: stat.Size(), modTime: stat.ModTime()}, nil
+}
+
+// ** read the file of a segment and its base offset from disk
+func (m *segmentManager) describe(index int) (segmentInfo, error) {
+	info, err := m.stat(index)
+	if err != nil {
+		return segmentInfo{}, err
+	}
+	info.base, info.hasBase, err = segmentBase(m.fs, info.path, m.encryption)
+	if err != nil {
+		return segmentInfo{}, err
+	}
+	return info, nil
+}
+
+// ** base offset from the segment header, the first record for a legacy one
+func segmentBase(fs fileSystem, path string, encryption *recordEncryption) (int64, bool, error) {
+	file, err := openSegment(fs, path, 0)
+	if err != nil {
+		return 0, false, err
+	}
+	header, size, err := readSegmentHeader(bufio.NewReader(file))
+	file.Close()
+	if err == errTornHeader {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if size > 0 {
+		return header.BaseOffset, true, nil
+	}
+	return firstOffset(fs, path, encryption)
+}
+
+// ** segment indexes in ascending order
+func (m *segmentManager) indexes() []int {
+	indexes := make([]int, len(m.segments))
+	for i, segment := range m.segments {
+		indexes[i] = segment.index
+	}
+	return indexes
+}
+
+// ** a copy of what is known about every segment, in ascending order
+func (m *segmentManager) all() []segmentInfo {
+	return append([]segmentInfo(nil), m.segments...)
+}
+
+func (m *segmentManager) find(index int) int {
+	return sort.Search(len(m.segments), func(i int) bool { return m.segments[i].index >= index })
+}
+
+// ** start tracking a newly created segment and list it in the manifest
+func (m *segmentManager) add(index int, base int64) error {
+	m.insert(index, base)
+	return m.save()
+}
+
+func (m *segmentManager) insert(index int, base int64) {
+	info := segmentInfo{
+		index:   index,
+		path:    segmentFileName(m.directory, index),
+		base:    base,
+		hasBase: true,
+		modTime: time.Now(),
+	}
+	i := m.find(index)
+	if i < len(m.segments) && m.segments[i].index == index {
+		m.segments[i] = info
+		return
+	}
+	m.segments = append(m.segments, segmentInfo{})
+	copy(m.segments[i+1:], m.segments[i:])
+	m.segments[i] = info
+}
+
+// ** stop tracking a segment and take it out of the manifest, before its
+// ** files are deleted
+func (m *segmentManager) remove(index int) error {
+	i := m.find(index)
+	if i < len(m.segments) && m.segments[i].index == index {
+		m.segments = append(m.segments[:i], m.segments[i+1:]...)
+		return m.save()
+	}
+	return nil
+}
+
+// ** read a segment back from disk after it was closed, compressed,
+// ** compacted or truncated
+func (m *segmentManager) refresh(index int) error {
+	info, err := m.describe(index)
+	if err != nil {
+		return err
+	}
+	i := m.find(index)
+	if i < len(m.segments) && m.segments[i].index == index {
+		previous := m.segments[i]
+		m.segments[i] = info
+		if previous.base == info.base && previous.hasBase == info.hasBase {
+			return nil
+		}
+		return m.save()
+	}
+	m.insert(index, 0)
+	m.segments[m.find(index)] = info
+	return m.save()
+}
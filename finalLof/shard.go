@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ** a wal per topic under one root directory, wal_data/<topic>/wal_N.log
+// ** every topic has its own mutex, segments, rotation and offsets, so
+// ** writers of different topics never wait for each other
+// ** offsets are per topic and start at 1 for each of them
+type ShardedWAL struct {
+	directory string
+	opts      Options
+	mu        sync.RWMutex
+	shards    map[string]*WAL
+	closed    bool
+}
+
+// ** open the root directory and every topic already in it
+// ** opts apply to each topic, opts.Directory is the root
+func OpenSharded(opts Options) (*ShardedWAL, error) {
+	if opts.Directory == "" {
+		opts.Directory = walDir
+	}
+	if opts.fs == nil {
+		opts.fs = osFS{}
+	}
+	if err := opts.fs.MkdirAll(opts.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create wal directory: %w", err)
+	}
+	sharded := &ShardedWAL{
+		directory: opts.Directory,
+		opts:      opts,
+		shards:    make(map[string]*WAL),
+	}
+	entries, err := opts.fs.ReadDir(opts.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wal directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		topic, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+		if _, err := sharded.open(topic); err != nil {
+			sharded.Close()
+			return nil, err
+		}
+	}
+	return sharded, nil
+}
+
+// ** topic names end up as directory names, escaped so any name is safe
+func shardDirName(topic string) (string, error) {
+	if topic == "" || topic == "." || topic == ".." {
+		return "", fmt.Errorf("invalid topic name %q", topic)
+	}
+	return url.PathEscape(topic), nil
+}
+
+// ** open the wal of a topic, must be called with the write lock held
+func (s *ShardedWAL) open(topic string) (*WAL, error) {
+	name, err := shardDirName(topic)
+	if err != nil {
+		return nil, err
+	}
+	opts := s.opts
+	opts.Directory = filepath.Join(s.directory, name)
+	if opts.Archiver != nil {
+		// ** every topic numbers its segments from 1, keep them apart
+		opts.Archiver = &prefixedArchiver{Archiver: s.opts.Archiver, prefix: name + "/"}
+	}
+	wal, err := newWriteAheadLOG(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open topic %q: %w", topic, err)
+	}
+	s.shards[topic] = wal
+	return wal, nil
+}
+
+// ** the wal holding a topic, created on first use
+// ** gives access to the full single wal API for that topic
+func (s *ShardedWAL) Topic(topic string) (*WAL, error) {
+	s.mu.RLock()
+	wal, ok := s.shards[topic]
+	closed := s.closed
+	s.mu.RUnlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if ok {
+		return wal, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if wal, ok := s.shards[topic]; ok {
+		return wal, nil
+	}
+	return s.open(topic)
+}
+
+// ** topics that have a wal, sorted by name
+func (s *ShardedWAL) Topics() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	topics := make([]string, 0, len(s.shards))
+	for topic := range s.shards {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// ** same signature as WAL.WriteLog, the offset is the one within the topic
+func (s *ShardedWAL) WriteLog(topic string, payload interface{}) (int64, error) {
+	wal, err := s.Topic(topic)
+	if err != nil {
+		return 0, err
+	}
+	return wal.WriteLog(topic, payload)
+}
+
+// ** entries of one topic from offset onwards, nil if the topic was never written
+func (s *ShardedWAL) ReadFrom(topic string, offset int64) ([]LogEntry, error) {
+	s.mu.RLock()
+	wal, ok := s.shards[topic]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	return wal.ReadFrom(offset)
+}
+
+// ** fsync every topic, the first error is returned after trying all of them
+func (s *ShardedWAL) Sync() error {
+	return s.each(func(wal *WAL) error { return wal.Sync() })
+}
+
+// ** close every topic, later calls to any method fail with ErrClosed
+func (s *ShardedWAL) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	return s.each(func(wal *WAL) error { return wal.Close() })
+}
+
+func (s *ShardedWAL) each(fn func(*WAL) error) error {
+	s.mu.RLock()
+	shards := make([]*WAL, 0, len(s.shards))
+	for _, wal := range s.shards {
+		shards = append(shards, wal)
+	}
+	s.mu.RUnlock()
+
+	var firstErr error
+	for _, wal := range shards {
+		if err := fn(wal); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ** stores the segments of one topic under their own key prefix
+type prefixedArchiver struct {
+	Archiver
+	prefix string
+}
+
+func (a *prefixedArchiver) Upload(ctx context.Context, name string, data io.Reader) error {
+	return a.Archiver.Upload(ctx, a.prefix+name, data)
+}
+
+func (a *prefixedArchiver) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	return a.Archiver.Download(ctx, a.prefix+name)
+}
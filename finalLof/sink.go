@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"unicode/utf8"
+)
+
+// ** an io.Writer that appends what is written to topic, so the wal can be
+// ** the durable sink behind a logger or anything else that takes a writer
+// ** every line of a Write becomes one entry, and text after the last
+// ** newline one more, so a logger that writes a line per call gets an entry
+// ** per message and nothing is held back waiting for a newline
+// ** the lines of one Write are appended as a batch, all of them or none
+func (w *WAL) TopicWriter(topic string) io.Writer {
+	return &topicWriter{wal: w, topic: topic}
+}
+
+type topicWriter struct {
+	wal   *WAL
+	topic string
+}
+
+func (t *topicWriter) Write(p []byte) (int, error) {
+	var entries []LogEntry
+	for _, line := range bytes.Split(p, []byte{'\n'}) {
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 {
+			continue
+		}
+		entries = append(entries, LogEntry{Topic: t.topic, Payload: linePayload(line)})
+	}
+	if len(entries) == 0 {
+		return len(p), nil
+	}
+	if err := t.wal.WriteBatch(entries); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ** a JSON line, as a JSON handler writes it, is kept as that JSON, other
+// ** text as a string and bytes that are not UTF-8 as binary
+func linePayload(line []byte) interface{} {
+	switch {
+	case json.Valid(line):
+		return rawPayload(bytes.Clone(line))
+	case utf8.Valid(line):
+		return string(line)
+	default:
+		return rawPayload(bytes.Clone(line))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type syncMode int
+
+const (
+	syncAlways syncMode = iota
+	syncInterval
+	syncManual
+)
+
+// ** decides when buffered writes are fsynced to disk
+// ** writes are always flushed to the OS, only the fsync is deferred
+type SyncPolicy struct {
+	mode     syncMode
+	interval time.Duration
+}
+
+// ** fsync after every write, nothing acknowledged can be lost
+var SyncAlways = SyncPolicy{mode: syncAlways}
+
+// ** never fsync on write, the caller decides by calling Sync
+var SyncManual = SyncPolicy{mode: syncManual}
+
+// ** fsync in the background at most once per interval
+// ** a crash can lose up to one interval of acknowledged writes
+func SyncEvery(interval time.Duration) SyncPolicy {
+	if interval <= 0 {
+		return SyncAlways
+	}
+	return SyncPolicy{mode: syncInterval, interval: interval}
+}
+
+// ** a policy as written on the command line or in a config, always, manual
+// ** or an interval such as 10ms
+func parseSyncPolicy(value string) (SyncPolicy, error) {
+	switch value {
+	case "", "always":
+		return SyncAlways, nil
+	case "manual":
+		return SyncManual, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return SyncPolicy{}, fmt.Errorf("invalid sync policy %q, use always, manual or an interval", value)
+	}
+	return SyncEvery(interval), nil
+}
+
+func (p SyncPolicy) String() string {
+	switch p.mode {
+	case syncInterval:
+		return fmt.Sprintf("every %s", p.interval)
+	case syncManual:
+		return "manual"
+	default:
+		return "always"
+	}
+}
+
+// ** flush and fsync everything written so far
+// ** also reports a failure from the background sync loop if there was one
+func (w *WAL) Sync() (err error) {
+	defer w.metrics.countError(&err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if err := w.syncErr; err != nil {
+		w.syncErr = nil
+		return err
+	}
+	if err := w.FlushE(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// ** make a write visible according to the sync policy
+// ** must be called with the mutex held
+func (w *WAL) commit() error {
+	if w.syncPolicy.mode == syncAlways {
+		return w.FlushE()
+	}
+	return w.flushOnly()
+}
+
+// ** hand buffered writes to the OS and leave the fsync for later
+// ** must be called with the mutex held
+func (w *WAL) flushOnly() error {
+	if err := w.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush writer: %w", err)
+	}
+	w.dirty = true
+	return nil
+}
+
+func (w *WAL) startSyncLoop() {
+	if w.syncPolicy.mode != syncInterval {
+		return
+	}
+	w.stopSync = make(chan struct{})
+	go w.syncLoop(w.syncPolicy.interval, w.stopSync)
+}
+
+// ** background fsync for SyncEvery, only touches the disk when something was written
+func (w *WAL) syncLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty && !w.closed {
+				if err := w.FlushE(); err != nil {
+					w.syncErr = err
+					w.logger.Error("background fsync failed", "segment", w.currentSegmentIndex, "err", err)
+				} else {
+					w.dirty = false
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
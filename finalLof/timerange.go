@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const timeRangeSuffix = ".time"
+
+// ** oldest and newest write time in a segment, in unix nanoseconds
+// ** kept per segment so time range reads skip segments outside the range
+// ** the wall clock can go backwards, so entries inside are not sorted by time
+type timeRange struct {
+	min, max int64
+}
+
+func (r *timeRange) add(timestamp time.Time) {
+	nanos := timestamp.UnixNano()
+	if r.min == 0 || nanos < r.min {
+		r.min = nanos
+	}
+	if nanos > r.max {
+		r.max = nanos
+	}
+}
+
+// ** whether the segment may hold entries in [from, to), a zero bound is open
+func (r *timeRange) overlaps(from, to time.Time) bool {
+	if r.max == 0 {
+		// ** empty, or only entries from before timestamps were recorded
+		return false
+	}
+	if !from.IsZero() && r.max < from.UnixNano() {
+		return false
+	}
+	if !to.IsZero() && r.min >= to.UnixNano() {
+		return false
+	}
+	return true
+}
+
+func inTimeRange(timestamp, from, to time.Time) bool {
+	if timestamp.IsZero() {
+		return false
+	}
+	if !from.IsZero() && timestamp.Before(from) {
+		return false
+	}
+	return to.IsZero() || timestamp.Before(to)
+}
+
+func timeRangeFileName(directory string, index int) string {
+	return strings.TrimSuffix(segmentFileName(directory, index), ".log") + timeRangeSuffix
+}
+
+func writeTimeRange(fs fileSystem, directory string, index int, r timeRange) error {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(r.min))
+	binary.BigEndian.PutUint64(buf[8:], uint64(r.max))
+	path := timeRangeFileName(directory, index)
+	if err := writeFile(fs, path+".tmp", buf[:], 0666); err != nil {
+		return fmt.Errorf("failed to write time range: %w", err)
+	}
+	if err := fs.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to replace time range: %w", err)
+	}
+	return nil
+}
+
+// ** scan a segment and collect its write times
+func buildTimeRange(fs fileSystem, directory string, index int, encryption *recordEncryption) (timeRange, error) {
+	var r timeRange
+	err := scanSegment(fs, segmentPath(fs, directory, index), 0, encryption, func(record logRecord, _ int64) error {
+		if !record.Timestamp.IsZero() {
+			r.add(record.Timestamp)
+		}
+		return nil
+	})
+	return r, err
+}
+
+// ** read the time range of a closed segment, building it when missing
+func loadTimeRange(fs fileSystem, directory string, index int, encryption *recordEncryption) (timeRange, error) {
+	data, err := readFile(fs, timeRangeFileName(directory, index))
+	if err == nil && len(data) == 16 {
+		return timeRange{
+			min: int64(binary.BigEndian.Uint64(data[:8])),
+			max: int64(binary.BigEndian.Uint64(data[8:])),
+		}, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return timeRange{}, fmt.Errorf("failed to read time range: %w", err)
+	}
+	r, err := buildTimeRange(fs, directory, index, encryption)
+	if err != nil {
+		return timeRange{}, err
+	}
+	return r, writeTimeRange(fs, directory, index, r)
+}
+
+// ** all entries written in [from, to), in write order, a zero bound is open
+// ** closed segments whose time range lies outside are skipped, the rest
+// ** are scanned in full since write times are not indexed inside a segment
+// ** entries from before timestamps were recorded never match, and
+// ** segments that only live in the archive are not searched
+func (w *WAL) ReadRange(from, to time.Time, topics ...string) ([]LogEntry, error) {
+	return w.ReadRangeContext(context.Background(), from, to, topics...)
+}
+
+// ** ReadRange that stops with ctx.Err() once ctx is done
+func (w *WAL) ReadRangeContext(ctx context.Context, from, to time.Time, topics ...string) ([]LogEntry, error) {
+	w.mu.Lock()
+	snap, err := w.snapshotRange(from, to, topics)
+	w.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+
+	var result []LogEntry
+	err = snap.scanSegments(ctx, func(record logRecord) error {
+		if inTimeRange(record.Timestamp, from, to) && record.readable(topics) {
+			result = append(result, record.entry())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ** snapshot of the segments whose time range overlaps [from, to)
+// ** must be called with the mutex held
+func (w *WAL) snapshotRange(from, to time.Time, topics []string) (*logSnapshot, error) {
+	indexes := w.segments.indexes()
+	var ranges []segmentRange
+	for _, index := range indexes {
+		r := w.times
+		if index < w.currentSegmentIndex {
+			var err error
+			if r, err = loadTimeRange(w.fs, w.directory, index, w.encryption); err != nil {
+				return nil, err
+			}
+		}
+		if !r.overlaps(from, to) {
+			continue
+		}
+		if len(topics) > 0 && index < w.currentSegmentIndex {
+			filter, err := loadTopicFilter(w.fs, w.directory, index, w.encryption)
+			if err != nil {
+				return nil, err
+			}
+			if !filter.mayContainAny(topics) {
+				continue
+			}
+		}
+		ranges = append(ranges, segmentRange{index: index})
+	}
+	return w.snapshot(ranges)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// ** starts the spans of wal operations: writes, batches, fsyncs, rotations
+// ** and replays, and the requests of the HTTP and gRPC servers
+// ** the wal has no tracing dependency of its own, NewOTelTracer in otel.go
+// ** wraps OpenTelemetry when the binary is built with -tags otel
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// ** ctx joined to the trace a caller propagated, header looks up the
+	// ** headers or metadata of the request
+	Extract(ctx context.Context, header func(key string) string) context.Context
+}
+
+type Span interface {
+	SetAttribute(key string, value interface{})
+	// ** a non nil err marks the span as failed
+	End(err error)
+}
+
+// ** set by otel.go when the binary is built with -tags otel, a tracer that
+// ** exports to the OTLP endpoint and a func that flushes it on shutdown
+var newServerTracer func(endpoint string) (Tracer, func(context.Context) error, error)
+
+// ** a span of an operation that holds the mutex, nil when tracing is off
+type walSpan struct {
+	wal    *WAL
+	span   Span
+	parent context.Context
+}
+
+// ** start a span under the one of the operation holding the mutex, spans
+// ** started until it ends are its children
+// ** must be called with the mutex held
+func (w *WAL) startSpan(name string) *walSpan {
+	if w.tracer == nil {
+		return nil
+	}
+	parent := w.spanCtx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, span := w.tracer.Start(parent, name)
+	w.spanCtx = ctx
+	return &walSpan{wal: w, span: span, parent: parent}
+}
+
+// ** typed rather than interface{} so a write with tracing off does not box
+// ** its attributes only to drop them
+func (s *walSpan) setInt(key string, value int64) {
+	if s != nil {
+		s.span.SetAttribute(key, value)
+	}
+}
+
+func (s *walSpan) setString(key, value string) {
+	if s != nil {
+		s.span.SetAttribute(key, value)
+	}
+}
+
+// ** must be called with the mutex held
+func (s *walSpan) end(err error) {
+	if s == nil {
+		return
+	}
+	s.span.End(err)
+	s.wal.spanCtx = s.parent
+}
+
+// ** make ctx the parent of the spans started while the mutex is held, the
+// ** returned func undoes it and is meant to be deferred
+// ** must be called with the mutex held
+func (w *WAL) traceFrom(ctx context.Context) func() {
+	if w.tracer == nil {
+		return func() {}
+	}
+	previous := w.spanCtx
+	w.spanCtx = ctx
+	return func() { w.spanCtx = previous }
+}
+
+// ** a span around every request, joined to the caller's trace if the
+// ** request carries a W3C traceparent header
+func traceHTTP(tracer Tracer, next http.Handler) http.Handler {
+	if tracer == nil {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := tracer.Extract(request.Context(), request.Header.Get)
+		ctx, span := tracer.Start(ctx, "HTTP "+request.Method)
+		span.SetAttribute("http.method", request.Method)
+		span.SetAttribute("http.target", request.URL.Path)
+		defer span.End(nil)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
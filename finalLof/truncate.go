@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ** remove every entry with an offset above offset
+// ** later segments are deleted whole, the segment holding the cut point is
+// ** replaced by a cut down copy and becomes the active segment again, and the next
+// ** write gets offset+1
+// ** watchers that were past the cut go back to it, so they receive the
+// ** entries that replace the removed ones under the same offsets
+func (w *WAL) TruncateAfter(offset int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset+1 >= w.offset {
+		return nil
+	}
+	if err := w.FlushE(); err != nil {
+		return err
+	}
+
+	indexes := w.segments.indexes()
+	start, _, err := locateOffset(w.fs, w.directory, indexes, offset+1, w.encryption)
+	if err != nil {
+		return err
+	}
+	target := indexes[start]
+	cut := int64(-1)
+	// ** a batch the cut lands in, its head claims more records than are
+	// ** kept and recovery would throw away what is left of it, so it is
+	// ** rewritten to the kept count
+	// ** the index can point into the middle of a batch, so the scan starts
+	// ** at the top of the segment to see the head
+	var batch *keptBatch
+	err = scanSegment(w.fs, segmentPath(w.fs, w.directory, target), 0, w.encryption, func(record logRecord, position int64) error {
+		if record.Offset > offset {
+			cut = position
+			return errStopScan
+		}
+		if record.Batch > 0 {
+			batch = &keptBatch{position: position, head: record, encryption: w.encryption}
+		}
+		if batch != nil {
+			batch.kept++
+			if batch.kept == batch.head.Batch {
+				batch = nil
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errStopScan {
+		return err
+	}
+
+	if err := w.closeSegmentFile(); err != nil {
+		return err
+	}
+	if err := w.indexFile.Close(); err != nil {
+		return fmt.Errorf("failed to close index file: %w", err)
+	}
+	// ** newest first, so a crash midway still leaves a contiguous log
+	for i := len(indexes) - 1; i > start; i-- {
+		if err := w.deleteSegmentFiles(indexes[i]); err != nil {
+			return err
+		}
+	}
+	w.forgetArchived(target)
+	if cut < 0 {
+		batch = nil
+	}
+	if err := truncateSegment(w.fs, w.directory, target, cut, batch); err != nil {
+		return err
+	}
+	if err := w.activateSegment(target); err != nil {
+		return err
+	}
+
+	w.offset = offset + 1
+	if w.segmentSize == 0 {
+		// ** a segment from before headers that was cut back to nothing
+		if err := w.writeSegmentHeader(); err != nil {
+			return err
+		}
+	}
+	if err := w.segments.refresh(target); err != nil {
+		return err
+	}
+	if err := writeMeta(w.fs, w.directory, walMeta{NextOffset: w.offset}); err != nil {
+		return err
+	}
+	w.truncations = append(w.truncations, w.offset)
+	w.dedup.dropFrom(w.offset)
+	w.dropReservationsAfter(offset)
+	// ** the cut segment was synced, what is left is durable
+	w.written = w.offset
+	w.durable = w.offset
+	w.logger.Info("truncated after offset", "offset", offset, "segment", target, "segments_removed", len(indexes)-1-start)
+	w.signalAppend()
+	w.signalDurable()
+	return w.refreshUsage()
+}
+
+// ** the start of a batch that a truncation cuts short
+type keptBatch struct {
+	position   int64     // ** where its head starts in the segment
+	head       logRecord // ** the head as it is on disk
+	kept       int       // ** records of the batch before the cut
+	encryption *recordEncryption
+}
+
+// ** cut a segment down to its first size bytes and leave it as a plain file
+// ** a negative size keeps the whole segment
+// ** a compressed segment is decompressed since it is about to be appended to
+// ** with batch set the head of the batch is rewritten to what is kept, the
+// ** copy goes through a temporary file so a crash leaves either version
+func truncateSegment(fs fileSystem, directory string, index int, size int64, batch *keptBatch) error {
+	path := segmentPath(fs, directory, index)
+	plain := segmentFileName(directory, index)
+
+	if path == plain && batch == nil && size < 0 {
+		return nil
+	}
+
+	source, err := openSegment(fs, path, 0)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	tmp, err := createFile(fs, plain+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create segment file: %w", err)
+	}
+	defer tmp.Close()
+
+	writer := bufio.NewWriter(tmp)
+	switch {
+	case batch != nil:
+		err = copyKeptBatch(writer, source, size, batch)
+	case size < 0:
+		_, err = io.Copy(writer, source)
+	default:
+		_, err = io.CopyN(writer, source, size)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy segment: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write segment file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync segment file: %w", err)
+	}
+	if err := fs.Rename(plain+".tmp", plain); err != nil {
+		return fmt.Errorf("failed to replace segment file: %w", err)
+	}
+	if path != plain {
+		if err := fs.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove compressed segment: %w", err)
+		}
+	}
+	return fs.SyncDir(directory)
+}
+
+// ** copy the first size bytes of source with the head of batch rewritten
+// ** to the number of records kept, 0 when the head is all that is left
+func copyKeptBatch(dst io.Writer, source io.Reader, size int64, batch *keptBatch) error {
+	if _, err := io.CopyN(dst, source, batch.position); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(source)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	head := batch.head
+	head.Batch = batch.kept
+	if head.Batch == 1 {
+		head.Batch = 0
+	}
+	if err := batch.encryption.encodeRecord(dst, head); err != nil {
+		return err
+	}
+	_, err = io.CopyN(dst, reader, size-batch.position-int64(len(line)))
+	return err
+}
+
+// ** make an existing plain segment the one new entries are appended to
+// ** its index and topic filter are rebuilt from what is on disk
+// ** must be called with the mutex held and the previous active segment closed
+func (w *WAL) activateSegment(index int) error {
+	if err := w.fs.Remove(bloomFileName(w.directory, index)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove topic filter: %w", err)
+	}
+	if err := w.fs.Remove(timeRangeFileName(w.directory, index)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove time range: %w", err)
+	}
+	_, recordCount, err := buildIndex(w.fs, w.directory, index, w.encryption)
+	if err != nil {
+		return err
+	}
+	topics, err := buildTopicFilter(w.fs, w.directory, index, w.encryption)
+	if err != nil {
+		return err
+	}
+	times, err := buildTimeRange(w.fs, w.directory, index, w.encryption)
+	if err != nil {
+		return err
+	}
+
+	file, segment, err := openActiveSegment(w.fs, segmentFileName(w.directory, index), w.preallocate, w.rotation.MaxBytes)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync segment file: %w", err)
+	}
+	indexFile, err := openIndexFile(w.fs, w.directory, index)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	w.currentSegmentIndex = index
+	w.currentSegment = file
+	w.segmentWriter = segment
+	w.indexFile = indexFile
+	w.writer.Reset(segment)
+	w.sinceIndexed = recordCount % indexInterval
+	w.segmentSize = segment.end
+	w.segmentEntries = int64(recordCount)
+	w.topics = topics
+	w.times = times
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// ** a cut inside a batch must leave a head that recovery accepts, or the
+// ** kept records and everything after them are lost on reopen
+func TestTruncateInsideBatchSurvivesReopen(t *testing.T) {
+	for _, kept := range []int{1, 3} {
+		t.Run(fmt.Sprintf("kept=%d", kept), func(t *testing.T) {
+			dir := t.TempDir()
+			options := Options{Directory: dir, Rotation: RotationPolicy{MaxBytes: 1 << 30}}
+			wal, err := newWriteAheadLOG(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			offsets, err := wal.WriteBatchOffsets(batchEntries("first", 5))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := wal.TruncateAfter(offsets[kept-1]); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := wal.WriteBatchOffsets(batchEntries("second", 2)); err != nil {
+				t.Fatal(err)
+			}
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			wal, err = newWriteAheadLOG(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wal.Close()
+			entries, err := wal.ReadFrom(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != kept+2 {
+				t.Fatalf("got %d entries after reopen, want %d", len(entries), kept+2)
+			}
+			for i, entry := range entries {
+				if entry.Offset != offsets[0]+int64(i) {
+					t.Fatalf("entry %d has offset %d, want %d", i, entry.Offset, offsets[0]+int64(i))
+				}
+			}
+		})
+	}
+}
+
+func batchEntries(topic string, n int) []LogEntry {
+	entries := make([]LogEntry, n)
+	for i := range entries {
+		entries[i] = LogEntry{Topic: topic, Payload: fmt.Sprintf("%s-%d", topic, i)}
+	}
+	return entries
+}
+
+// ** a closed segment mapped by an iterator must not shrink under it, a
+// ** read past the new end of a shared mapping is a SIGBUS
+func TestTruncateUnderMappedIterator(t *testing.T) {
+	wal, err := newWriteAheadLOG(Options{Directory: t.TempDir(), Rotation: RotationPolicy{MaxBytes: 1 << 30, MaxEntries: 10}, MmapReads: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	// ** entries well past the read buffer, so the iterator still has to
+	// ** touch the mapping after the cut
+	var offsets []int64
+	for i := 0; i < 15; i++ {
+		offset, err := wal.WriteLog("first", strings.Repeat("x", 2048))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, offset)
+	}
+
+	it := wal.NewIterator(IterOptions{})
+	defer it.Close()
+	if !it.Next() {
+		t.Fatalf("iterator is empty: %v", it.Err())
+	}
+	if err := wal.TruncateAfter(offsets[1]); err != nil {
+		t.Fatal(err)
+	}
+	seen := 1
+	for it.Next() {
+		seen++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// ** the open segment is read as it was, the ones after it are gone
+	if seen != 10 {
+		t.Fatalf("iterator yielded %d entries, want the 10 of the segment it had open", seen)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ** LogEntry with its payload decoded into T
+type TypedEntry[T any] struct {
+	Offset    int64     `json:"offset"`
+	Topic     string    `json:"topic"`
+	Key       string    `json:"key,omitempty"`
+	Payload   T         `json:"payload"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ** a view of a wal whose payloads are all of type T
+// ** payloads are stored as JSON like any other, so T must round trip
+// ** through encoding/json, and the same wal stays usable untyped
+type TypedWAL[T any] struct {
+	wal *WAL
+}
+
+func NewTypedWAL[T any](wal *WAL) *TypedWAL[T] {
+	return &TypedWAL[T]{wal: wal}
+}
+
+// ** the underlying wal, for everything that does not touch payloads
+func (t *TypedWAL[T]) Unwrap() *WAL {
+	return t.wal
+}
+
+func (t *TypedWAL[T]) WriteLog(topic string, payload T) (int64, error) {
+	return t.wal.WriteLog(topic, payload)
+}
+
+func (t *TypedWAL[T]) WriteLogContext(ctx context.Context, topic string, payload T) (int64, error) {
+	return t.wal.WriteLogContext(ctx, topic, payload)
+}
+
+// ** entries from offset onwards, an entry whose payload does not decode
+// ** into T fails the whole read
+func (t *TypedWAL[T]) ReadFrom(offset int64, topics ...string) ([]TypedEntry[T], error) {
+	return t.ReadFromContext(context.Background(), offset, topics...)
+}
+
+func (t *TypedWAL[T]) ReadFromContext(ctx context.Context, offset int64, topics ...string) ([]TypedEntry[T], error) {
+	entries, err := t.wal.ReadFromContext(ctx, offset, topics...)
+	if err != nil {
+		return nil, err
+	}
+	typed := make([]TypedEntry[T], 0, len(entries))
+	for _, entry := range entries {
+		decoded, err := decodeTypedEntry[T](entry)
+		if err != nil {
+			return nil, err
+		}
+		typed = append(typed, decoded)
+	}
+	return typed, nil
+}
+
+// ** call fn for every entry from offset onwards without holding them all
+// ** in memory, through Replay with one worker per CPU
+func (t *TypedWAL[T]) Iterate(offset int64, fn func(TypedEntry[T]) error, topics ...string) error {
+	return t.IterateContext(context.Background(), offset, fn, topics...)
+}
+
+func (t *TypedWAL[T]) IterateContext(ctx context.Context, offset int64, fn func(TypedEntry[T]) error, topics ...string) error {
+	return t.wal.ReplayContext(ctx, offset, 0, func(entry LogEntry) error {
+		decoded, err := decodeTypedEntry[T](entry)
+		if err != nil {
+			return err
+		}
+		return fn(decoded)
+	}, topics...)
+}
+
+// ** payloads come back from disk as generic JSON values, so they are
+// ** encoded again and decoded into T
+func decodeTypedEntry[T any](entry LogEntry) (TypedEntry[T], error) {
+	typed := TypedEntry[T]{
+		Offset:    entry.Offset,
+		Topic:     entry.Topic,
+		Key:       entry.Key,
+		Timestamp: entry.Timestamp,
+	}
+	if payload, ok := entry.Payload.(T); ok {
+		typed.Payload = payload
+		return typed, nil
+	}
+	data, err := json.Marshal(entry.Payload)
+	if err != nil {
+		return typed, fmt.Errorf("failed to decode payload of entry %d: %w", entry.Offset, err)
+	}
+	if err := json.Unmarshal(data, &typed.Payload); err != nil {
+		return typed, fmt.Errorf("failed to decode payload of entry %d: %w", entry.Offset, err)
+	}
+	return typed, nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// ** the merge in progress, present from when the merged file is synced
+	// ** until every source is gone
+	vacuumFileName = "wal.vacuum"
+	vacuumSuffix   = ".vacuum"
+)
+
+// ** merging of runs of small closed segments into larger ones
+// ** a segment is small once its file is below MinSize
+type VacuumPolicy struct {
+	// ** how often the background vacuum runs, off if zero
+	Interval time.Duration
+	// ** closed segments below this many bytes on disk are merged
+	MinSize int64
+	// ** largest merged segment in bytes on disk, the segment size if zero
+	MaxSize int64
+}
+
+// ** a merge of sources into the segment target, which is also the first source
+type vacuumPlan struct {
+	Target  int   `json:"target"`
+	Sources []int `json:"sources"`
+}
+
+func (w *WAL) startVacuum() {
+	if w.vacuum.Interval <= 0 {
+		return
+	}
+	w.stopVacuum = make(chan struct{})
+	go w.vacuumLoop(w.vacuum.Interval, w.stopVacuum)
+}
+
+func (w *WAL) vacuumLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if _, err := w.Vacuum(); err != nil && !errors.Is(err, ErrClosed) {
+				w.metrics.errors.Add(1)
+				w.logger.Error("background vacuum failed", "err", err)
+			}
+		}
+	}
+}
+
+// ** merge adjacent closed segments below the vacuum MinSize, returning how
+// ** many segments went away
+// ** each run is merged into its first segment, so offsets and base offsets
+// ** stay as they were and segment indexes simply get gaps, the sources are
+// ** only deleted once the merged segment is synced
+func (w *WAL) Vacuum() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if w.vacuum.MinSize <= 0 {
+		return 0, nil
+	}
+	maxSize := w.vacuum.MaxSize
+	if maxSize <= 0 {
+		maxSize = w.rotation.MaxBytes
+	}
+
+	merged := 0
+	var run []segmentInfo
+	var runSize int64
+	flush := func() error {
+		if len(run) > 1 {
+			if err := w.mergeSegments(run); err != nil {
+				return fmt.Errorf("failed to merge segments %d to %d: %w", run[0].index, run[len(run)-1].index, err)
+			}
+			merged += len(run) - 1
+		}
+		run, runSize = nil, 0
+		return nil
+	}
+	for _, segment := range w.segments.all() {
+		if segment.index >= w.currentSegmentIndex {
+			break
+		}
+		if segment.size >= w.vacuum.MinSize {
+			if err := flush(); err != nil {
+				return merged, err
+			}
+			continue
+		}
+		if runSize+segment.size > maxSize {
+			if err := flush(); err != nil {
+				return merged, err
+			}
+		}
+		run = append(run, segment)
+		runSize += segment.size
+	}
+	if err := flush(); err != nil {
+		return merged, err
+	}
+	if merged == 0 {
+		return 0, nil
+	}
+	w.metrics.vacuumed.Add(uint64(merged))
+	return merged, w.refreshUsage()
+}
+
+// ** merge a run of closed segments into its first one, must be called with
+// ** the mutex held
+func (w *WAL) mergeSegments(run []segmentInfo) error {
+	plan := vacuumPlan{Target: run[0].index}
+	for _, segment := range run {
+		plan.Sources = append(plan.Sources, segment.index)
+	}
+	// ** the merged segment is as old as its newest data, so retention does
+	// ** not remove it any earlier than the last source
+	modTime := run[len(run)-1].modTime
+	if err := w.writeMerged(run, modTime); err != nil {
+		return err
+	}
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(w.fs, filepath.Join(w.directory, vacuumFileName), data); err != nil {
+		return fmt.Errorf("failed to write vacuum plan: %w", err)
+	}
+	if err := finishVacuum(w.fs, w.directory, plan, w.encryption); err != nil {
+		return err
+	}
+
+	for _, index := range plan.Sources[1:] {
+		if err := w.segments.remove(index); err != nil {
+			return err
+		}
+		delete(w.archived, index)
+	}
+	delete(w.archived, plan.Target)
+	if w.compression != CompressionNone {
+		if err := compressSegment(w.fs, w.directory, plan.Target, w.compression); err != nil {
+			return fmt.Errorf("failed to compress segment: %w", err)
+		}
+		if err := w.fs.Chtimes(segmentPath(w.fs, w.directory, plan.Target), modTime, modTime); err != nil {
+			return err
+		}
+	}
+	if err := w.segments.refresh(plan.Target); err != nil {
+		return err
+	}
+	w.queueArchive(plan.Target)
+	return nil
+}
+
+// ** write the records of a run into the temp file of the merged segment
+// ** and sync it, a segment that does not decode to its end is refused
+// ** rather than losing what follows the damage
+func (w *WAL) writeMerged(run []segmentInfo, modTime time.Time) error {
+	merged := segmentFileName(w.directory, run[0].index) + vacuumSuffix
+	tmp, err := createFile(w.fs, merged)
+	if err != nil {
+		return fmt.Errorf("failed to create merged segment: %w", err)
+	}
+	defer tmp.Close()
+	out := bufio.NewWriterSize(tmp, bufferSize)
+
+	// ** a legacy segment without records has no base, the next one's is the same
+	header := segmentHeader{Version: segmentVersion, Created: time.Now().UTC()}
+	for _, segment := range run {
+		if segment.hasBase {
+			header.BaseOffset = segment.base
+			break
+		}
+	}
+	if _, err := out.Write(header.encode()); err != nil {
+		return err
+	}
+	for _, segment := range run {
+		if err := w.copyRecords(out, segment); err != nil {
+			w.fs.Remove(merged)
+			return err
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync merged segment: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return w.fs.Chtimes(merged, modTime, modTime)
+}
+
+// ** append every record of one segment to out, lines are copied as they
+// ** are unless the segment was written in another format version
+func (w *WAL) copyRecords(out *bufio.Writer, segment segmentInfo) error {
+	source, err := openSegment(w.fs, segment.path, 0)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	reader := bufio.NewReader(source)
+	header, position, err := readSegmentHeader(reader)
+	if err == errTornHeader {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	decode := segmentDecoders[header.Version]
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read segment %d: %w", segment.index, err)
+		}
+		record, err := decode(w.encryption, line)
+		if err != nil {
+			return fmt.Errorf("segment %d is damaged at position %d, run walctl repair: %w", segment.index, position, err)
+		}
+		if header.Version == segmentVersion {
+			_, err = out.Write(line)
+		} else {
+			err = w.encryption.encodeRecord(out, record)
+		}
+		if err != nil {
+			return err
+		}
+		position += int64(len(line))
+	}
+}
+
+// ** put the merged segment in place of its sources and rebuild its sidecars
+// ** every step can be repeated, so a merge cut short by a crash is finished
+// ** by running this again
+func finishVacuum(fs fileSystem, directory string, plan vacuumPlan, encryption *recordEncryption) error {
+	plain := segmentFileName(directory, plan.Target)
+	if _, err := fs.Stat(plain + vacuumSuffix); err == nil {
+		// ** the plain file wins over a compressed one of the same index, so
+		// ** the merged contents are in effect from the rename on
+		if err := fs.Rename(plain+vacuumSuffix, plain); err != nil {
+			return fmt.Errorf("failed to replace segment file: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, suffix := range compressionSuffixes {
+		if err := fs.Remove(plain + suffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove compressed segment: %w", err)
+		}
+	}
+	// ** the target holds the sources now, they leave the manifest before
+	// ** they are deleted like any other segment
+	if err := dropFromManifest(fs, directory, plan.Sources[1:]); err != nil {
+		return err
+	}
+	// ** newest first, so a crash midway still leaves the oldest sources
+	// ** next to the merged segment that already holds them
+	for i := len(plan.Sources) - 1; i > 0; i-- {
+		index := plan.Sources[i]
+		if err := fs.Remove(segmentPath(fs, directory, index)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove segment %d: %w", index, err)
+		}
+		if err := removeSidecars(fs, directory, index); err != nil {
+			return err
+		}
+	}
+
+	if _, _, err := buildIndex(fs, directory, plan.Target, encryption); err != nil {
+		return err
+	}
+	filter, err := buildTopicFilter(fs, directory, plan.Target, encryption)
+	if err != nil {
+		return err
+	}
+	if err := writeTopicFilter(fs, directory, plan.Target, filter); err != nil {
+		return err
+	}
+	times, err := buildTimeRange(fs, directory, plan.Target, encryption)
+	if err != nil {
+		return err
+	}
+	if err := writeTimeRange(fs, directory, plan.Target, times); err != nil {
+		return err
+	}
+	if err := fs.Remove(filepath.Join(directory, vacuumFileName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove vacuum plan: %w", err)
+	}
+	return fs.SyncDir(directory)
+}
+
+// ** finish a merge a crash interrupted, or drop a merged file that never
+// ** got as far as its plan, in which case the sources are all still there
+func recoverVacuum(fs fileSystem, directory string, encryption *recordEncryption) error {
+	data, err := readFile(fs, filepath.Join(directory, vacuumFileName))
+	if os.IsNotExist(err) {
+		entries, err := fs.ReadDir(directory)
+		if err != nil {
+			return fmt.Errorf("failed to read directory: %w", err)
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, ".log"+vacuumSuffix) {
+				continue
+			}
+			if err := fs.Remove(filepath.Join(directory, name)); err != nil {
+				return fmt.Errorf("failed to remove unfinished merge: %w", err)
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read vacuum plan: %w", err)
+	}
+	var plan vacuumPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return fmt.Errorf("failed to decode vacuum plan: %w", err)
+	}
+	if len(plan.Sources) == 0 || plan.Sources[0] != plan.Target {
+		return fmt.Errorf("damaged vacuum plan")
+	}
+	return finishVacuum(fs, directory, plan, encryption)
+}
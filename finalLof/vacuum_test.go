@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ** a wal of four closed segments with two entries each and an active one
+func writeVacuumWAL(t *testing.T, dir string) *WAL {
+	t.Helper()
+	wal, err := newWriteAheadLOG(Options{Directory: dir, Rotation: RotationPolicy{MaxBytes: 1 << 30, MaxEntries: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range batchEntries("t", 9) {
+		if _, err := wal.WriteLog(entry.Topic, entry.Payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return wal
+}
+
+// ** every entry is there once and in order, and nothing of the merge is left
+func checkVacuumRecovered(t *testing.T, dir string) []int {
+	t.Helper()
+	wal, err := newWriteAheadLOG(Options{Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadFrom(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 9 {
+		t.Fatalf("got %d entries after recovery, want 9", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Offset != int64(i+1) {
+			t.Fatalf("entry %d has offset %d, want %d", i, entry.Offset, i+1)
+		}
+	}
+	leftover, err := filepath.Glob(filepath.Join(dir, "*"+vacuumSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftover) > 0 {
+		t.Fatalf("merge files left behind: %v", leftover)
+	}
+	return wal.segments.indexes()
+}
+
+// ** a merged file without its plan was cut short before the sources were
+// ** touched, recovery throws it away and keeps the sources
+func TestVacuumRecoveryWithoutPlan(t *testing.T) {
+	dir := t.TempDir()
+	wal := writeVacuumWAL(t, dir)
+	before := wal.segments.indexes()
+	wal.mu.Lock()
+	err := wal.writeMerged(wal.segments.all()[:3], time.Now())
+	wal.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := checkVacuumRecovered(t, dir); len(after) != len(before) {
+		t.Fatalf("segments %v after recovery, want the sources %v kept", after, before)
+	}
+}
+
+// ** with the plan written the merge is finished, whether the crash came
+// ** before the merged file replaced the target or after sources were removed
+func TestVacuumRecoveryWithPlan(t *testing.T) {
+	for _, crash := range []string{"before rename", "after removing a source"} {
+		t.Run(crash, func(t *testing.T) {
+			dir := t.TempDir()
+			wal := writeVacuumWAL(t, dir)
+			before := wal.segments.indexes()
+			wal.mu.Lock()
+			run := wal.segments.all()[:3]
+			plan := vacuumPlan{Target: run[0].index}
+			for _, segment := range run {
+				plan.Sources = append(plan.Sources, segment.index)
+			}
+			err := wal.writeMerged(run, run[2].modTime)
+			wal.mu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := json.Marshal(plan)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, vacuumFileName), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if crash == "after removing a source" {
+				plain := segmentFileName(dir, plan.Target)
+				if err := os.Rename(plain+vacuumSuffix, plain); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Remove(segmentFileName(dir, plan.Sources[2])); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			after := checkVacuumRecovered(t, dir)
+			if len(after) != len(before)-2 || after[0] != plan.Target {
+				t.Fatalf("segments %v after recovery, want %v merged into %d", after, before, plan.Target)
+			}
+			if _, err := os.Stat(filepath.Join(dir, vacuumFileName)); !os.IsNotExist(err) {
+				t.Fatalf("vacuum plan still there: %v", err)
+			}
+		})
+	}
+}
+
+// ** recovery lists the directory through the fileSystem, so a merged file
+// ** left in memory goes the same way as one on disk
+func TestVacuumRecoveryOnMemFS(t *testing.T) {
+	fs := newMemFS()
+	if err := fs.MkdirAll("wal", 0755); err != nil {
+		t.Fatal(err)
+	}
+	stale := segmentFileName("wal", 1) + vacuumSuffix
+	if err := writeFile(fs, stale, []byte("unfinished"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := recoverVacuum(fs, "wal", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("unfinished merge still there: %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ** the first problem Verify found in a segment
+type SegmentCorruption struct {
+	Segment  int    `json:"segment"`
+	Path     string `json:"path"`
+	Position int64  `json:"position"`
+	Reason   string `json:"reason"`
+	// ** records before Position that checked out
+	GoodEntries int `json:"good_entries"`
+}
+
+// ** walk every local segment checking record framing, checksums and offset
+// ** order, returning the first corruption of each segment, none if all is well
+// ** closed segments are checked without holding the mutex, only the active
+// ** one holds up writes while it is read
+func (w *WAL) Verify() ([]SegmentCorruption, error) {
+	return w.verifySegments(false)
+}
+
+// ** body of Verify, with cold only the closed segments are checked
+func (w *WAL) verifySegments(cold bool) ([]SegmentCorruption, error) {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil, ErrClosed
+	}
+	indexes := w.segments.indexes()
+	active := w.currentSegmentIndex
+	w.mu.Unlock()
+
+	var found []SegmentCorruption
+	for _, index := range indexes {
+		var report segmentReport
+		var err error
+		if index == active {
+			if cold {
+				continue
+			}
+			report, err = w.verifyActive(index)
+		} else {
+			report, err = inspectSegment(w.fs, w.directory, index, w.encryption)
+		}
+		if err != nil {
+			// ** retention or compaction removed it meanwhile
+			if _, statErr := w.fs.Stat(segmentPath(w.fs, w.directory, index)); os.IsNotExist(statErr) {
+				continue
+			}
+			return nil, err
+		}
+		if report.Corruption != nil {
+			found = append(found, SegmentCorruption{
+				Segment:     index,
+				Path:        report.Path,
+				Position:    report.Corruption.Position,
+				Reason:      report.Corruption.Reason,
+				GoodEntries: report.Entries,
+			})
+		}
+	}
+	return found, nil
+}
+
+// ** inspect the active segment with buffered writes flushed and the mutex
+// ** held, so a record that is half written does not look torn
+func (w *WAL) verifyActive(index int) (segmentReport, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return segmentReport{}, ErrClosed
+	}
+	if err := w.writer.Flush(); err != nil {
+		return segmentReport{}, err
+	}
+	return inspectSegment(w.fs, w.directory, index, w.encryption)
+}
+
+func (w *WAL) startScrubber() {
+	if w.scrubInterval <= 0 {
+		return
+	}
+	w.stopScrub = make(chan struct{})
+	go w.scrubLoop(w.scrubInterval, w.stopScrub)
+}
+
+// ** background Verify of the closed segments, results end up in Stats
+func (w *WAL) scrubLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			found, err := w.verifySegments(true)
+			if errors.Is(err, ErrClosed) {
+				return
+			}
+			if err != nil {
+				w.metrics.errors.Add(1)
+				w.logger.Error("scrub failed", "err", err)
+				continue
+			}
+			for _, segment := range found {
+				w.logger.Warn("scrub found a corrupt segment", "segment", segment.Segment, "reason", segment.Reason)
+			}
+			w.metrics.scrubRuns.Add(1)
+			w.metrics.corruptSegments.Store(int64(len(found)))
+			w.metrics.lastScrub.Store(time.Now().UnixNano())
+		}
+	}
+}
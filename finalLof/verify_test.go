@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// ** a wal of three segments with four entries each, the last one active
+func writeVerifyWAL(t *testing.T, dir string) *WAL {
+	t.Helper()
+	wal, err := newWriteAheadLOG(Options{Directory: dir, Rotation: RotationPolicy{MaxBytes: 1 << 30, MaxEntries: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range batchEntries("t", 12) {
+		if _, err := wal.WriteLog(entry.Topic, entry.Payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return wal
+}
+
+// ** change a payload in the second record of the first segment, which
+// ** still decodes but fails its checksum, and leave half a record at the
+// ** end of the second segment, returns the position of each
+func damageSegments(t *testing.T, dir string, indexes []int) (badCRC, tornTail int64) {
+	t.Helper()
+	first := segmentFileName(dir, indexes[0])
+	data, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data[segmentHeaderSize:], []byte("\n"))
+	badCRC = int64(segmentHeaderSize + len(lines[0]))
+	data = bytes.Replace(data, []byte(`"t-1"`), []byte(`"t-9"`), 1)
+	if err := os.WriteFile(first, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	second := segmentFileName(dir, indexes[1])
+	info, err := os.Stat(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(second, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(`{"offset":99,"topic":"t","pay`); err != nil {
+		t.Fatal(err)
+	}
+	return badCRC, info.Size()
+}
+
+func TestVerifyFindsDamage(t *testing.T) {
+	dir := t.TempDir()
+	wal := writeVerifyWAL(t, dir)
+	defer wal.Close()
+	indexes := wal.segments.indexes()
+	if found, err := wal.Verify(); err != nil || len(found) != 0 {
+		t.Fatalf("intact wal: %v, %v", found, err)
+	}
+	badCRC, tornTail := damageSegments(t, dir, indexes)
+
+	found, err := wal.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SegmentCorruption{
+		{Segment: indexes[0], Position: badCRC, Reason: "checksum mismatch", GoodEntries: 1},
+		{Segment: indexes[1], Position: tornTail, Reason: "torn record at end of segment", GoodEntries: 4},
+	}
+	if len(found) != len(want) {
+		t.Fatalf("got %d corruptions, want %d: %+v", len(found), len(want), found)
+	}
+	for i := range want {
+		found[i].Path = ""
+		if found[i] != want[i] {
+			t.Fatalf("corruption %d is %+v, want %+v", i, found[i], want[i])
+		}
+	}
+}
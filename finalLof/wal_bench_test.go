@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// ** the sync policies a write benchmark runs under, SyncAlways measures the
+// ** fsync of the disk more than the wal
+var benchSyncPolicies = []struct {
+	name   string
+	policy SyncPolicy
+}{
+	{"always", SyncAlways},
+	{"every10ms", SyncEvery(10 * time.Millisecond)},
+	{"manual", SyncManual},
+}
+
+// ** a wal in a fresh directory that rotates rarely unless options say
+// ** otherwise, so a benchmark measures appends rather than segment creation
+func openBenchWAL(b *testing.B, options Options) *WAL {
+	b.Helper()
+	options.Directory = b.TempDir()
+	if options.Rotation == (RotationPolicy{}) {
+		options.Rotation = RotationPolicy{MaxBytes: 64 << 20}
+	}
+	wal, err := newWriteAheadLOG(options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { wal.Close() })
+	return wal
+}
+
+// ** the append path under each sync policy, without fsyncs a syscall per
+// ** write shows up in manual
+func BenchmarkWriteLog(b *testing.B) {
+	payload := map[string]interface{}{"user": "bench", "value": 42}
+	for _, sync := range benchSyncPolicies {
+		b.Run(sync.name, func(b *testing.B) {
+			wal := openBenchWAL(b, Options{SyncPolicy: sync.policy})
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := wal.WriteLog("bench", payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// ** batches of 100 entries, each op is one batch
+func BenchmarkWriteBatch(b *testing.B) {
+	entries := make([]LogEntry, 100)
+	for i := range entries {
+		entries[i] = LogEntry{Topic: "bench", Payload: map[string]interface{}{"user": "bench", "value": i}}
+	}
+	for _, sync := range benchSyncPolicies {
+		b.Run(sync.name, func(b *testing.B) {
+			wal := openBenchWAL(b, Options{SyncPolicy: sync.policy})
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := wal.WriteBatch(entries); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// ** reading back 10000 entries spread over segments of 64KB, each op is a
+// ** full replay
+func BenchmarkReplay(b *testing.B) {
+	const count = 10000
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			wal := openBenchWAL(b, Options{SyncPolicy: SyncManual, Rotation: RotationPolicy{MaxBytes: 64 << 10}})
+			payload := map[string]interface{}{"user": "bench", "value": 42}
+			for i := 0; i < count; i++ {
+				if _, err := wal.WriteLog("bench", payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := wal.Sync(); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				seen := 0
+				err := wal.Replay(0, workers, func(LogEntry) error {
+					seen++
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if seen != count {
+					b.Fatalf("replayed %d entries, want %d", seen, count)
+				}
+			}
+		})
+	}
+}
+
+// ** encoding one record into pooled scratch buffers, the part of every
+// ** write that should not allocate once the buffers have grown
+func BenchmarkMarshalRecord(b *testing.B) {
+	record := logRecord{LogEntry: LogEntry{
+		Offset:    1,
+		Topic:     "bench",
+		Payload:   map[string]interface{}{"user": "bench", "value": 42},
+		Timestamp: time.Now(),
+	}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		scratch := getRecordScratch()
+		if _, err := marshalRecord(scratch, record); err != nil {
+			b.Fatal(err)
+		}
+		putRecordScratch(scratch)
+	}
+}
+
+// ** WriteLog with the AES-GCM sealing and base64 encoding on top
+func BenchmarkWriteLogEncrypted(b *testing.B) {
+	wal := openBenchWAL(b, Options{SyncPolicy: SyncManual, Encryption: StaticKey(bytes.Repeat([]byte{7}, 32))})
+	payload := map[string]interface{}{"user": "bench", "value": 42}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := wal.WriteLog("bench", payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
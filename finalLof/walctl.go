@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+const walctlUsage = `usage: walctl <command> [flags]
+
+commands:
+  segments   list segments with entry counts and offset ranges
+  dump       print entries as JSON lines
+  verify     check record framing and checksums of every segment
+  repair     cut corrupt segments off at their first bad record
+  info       show an overview of the WAL
+  backup     write a tar archive of the WAL directory
+  restore    recreate a WAL directory from a backup
+  bench      measure write, batch and replay throughput and latency
+  crashtest  crash a writer with injected faults and check recovery
+`
+
+// ** offline inspection of a wal directory, run as "<binary> walctl <command>"
+// ** or through a binary or symlink named walctl
+// ** it only reads segments and never recovers or truncates anything, so it
+// ** is safe to point at the directory of a running server
+// ** restore and repair are the commands that write, restore only into an
+// ** empty directory and repair only while no process has the wal open, and
+// ** bench and crashtest write to a wal of their own unless given a directory
+func runWalctl(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, walctlUsage)
+		return 2
+	}
+	commands := map[string]func([]string, io.Writer) error{
+		"segments":  walctlSegments,
+		"dump":      walctlDump,
+		"verify":    walctlVerify,
+		"repair":    walctlRepair,
+		"info":      walctlInfo,
+		"backup":    walctlBackup,
+		"restore":   walctlRestore,
+		"bench":     walctlBench,
+		"crashtest": walctlCrashTest,
+	}
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "walctl: unknown command %q\n\n%s", args[0], walctlUsage)
+		return 2
+	}
+	if err := command(args[1:], stdout); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(stderr, "walctl %s: %v\n", args[0], err)
+		}
+		return 1
+	}
+	return 0
+}
+
+func isWalctl(args []string) bool {
+	return filepath.Base(args[0]) == "walctl" || (len(args) > 1 && args[1] == "walctl")
+}
+
+func walctlArgs(args []string) []string {
+	if filepath.Base(args[0]) == "walctl" {
+		return args[1:]
+	}
+	return args[2:]
+}
+
+// ** flags shared by every command
+type walctlTarget struct {
+	dir     string
+	keyFile string
+}
+
+func (t *walctlTarget) register(flags *flag.FlagSet) {
+	flags.StringVar(&t.dir, "dir", walDir, "wal directory")
+	flags.StringVar(&t.keyFile, "key-file", "", "file holding the raw AES key of an encrypted wal")
+}
+
+func (t *walctlTarget) encryption() (*recordEncryption, error) {
+	if t.keyFile == "" {
+		return nil, checkEncryptionKey(osFS{}, t.dir, nil)
+	}
+	key, err := os.ReadFile(t.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	encryption, err := newRecordEncryption(StaticKey(key))
+	if err != nil {
+		return nil, err
+	}
+	// ** checkEncryptionKey would set up a key check file for a fresh wal
+	if _, err := os.Stat(filepath.Join(t.dir, keyCheckFileName)); os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s is not an encrypted wal", t.dir)
+	}
+	return encryption, checkEncryptionKey(osFS{}, t.dir, encryption)
+}
+
+// ** inspect every segment of the target directory
+func (t *walctlTarget) reports() ([]segmentReport, error) {
+	if _, err := os.Stat(t.dir); err != nil {
+		return nil, err
+	}
+	encryption, err := t.encryption()
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := listSegments(osFS{}, t.dir)
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]segmentReport, 0, len(indexes))
+	for _, index := range indexes {
+		report, err := inspectSegment(osFS{}, t.dir, index, encryption)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func walctlSegments(args []string, stdout io.Writer) error {
+	var target walctlTarget
+	flags := flag.NewFlagSet("segments", flag.ContinueOnError)
+	target.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	reports, err := target.reports()
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "INDEX\tFILE\tSIZE\tENTRIES\tFIRST\tLAST\tSTATUS")
+	for _, report := range reports {
+		first, last := "-", "-"
+		if report.Entries > 0 {
+			first, last = fmt.Sprint(report.FirstOffset), fmt.Sprint(report.LastOffset)
+		}
+		status := "ok"
+		if report.Corruption != nil {
+			status = fmt.Sprintf("corrupt at %d", report.Corruption.Position)
+		}
+		fmt.Fprintf(table, "%d\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			report.Index, filepath.Base(report.Path), report.Size, report.Entries, first, last, status)
+	}
+	return table.Flush()
+}
+
+func walctlDump(args []string, stdout io.Writer) error {
+	var target walctlTarget
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	target.register(flags)
+	segment := flags.Int("segment", 0, "only dump this segment index")
+	from := flags.Int64("from", 0, "first offset to dump")
+	to := flags.Int64("to", 0, "last offset to dump, 0 for no limit")
+	topic := flags.String("topic", "", "only dump entries of this topic")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	encryption, err := target.encryption()
+	if err != nil {
+		return err
+	}
+	indexes, err := listSegments(osFS{}, target.dir)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(stdout)
+	for i, index := range indexes {
+		if *segment != 0 && index != *segment {
+			continue
+		}
+		// ** the whole segment is before the range if the next one starts inside it
+		if i+1 < len(indexes) && *segment == 0 {
+			next, ok, err := firstOffset(osFS{}, segmentPath(osFS{}, target.dir, indexes[i+1]), encryption)
+			if err != nil {
+				return err
+			}
+			if ok && next <= *from {
+				continue
+			}
+		}
+		err := scanSegment(osFS{}, segmentPath(osFS{}, target.dir, index), 0, encryption, func(record logRecord, _ int64) error {
+			if record.Offset < *from || (*to > 0 && record.Offset > *to) {
+				return nil
+			}
+			if *topic != "" && record.Topic != *topic {
+				return nil
+			}
+			return encoder.Encode(record.entry())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walctlVerify(args []string, stdout io.Writer) error {
+	var target walctlTarget
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	target.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	reports, err := target.reports()
+	if err != nil {
+		return err
+	}
+
+	corrupt := 0
+	for _, report := range reports {
+		name := filepath.Base(report.Path)
+		if report.Corruption == nil {
+			fmt.Fprintf(stdout, "%s: ok, %d entries\n", name, report.Entries)
+			continue
+		}
+		corrupt++
+		fmt.Fprintf(stdout, "%s: corrupt at byte %d after %d good entries: %s\n",
+			name, report.Corruption.Position, report.Entries, report.Corruption.Reason)
+	}
+	if corrupt > 0 {
+		return fmt.Errorf("%d of %d segments corrupt", corrupt, len(reports))
+	}
+	return nil
+}
+
+func walctlRepair(args []string, stdout io.Writer) error {
+	var target walctlTarget
+	flags := flag.NewFlagSet("repair", flag.ContinueOnError)
+	target.register(flags)
+	quarantine := flags.Bool("quarantine", true, "keep the bytes cut off each segment in a .corrupt file next to it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if _, err := os.Stat(target.dir); err != nil {
+		return err
+	}
+	encryption, err := target.encryption()
+	if err != nil {
+		return err
+	}
+	repairs, err := repairDirectory(osFS{}, target.dir, encryption, *quarantine)
+	for _, repair := range repairs {
+		fmt.Fprintf(stdout, "%s: cut at byte %d, kept %d entries, dropped %d bytes: %s\n",
+			filepath.Base(repair.Path), repair.Position, repair.KeptEntries, repair.DroppedBytes, repair.Reason)
+		if repair.Quarantine != "" {
+			fmt.Fprintf(stdout, "  dropped bytes saved to %s\n", repair.Quarantine)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(repairs) == 0 {
+		fmt.Fprintln(stdout, "no corrupt segments found")
+	}
+	return nil
+}
+
+func walctlInfo(args []string, stdout io.Writer) error {
+	var target walctlTarget
+	flags := flag.NewFlagSet("info", flag.ContinueOnError)
+	target.register(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	reports, err := target.reports()
+	if err != nil {
+		return err
+	}
+	meta, err := readMeta(osFS{}, target.dir)
+	if err != nil {
+		return err
+	}
+
+	var totalSize int64
+	entries, corrupt := 0, 0
+	var first, last int64
+	for _, report := range reports {
+		totalSize += report.Size
+		if report.Corruption != nil {
+			corrupt++
+		}
+		if report.Entries == 0 {
+			continue
+		}
+		if entries == 0 {
+			first = report.FirstOffset
+		}
+		last = report.LastOffset
+		entries += report.Entries
+	}
+	next := meta.NextOffset
+	if entries > 0 && last+1 > next {
+		next = last + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	checkpoint, err := readCheckpoint(osFS{}, target.dir)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(filepath.Join(target.dir, keyCheckFileName))
+	encrypted := err == nil
+
+	table := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "directory:\t%s\n", target.dir)
+	fmt.Fprintf(table, "segments:\t%d (%d corrupt)\n", len(reports), corrupt)
+	fmt.Fprintf(table, "size:\t%d bytes\n", totalSize)
+	fmt.Fprintf(table, "entries:\t%d\n", entries)
+	if entries > 0 {
+		fmt.Fprintf(table, "offsets:\t%d - %d\n", first, last)
+	}
+	fmt.Fprintf(table, "next offset:\t%d\n", next)
+	if checkpoint != nil {
+		fmt.Fprintf(table, "checkpoint:\t%d (%s)\n", checkpoint.Offset, checkpoint.CreatedAt.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(table, "encrypted:\t%t\n", encrypted)
+	return table.Flush()
+}
+
+// ** a backup of a directory a server is writing to may end in a torn
+// ** record, which is cut off when the restored wal is opened
+// ** use Backup on the running wal for an exact snapshot
+func walctlBackup(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dir := flags.String("dir", walDir, "wal directory")
+	output := flags.String("out", "", "archive to write, stdout if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" {
+		return writeBackup(osFS{}, stdout, *dir)
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	if err := writeBackup(osFS{}, file, *dir); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync archive: %w", err)
+	}
+	return file.Close()
+}
+
+func walctlRestore(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dir := flags.String("dir", walDir, "directory to restore into, must be empty")
+	input := flags.String("in", "", "archive to read, stdin if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	source := io.Reader(os.Stdin)
+	if *input != "" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return fmt.Errorf("failed to open archive: %w", err)
+		}
+		defer file.Close()
+		source = file
+	}
+	if err := Restore(*dir, source); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "restored %s\n", *dir)
+	return nil
+}
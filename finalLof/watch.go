@@ -0,0 +1,143 @@
+package main
+
+import "context"
+
+// ** wake up everyone waiting for new entries
+// ** must be called with the mutex held
+func (w *WAL) signalAppend() {
+	if w.appended != nil {
+		close(w.appended)
+		w.appended = nil
+	}
+}
+
+// ** wake up everyone waiting for entries to become durable
+// ** must be called with the mutex held
+func (w *WAL) signalDurable() {
+	if w.synced != nil {
+		close(w.synced)
+		w.synced = nil
+	}
+}
+
+// ** the channel the next fsync that covers new entries closes
+// ** must be called with the mutex held
+func (w *WAL) durableSignal() <-chan struct{} {
+	if w.synced == nil {
+		w.synced = make(chan struct{})
+	}
+	return w.synced
+}
+
+// ** the channel the next append closes, only made once someone waits so
+// ** a write nobody watches does not allocate one
+// ** must be called with the mutex held
+func (w *WAL) appendSignal() <-chan struct{} {
+	if w.appended == nil {
+		w.appended = make(chan struct{})
+	}
+	return w.appended
+}
+
+// ** stream entries from fromOffset onwards, first replaying what is already
+// ** in the log and then following new writes as they are committed
+// ** an entry is handed out once it is written, before the fsync unless
+// ** the sync policy is SyncAlways, the HTTP /stream waits for the fsync
+// ** the returned func stops the watch, the channel is closed once the
+// ** watcher is done, either because it was cancelled or the wal was closed
+// ** after TruncateAfter the watcher resumes at the cut point, so a consumer
+// ** sees an offset it already received again and should drop what it had
+// ** from there on
+func (w *WAL) Watch(fromOffset int64) (<-chan LogEntry, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return w.WatchContext(ctx, fromOffset), cancel
+}
+
+// ** Watch that ends once ctx is done, the channel is closed as with Watch
+func (w *WAL) WatchContext(ctx context.Context, fromOffset int64) <-chan LogEntry {
+	out := make(chan LogEntry)
+	go func() {
+		defer close(out)
+		w.watch(ctx, fromOffset, false, func(record logRecord) bool {
+			select {
+			case out <- record.entry():
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return out
+}
+
+// ** WatchContext that only hands out entries an fsync has covered, for
+// ** consumers outside the process that must never see an entry a power
+// ** loss could still take back
+// ** with SyncAlways that is every entry as soon as its write returns, with
+// ** SyncEvery or SyncManual entries wait for the background sync or Sync
+// ** records are handed out whole, so the stream can pass on what a
+// ** follower needs to store them as the leader did
+func (w *WAL) watchDurable(ctx context.Context, fromOffset int64) <-chan logRecord {
+	out := make(chan logRecord)
+	go func() {
+		defer close(out)
+		w.watch(ctx, fromOffset, true, func(record logRecord) bool {
+			select {
+			case out <- record:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+	return out
+}
+
+// ** hand every record from fromOffset onwards to send as it is committed,
+// ** or made durable, until send returns false, ctx is done or the wal closes
+func (w *WAL) watch(ctx context.Context, fromOffset int64, durable bool, send func(logRecord) bool) {
+	next := fromOffset
+	w.mu.Lock()
+	seenTruncations := len(w.truncations)
+	w.mu.Unlock()
+	for {
+		// ** take the wakeup channel before reading so an append that
+		// ** lands in between is not missed
+		w.mu.Lock()
+		wait, limit := w.appendSignal(), int64(-1)
+		if durable {
+			wait, limit = w.durableSignal(), w.durable
+		}
+		closed := w.closed
+		for _, cut := range w.truncations[seenTruncations:] {
+			if cut < next {
+				next = cut
+			}
+		}
+		seenTruncations = len(w.truncations)
+		w.mu.Unlock()
+
+		records, err := w.readRecordsFrom(ctx, next)
+		if err != nil {
+			return
+		}
+		for _, record := range records {
+			if limit >= 0 && record.Offset >= limit {
+				// ** read again once the fsync covering it is done
+				break
+			}
+			if !send(record) {
+				return
+			}
+			next = record.Offset + 1
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// ** /stream must not hand out an entry before the fsync covering it
+func TestWatchDurableWaitsForSync(t *testing.T) {
+	wal, err := newWriteAheadLOG(Options{Directory: t.TempDir(), SyncPolicy: SyncManual})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watched := wal.WatchContext(ctx, 0)
+	durable := wal.watchDurable(ctx, 0)
+
+	offset, err := wal.WriteLog("t", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case entry := <-watched:
+		if entry.Offset != offset {
+			t.Fatalf("watch got offset %d, want %d", entry.Offset, offset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not see the write")
+	}
+	select {
+	case entry := <-durable:
+		t.Fatalf("durable watch got offset %d before the sync", entry.Offset)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := wal.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case entry := <-durable:
+		if entry.Offset != offset {
+			t.Fatalf("durable watch got offset %d, want %d", entry.Offset, offset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("durable watch did not see the synced write")
+	}
+}